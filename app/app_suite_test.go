@@ -7,11 +7,12 @@ import (
 
 	"github.com/Sirupsen/logrus"
 	"github.com/Tapjoy/dynamiq/app"
+	"github.com/Tapjoy/dynamiq/app/backend"
+	"github.com/Tapjoy/dynamiq/app/compressor"
+	"github.com/Tapjoy/dynamiq/app/stats"
 	"github.com/hashicorp/memberlist"
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
-	"github.com/tpjg/goriakpbc"
-	"github.com/tpjg/goriakpbc/pb"
 )
 
 var cfg *app.Config
@@ -20,7 +21,6 @@ var queues *app.Queues
 var duration time.Duration
 var memberList *memberlist.Memberlist
 var testQueueName = "test_queue"
-var RDtMap *riak.RDtMap
 
 func TestPartitions(t *testing.T) {
 	RegisterFailHandler(Fail)
@@ -44,32 +44,28 @@ var _ = BeforeSuite(func() {
 		SyncConfigInterval:    duration,
 	}
 
-	queueMap := make(map[string]*app.Queue)
-	configRDtMap := riak.RDtMap{
-		Values:   make(map[riak.MapKey]interface{}),
-		ToAdd:    make([]*pb.MapUpdate, 1),
-		ToRemove: make([]*pb.MapField, 1),
-	}
-
-	configRDtMap.Values[riak.MapKey{Key: "max_partitions", Type: pb.MapField_REGISTER}] = &riak.RDtRegister{Value: []byte(app.DefaultSettings[app.MaxPartitions])}
-	configRDtMap.Values[riak.MapKey{Key: "min_partitions", Type: pb.MapField_REGISTER}] = &riak.RDtRegister{Value: []byte(app.DefaultSettings[app.MinPartitions])}
-	configRDtMap.Values[riak.MapKey{Key: "visibility_timeout", Type: pb.MapField_REGISTER}] = &riak.RDtRegister{Value: []byte(app.DefaultSettings[app.VisibilityTimeout])}
-
-	queue := &app.Queue{
-		Name:   testQueueName,
-		Config: &configRDtMap,
-	}
-	queueMap[testQueueName] = queue
-
 	queues = &app.Queues{
-		QueueMap: queueMap,
+		QueueMap: make(map[string]*app.Queue),
 	}
 
 	cfg.Core = core
 	cfg.Queues = queues
+	cfg.Backend = backend.NewMemoryBackend()
+	cfg.Stats.Client = stats.NewNOOPClient()
+	cfg.Compressor = compressor.NewZlibCompressor()
+
+	// Create the test queue in the in-memory backend, with the default settings
+	err := cfg.InitializeQueue(testQueueName)
+	Expect(err).ToNot(HaveOccurred())
 
-	// Create a memberlist, aka the list of possible RiaQ processes to communicate with
-	memberList, _, _ = app.InitMemberList(core.Name, core.Port, core.SeedServers, core.SeedPort)
+	// Create a memberlist, aka the list of possible RiaQ processes to communicate with,
+	// with a topology following its members, and gossip spreading config changes, as when running
+	cfg.Topology = app.NewTopology(cfg)
+	cfg.Gossip = app.NewGossip(cfg)
+	memberList, _, _ = app.InitMemberList(core.Name, core.Port, core.SeedServers, core.SeedPort, cfg.Topology, cfg.Gossip)
+	// Leases are renewed by the specs which need them, rather than on an interval
+	cfg.Leases = app.NewLeases()
+	cfg.Topology.Rebalance(memberList)
 
 	// Disable log output during tests
 	logrus.SetOutput(ioutil.Discard)
@@ -0,0 +1,145 @@
+package backend
+
+import (
+	"errors"
+	"sort"
+)
+
+var (
+	// ErrNotFound represents the condition where the requested message or map
+	// does not exist in the backend. The message matches the one returned by Riak
+	// so callers comparing on the string continue to behave
+	ErrNotFound = errors.New("Object not found")
+	// ErrConflict represents the condition where a message can't be updated in place
+	// because the backend holds more than one value for it
+	ErrConflict = errors.New("Object has siblings")
+	// ErrConditionFailed represents the condition where a conditional write was refused, because
+	// the stored value no longer matched what the caller expected
+	ErrConditionFailed = errors.New("Object was changed")
+)
+
+// Backend represents the set of storage operations Dynamiq needs in order to
+// hold messages and the configuration for queues and topics
+type Backend interface {
+	// PutMessage stores the message in the given queue, indexed by its key
+	PutMessage(queueName string, message *Message) error
+	// GetMessage returns the message with the given key from the given queue
+	GetMessage(queueName string, key string) (*Message, error)
+	// RangeScan returns up to limit message keys, in order, whose id falls between
+	// bottom and top inclusive, as well as a continuation to resume the scan from
+	RangeScan(queueName string, bottom int, top int, limit uint32, continuation string) ([]string, string, error)
+	// UpdateMessage replaces the stored value of an existing message, returning ErrNotFound
+	// if it no longer exists, or ErrConflict if it has siblings
+	UpdateMessage(queueName string, message *Message) error
+	// UpdateMessageIf replaces the stored value of an existing message only if the condition holds
+	// for the value stored at the time of the write, returning ErrConditionFailed if it doesn't
+	UpdateMessageIf(queueName string, message *Message, condition func(stored *Message) bool) error
+	// DeleteMessage removes the message with the given key from the given queue
+	DeleteMessage(queueName string, key string) error
+	// DeleteMessageIf removes the message only if the condition holds for the value stored at the
+	// time of the delete, returning ErrConditionFailed if it doesn't, or ErrNotFound if there is no message
+	DeleteMessageIf(queueName string, key string, condition func(stored *Message) bool) error
+
+	// FetchMap returns the config map stored under the given key. If no map exists, an
+	// empty map is returned along with ErrNotFound
+	FetchMap(key string) (*Map, error)
+	// UpdateRegisters sets each of the provided registers on the given map in one write
+	UpdateRegisters(key string, registers map[string]string) error
+	// AddToSet adds the value to the named set on the given map
+	AddToSet(key string, set string, value string) error
+	// RemoveFromSet removes the value from the named set on the given map
+	RemoveFromSet(key string, set string, value string) error
+	// DeleteMap removes the given map entirely
+	DeleteMap(key string) error
+
+	// FetchRecord returns the registers of the record stored under the given key. Records are kept apart
+	// from the config maps and only written conditionally, so nodes can use them to claim things from each
+	// other. If no record exists, an empty map is returned along with ErrNotFound
+	FetchRecord(key string) (*Map, error)
+	// UpdateRecordIf sets each of the provided registers on the record, creating it if needed, only if the
+	// condition holds for the value stored at the time of the write - an empty map if there is none.
+	// Returns ErrConditionFailed if it doesn't
+	UpdateRecordIf(key string, registers map[string]string, condition func(stored *Map) bool) error
+	// DeleteRecordIf removes the record only if the condition holds for the value stored at the time of the
+	// delete, returning ErrConditionFailed if it doesn't, or ErrNotFound if there is no record
+	DeleteRecordIf(key string, condition func(stored *Map) bool) error
+}
+
+// Message represents a single message as it is held in the backend
+type Message struct {
+	Key         string
+	ContentType string
+	Data        []byte
+	// Meta holds small pieces of metadata stored alongside the message, such as its in-flight record
+	Meta map[string]string
+	// Siblings holds each conflicting version of the message, if the backend
+	// stored more than one value under the same key
+	Siblings []Message
+}
+
+// Conflict returns true if the backend held more than one value for the message
+func (m *Message) Conflict() bool {
+	return len(m.Siblings) > 0
+}
+
+// Map represents a CRDT style map of registers and sets, used to hold configuration
+type Map struct {
+	Registers map[string]string
+	Sets      map[string][]string
+}
+
+// NewMap returns an empty Map
+func NewMap() *Map {
+	return &Map{
+		Registers: make(map[string]string),
+		Sets:      make(map[string][]string),
+	}
+}
+
+// FetchRegister returns the value of the named register, and whether it was present
+func (m *Map) FetchRegister(name string) (string, bool) {
+	if m == nil {
+		return "", false
+	}
+	value, ok := m.Registers[name]
+	return value, ok
+}
+
+// FetchSet returns the sorted members of the named set, or nil if it was not present
+func (m *Map) FetchSet(name string) []string {
+	if m == nil {
+		return nil
+	}
+	return m.Sets[name]
+}
+
+// Copy returns a deep copy of the map, so backends can hand out snapshots
+func (m *Map) Copy() *Map {
+	c := NewMap()
+	for name, value := range m.Registers {
+		c.Registers[name] = value
+	}
+	for name, members := range m.Sets {
+		c.Sets[name] = append([]string(nil), members...)
+	}
+	return c
+}
+
+func addToSet(members []string, value string) []string {
+	i := sort.SearchStrings(members, value)
+	if i < len(members) && members[i] == value {
+		return members
+	}
+	members = append(members, "")
+	copy(members[i+1:], members[i:])
+	members[i] = value
+	return members
+}
+
+func removeFromSet(members []string, value string) []string {
+	i := sort.SearchStrings(members, value)
+	if i < len(members) && members[i] == value {
+		return append(members[:i], members[i+1:]...)
+	}
+	return members
+}
@@ -0,0 +1,364 @@
+package backend
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"strconv"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	// messagesBucket holds a nested bucket of messages per queue
+	messagesBucket = []byte("messages")
+	// mapsBucket holds the config maps
+	mapsBucket = []byte("maps")
+	// recordsBucket holds the records, which are only written conditionally
+	recordsBucket = []byte("records")
+)
+
+// BoltBackend stores messages and config in a single BoltDB file on local disk.
+// Messages are keyed by their 63 bit id encoded big endian, so the B-tree order
+// matches the id order and range scans are a cursor walk
+type BoltBackend struct {
+	db *bolt.DB
+}
+
+// NewBoltBackend opens, or creates, the BoltDB file at the given path
+func NewBoltBackend(path string) (*BoltBackend, error) {
+	// Only one process may hold the file open, don't wait forever if another node has it
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{messagesBucket, mapsBucket, recordsBucket} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &BoltBackend{db: db}, nil
+}
+
+// Close releases the BoltDB file
+func (b *BoltBackend) Close() error {
+	return b.db.Close()
+}
+
+// PutMessage stores the message. If a message already exists under the same key,
+// both are kept as siblings so the queue can read repair them as it does for Riak
+func (b *BoltBackend) PutMessage(queueName string, message *Message) error {
+	id, err := boltMessageID(message.Key)
+	if err != nil {
+		return err
+	}
+	return b.db.Update(func(tx *bolt.Tx) error {
+		queueBucket, err := tx.Bucket(messagesBucket).CreateBucketIfNotExists([]byte(queueName))
+		if err != nil {
+			return err
+		}
+		stored := message
+		if existing := queueBucket.Get(id); existing != nil {
+			var previous Message
+			if err := json.Unmarshal(existing, &previous); err != nil {
+				return err
+			}
+			siblings := previous.Siblings
+			if !previous.Conflict() {
+				siblings = []Message{previous}
+			}
+			stored = &Message{
+				Key:      message.Key,
+				Siblings: append(siblings, *message),
+			}
+		}
+		value, err := json.Marshal(stored)
+		if err != nil {
+			return err
+		}
+		return queueBucket.Put(id, value)
+	})
+}
+
+// GetMessage reads the message from the queues bucket
+func (b *BoltBackend) GetMessage(queueName string, key string) (*Message, error) {
+	id, err := boltMessageID(key)
+	if err != nil {
+		return nil, err
+	}
+	var message *Message
+	err = b.db.View(func(tx *bolt.Tx) error {
+		queueBucket := tx.Bucket(messagesBucket).Bucket([]byte(queueName))
+		if queueBucket == nil {
+			return ErrNotFound
+		}
+		value := queueBucket.Get(id)
+		if value == nil {
+			return ErrNotFound
+		}
+		message = new(Message)
+		return json.Unmarshal(value, message)
+	})
+	return message, err
+}
+
+// RangeScan walks a cursor over the queues bucket from bottom to top. The continuation
+// is the last key returned. A limit of 0 reads the whole range, as it does on Riak
+func (b *BoltBackend) RangeScan(queueName string, bottom int, top int, limit uint32, continuation string) ([]string, string, error) {
+	start := uint64(bottom)
+	if continuation != "" {
+		last, err := strconv.ParseUint(continuation, 10, 64)
+		if err != nil {
+			return nil, "", err
+		}
+		start = last + 1
+	}
+	keys := make([]string, 0)
+	next := ""
+	err := b.db.View(func(tx *bolt.Tx) error {
+		queueBucket := tx.Bucket(messagesBucket).Bucket([]byte(queueName))
+		if queueBucket == nil {
+			return nil
+		}
+		cursor := queueBucket.Cursor()
+		for k, _ := cursor.Seek(encodeBoltID(start)); k != nil; k, _ = cursor.Next() {
+			id := binary.BigEndian.Uint64(k)
+			if id > uint64(top) {
+				break
+			}
+			if limit > 0 && uint32(len(keys)) == limit {
+				// There is more to read, hand back where we stopped
+				next = keys[len(keys)-1]
+				break
+			}
+			keys = append(keys, strconv.FormatUint(id, 10))
+		}
+		return nil
+	})
+	return keys, next, err
+}
+
+// UpdateMessage replaces the stored message
+func (b *BoltBackend) UpdateMessage(queueName string, message *Message) error {
+	return b.UpdateMessageIf(queueName, message, func(*Message) bool { return true })
+}
+
+// UpdateMessageIf replaces the stored message if the condition holds, inside of a single transaction
+func (b *BoltBackend) UpdateMessageIf(queueName string, message *Message, condition func(stored *Message) bool) error {
+	id, err := boltMessageID(message.Key)
+	if err != nil {
+		return err
+	}
+	return b.db.Update(func(tx *bolt.Tx) error {
+		queueBucket, err := b.checkMessage(tx, queueName, id, condition)
+		if err != nil {
+			return err
+		}
+		value, err := json.Marshal(message)
+		if err != nil {
+			return err
+		}
+		return queueBucket.Put(id, value)
+	})
+}
+
+// DeleteMessage removes the message from the queues bucket
+func (b *BoltBackend) DeleteMessage(queueName string, key string) error {
+	id, err := boltMessageID(key)
+	if err != nil {
+		return err
+	}
+	return b.db.Update(func(tx *bolt.Tx) error {
+		queueBucket := tx.Bucket(messagesBucket).Bucket([]byte(queueName))
+		if queueBucket == nil {
+			return nil
+		}
+		return queueBucket.Delete(id)
+	})
+}
+
+// DeleteMessageIf removes the message from the queues bucket if the condition holds, inside of a
+// single transaction
+func (b *BoltBackend) DeleteMessageIf(queueName string, key string, condition func(stored *Message) bool) error {
+	id, err := boltMessageID(key)
+	if err != nil {
+		return err
+	}
+	return b.db.Update(func(tx *bolt.Tx) error {
+		queueBucket, err := b.checkMessage(tx, queueName, id, condition)
+		if err != nil {
+			return err
+		}
+		return queueBucket.Delete(id)
+	})
+}
+
+// checkMessage reads the stored message within the transaction and checks the condition against it,
+// returning the queues bucket to write to if it holds
+func (b *BoltBackend) checkMessage(tx *bolt.Tx, queueName string, id []byte, condition func(stored *Message) bool) (*bolt.Bucket, error) {
+	queueBucket := tx.Bucket(messagesBucket).Bucket([]byte(queueName))
+	if queueBucket == nil {
+		return nil, ErrNotFound
+	}
+	existing := queueBucket.Get(id)
+	if existing == nil {
+		return nil, ErrNotFound
+	}
+	var previous Message
+	if err := json.Unmarshal(existing, &previous); err != nil {
+		return nil, err
+	}
+	if previous.Conflict() {
+		return nil, ErrConflict
+	}
+	if !condition(&previous) {
+		return nil, ErrConditionFailed
+	}
+	return queueBucket, nil
+}
+
+// FetchMap reads the map from the maps bucket
+func (b *BoltBackend) FetchMap(key string) (*Map, error) {
+	m := NewMap()
+	err := b.db.View(func(tx *bolt.Tx) error {
+		value := tx.Bucket(mapsBucket).Get([]byte(key))
+		if value == nil {
+			return ErrNotFound
+		}
+		return json.Unmarshal(value, m)
+	})
+	return m, err
+}
+
+// UpdateRegisters sets each register on the map, creating the map if needed
+func (b *BoltBackend) UpdateRegisters(key string, registers map[string]string) error {
+	return b.updateMap(key, true, func(m *Map) {
+		for name, value := range registers {
+			m.Registers[name] = value
+		}
+	})
+}
+
+// AddToSet adds the value to the set on the map, creating the map if needed
+func (b *BoltBackend) AddToSet(key string, set string, value string) error {
+	return b.updateMap(key, true, func(m *Map) {
+		m.Sets[set] = addToSet(m.Sets[set], value)
+	})
+}
+
+// RemoveFromSet removes the value from the set on the map
+func (b *BoltBackend) RemoveFromSet(key string, set string, value string) error {
+	return b.updateMap(key, false, func(m *Map) {
+		m.Sets[set] = removeFromSet(m.Sets[set], value)
+	})
+}
+
+// DeleteMap removes the map from the maps bucket
+func (b *BoltBackend) DeleteMap(key string) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(mapsBucket)
+		if bucket.Get([]byte(key)) == nil {
+			return ErrNotFound
+		}
+		return bucket.Delete([]byte(key))
+	})
+}
+
+// updateMap applies the change to the stored map inside of a single transaction
+func (b *BoltBackend) updateMap(key string, create bool, change func(m *Map)) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(mapsBucket)
+		m := NewMap()
+		if value := bucket.Get([]byte(key)); value != nil {
+			if err := json.Unmarshal(value, m); err != nil {
+				return err
+			}
+		} else if !create {
+			return ErrNotFound
+		}
+		change(m)
+		value, err := json.Marshal(m)
+		if err != nil {
+			return err
+		}
+		return bucket.Put([]byte(key), value)
+	})
+}
+
+// FetchRecord reads the record from the records bucket
+func (b *BoltBackend) FetchRecord(key string) (*Map, error) {
+	m := NewMap()
+	err := b.db.View(func(tx *bolt.Tx) error {
+		value := tx.Bucket(recordsBucket).Get([]byte(key))
+		if value == nil {
+			return ErrNotFound
+		}
+		return json.Unmarshal(value, m)
+	})
+	return m, err
+}
+
+// UpdateRecordIf sets each register on the record if the condition holds, inside of a single transaction
+func (b *BoltBackend) UpdateRecordIf(key string, registers map[string]string, condition func(stored *Map) bool) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(recordsBucket)
+		m := NewMap()
+		if value := bucket.Get([]byte(key)); value != nil {
+			if err := json.Unmarshal(value, m); err != nil {
+				return err
+			}
+		}
+		if !condition(m.Copy()) {
+			return ErrConditionFailed
+		}
+		for name, value := range registers {
+			m.Registers[name] = value
+		}
+		value, err := json.Marshal(m)
+		if err != nil {
+			return err
+		}
+		return bucket.Put([]byte(key), value)
+	})
+}
+
+// DeleteRecordIf removes the record from the records bucket if the condition holds, inside of a
+// single transaction
+func (b *BoltBackend) DeleteRecordIf(key string, condition func(stored *Map) bool) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(recordsBucket)
+		value := bucket.Get([]byte(key))
+		if value == nil {
+			return ErrNotFound
+		}
+		m := NewMap()
+		if err := json.Unmarshal(value, m); err != nil {
+			return err
+		}
+		if !condition(m) {
+			return ErrConditionFailed
+		}
+		return bucket.Delete([]byte(key))
+	})
+}
+
+func boltMessageID(key string) ([]byte, error) {
+	id, err := strconv.ParseUint(key, 10, 64)
+	if err != nil {
+		return nil, err
+	}
+	return encodeBoltID(id), nil
+}
+
+func encodeBoltID(id uint64) []byte {
+	encoded := make([]byte, 8)
+	binary.BigEndian.PutUint64(encoded, id)
+	return encoded
+}
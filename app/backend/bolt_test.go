@@ -0,0 +1,174 @@
+package backend_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/Tapjoy/dynamiq/app/backend"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("BoltBackend", func() {
+
+	var (
+		store *backend.BoltBackend
+		dir   string
+		path  string
+	)
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "dynamiq")
+		Expect(err).ToNot(HaveOccurred())
+		path = filepath.Join(dir, "dynamiq.db")
+		store, err = backend.NewBoltBackend(path)
+		Expect(err).ToNot(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		store.Close()
+		os.RemoveAll(dir)
+	})
+
+	Context("RangeScan", func() {
+		BeforeEach(func() {
+			// 256 and 1 sort differently as strings and as ids
+			for _, key := range []string{"256", "1", "9223372036854775807", "70000"} {
+				store.PutMessage("queue", &backend.Message{Key: key, Data: []byte(key)})
+			}
+		})
+
+		It("should return the keys in the range in id order", func() {
+			keys, continuation, err := store.RangeScan("queue", 0, 100000, 10, "")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(keys).To(Equal([]string{"1", "256", "70000"}))
+			Expect(continuation).To(BeEmpty())
+		})
+
+		It("should page through the range using the continuation", func() {
+			keys, continuation, _ := store.RangeScan("queue", 0, 9223372036854775807, 2, "")
+			Expect(keys).To(Equal([]string{"1", "256"}))
+			keys, continuation, _ = store.RangeScan("queue", 0, 9223372036854775807, 2, continuation)
+			Expect(keys).To(Equal([]string{"70000", "9223372036854775807"}))
+			Expect(continuation).To(BeEmpty())
+		})
+
+		It("should read the whole range without a limit", func() {
+			keys, continuation, err := store.RangeScan("queue", 0, 9223372036854775807, 0, "")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(keys).To(Equal([]string{"1", "256", "70000", "9223372036854775807"}))
+			Expect(continuation).To(BeEmpty())
+		})
+
+		It("should return nothing for an unknown queue", func() {
+			keys, _, err := store.RangeScan("missing", 0, 100, 10, "")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(keys).To(BeEmpty())
+		})
+	})
+
+	Context("PutMessage", func() {
+		It("should keep both values as siblings when a key is written twice", func() {
+			store.PutMessage("queue", &backend.Message{Key: "1", Data: []byte("first")})
+			store.PutMessage("queue", &backend.Message{Key: "1", Data: []byte("second")})
+
+			message, err := store.GetMessage("queue", "1")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(message.Conflict()).To(BeTrue())
+			Expect(message.Siblings).To(HaveLen(2))
+		})
+	})
+
+	Context("DeleteMessage", func() {
+		It("should remove the message", func() {
+			store.PutMessage("queue", &backend.Message{Key: "1", Data: []byte("first")})
+			Expect(store.DeleteMessage("queue", "1")).To(Succeed())
+			_, err := store.GetMessage("queue", "1")
+			Expect(err).To(Equal(backend.ErrNotFound))
+		})
+	})
+
+	Context("Conditional writes", func() {
+		receipt := func(want string) func(*backend.Message) bool {
+			return func(stored *backend.Message) bool { return stored.Meta["receipt"] == want }
+		}
+
+		BeforeEach(func() {
+			store.PutMessage("queue", &backend.Message{Key: "1", Data: []byte("first"), Meta: map[string]string{"receipt": "a"}})
+		})
+
+		It("should only update the message while the condition holds", func() {
+			Expect(store.UpdateMessageIf("queue", &backend.Message{Key: "1", Data: []byte("first"), Meta: map[string]string{"receipt": "b"}}, receipt("a"))).To(Succeed())
+			err := store.UpdateMessageIf("queue", &backend.Message{Key: "1", Data: []byte("first"), Meta: map[string]string{"receipt": "c"}}, receipt("a"))
+			Expect(err).To(Equal(backend.ErrConditionFailed))
+
+			message, _ := store.GetMessage("queue", "1")
+			Expect(message.Meta["receipt"]).To(Equal("b"))
+		})
+
+		It("should only delete the message while the condition holds", func() {
+			Expect(store.DeleteMessageIf("queue", "1", receipt("b"))).To(Equal(backend.ErrConditionFailed))
+			Expect(store.DeleteMessageIf("queue", "1", receipt("a"))).To(Succeed())
+			Expect(store.DeleteMessageIf("queue", "1", receipt("a"))).To(Equal(backend.ErrNotFound))
+		})
+	})
+
+	Context("Maps", func() {
+		It("should store registers and sets", func() {
+			store.UpdateRegisters("config", map[string]string{"a": "1"})
+			store.AddToSet("config", "queues", "b")
+			store.AddToSet("config", "queues", "a")
+
+			m, err := store.FetchMap("config")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(m.Registers).To(Equal(map[string]string{"a": "1"}))
+			Expect(m.FetchSet("queues")).To(Equal([]string{"a", "b"}))
+		})
+
+		It("should return ErrNotFound when removing from a missing map", func() {
+			Expect(store.RemoveFromSet("config", "queues", "a")).To(Equal(backend.ErrNotFound))
+		})
+	})
+
+	Context("Records", func() {
+		unclaimed := func(stored *backend.Map) bool {
+			_, claimed := stored.FetchRegister("owner")
+			return !claimed
+		}
+
+		It("should only let the first of several writers claim a record", func() {
+			Expect(store.UpdateRecordIf("claim", map[string]string{"owner": "a"}, unclaimed)).To(Succeed())
+			Expect(store.UpdateRecordIf("claim", map[string]string{"owner": "b"}, unclaimed)).To(Equal(backend.ErrConditionFailed))
+
+			record, err := store.FetchRecord("claim")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(record.Registers).To(Equal(map[string]string{"owner": "a"}))
+		})
+
+		It("should only delete the record while the condition holds", func() {
+			store.UpdateRecordIf("claim", map[string]string{"owner": "a"}, unclaimed)
+			Expect(store.DeleteRecordIf("claim", unclaimed)).To(Equal(backend.ErrConditionFailed))
+			Expect(store.DeleteRecordIf("claim", func(*backend.Map) bool { return true })).To(Succeed())
+			_, err := store.FetchRecord("claim")
+			Expect(err).To(Equal(backend.ErrNotFound))
+		})
+	})
+
+	It("should keep messages and config across restarts", func() {
+		store.PutMessage("queue", &backend.Message{Key: "1", Data: []byte("durable")})
+		store.AddToSet("config", "queues", "queue")
+		Expect(store.Close()).To(Succeed())
+
+		var err error
+		store, err = backend.NewBoltBackend(path)
+		Expect(err).ToNot(HaveOccurred())
+
+		message, err := store.GetMessage("queue", "1")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(string(message.Data)).To(Equal("durable"))
+		m, _ := store.FetchMap("config")
+		Expect(m.FetchSet("queues")).To(Equal([]string{"queue"}))
+	})
+})
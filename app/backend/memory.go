@@ -0,0 +1,292 @@
+package backend
+
+import (
+	"sort"
+	"strconv"
+	"sync"
+)
+
+// MemoryBackend holds messages and config in process. It emulates the parts of Riak
+// Dynamiq relies on: range scans over the id_int index, siblings when two writes land
+// on the same key, and map / set / register CRDTs. Nothing is persisted
+type MemoryBackend struct {
+	// messages per queue, keyed by message key
+	messages map[string]map[string]*Message
+	// sorted message ids per queue, acting as the id_int index
+	indexes map[string][]int64
+	maps    map[string]*Map
+	records map[string]*Map
+	sync.RWMutex
+}
+
+// NewMemoryBackend returns an empty MemoryBackend
+func NewMemoryBackend() *MemoryBackend {
+	return &MemoryBackend{
+		messages: make(map[string]map[string]*Message),
+		indexes:  make(map[string][]int64),
+		maps:     make(map[string]*Map),
+		records:  make(map[string]*Map),
+	}
+}
+
+// PutMessage stores the message. If a message already exists under the same key,
+// both are kept as siblings, as Riak would with allow_mult
+func (m *MemoryBackend) PutMessage(queueName string, message *Message) error {
+	id, err := strconv.ParseInt(message.Key, 10, 64)
+	if err != nil {
+		return err
+	}
+	m.Lock()
+	defer m.Unlock()
+	if m.messages[queueName] == nil {
+		m.messages[queueName] = make(map[string]*Message)
+	}
+	stored := copyMessage(message)
+	if existing, ok := m.messages[queueName][message.Key]; ok {
+		siblings := existing.Siblings
+		if !existing.Conflict() {
+			siblings = []Message{*existing}
+		}
+		stored = &Message{
+			Key:      message.Key,
+			Siblings: append(siblings, *stored),
+		}
+	} else {
+		m.indexes[queueName] = insertID(m.indexes[queueName], id)
+	}
+	m.messages[queueName][message.Key] = stored
+	return nil
+}
+
+// GetMessage returns a copy of the stored message
+func (m *MemoryBackend) GetMessage(queueName string, key string) (*Message, error) {
+	m.RLock()
+	defer m.RUnlock()
+	message, ok := m.messages[queueName][key]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return copyMessage(message), nil
+}
+
+// RangeScan walks the sorted ids for the queue. The continuation is the last key returned. A limit of
+// 0 reads the whole range, as it does on Riak
+func (m *MemoryBackend) RangeScan(queueName string, bottom int, top int, limit uint32, continuation string) ([]string, string, error) {
+	start := int64(bottom)
+	if continuation != "" {
+		last, err := strconv.ParseInt(continuation, 10, 64)
+		if err != nil {
+			return nil, "", err
+		}
+		start = last + 1
+	}
+	m.RLock()
+	defer m.RUnlock()
+	index := m.indexes[queueName]
+	i := sort.Search(len(index), func(i int) bool { return index[i] >= start })
+	keys := make([]string, 0)
+	for ; i < len(index) && index[i] <= int64(top); i++ {
+		if limit > 0 && uint32(len(keys)) == limit {
+			// There is more to read, hand back where we stopped
+			return keys, keys[len(keys)-1], nil
+		}
+		keys = append(keys, strconv.FormatInt(index[i], 10))
+	}
+	return keys, "", nil
+}
+
+// UpdateMessage replaces the stored message
+func (m *MemoryBackend) UpdateMessage(queueName string, message *Message) error {
+	return m.UpdateMessageIf(queueName, message, func(*Message) bool { return true })
+}
+
+// UpdateMessageIf replaces the stored message if the condition holds, under the write lock
+func (m *MemoryBackend) UpdateMessageIf(queueName string, message *Message, condition func(stored *Message) bool) error {
+	m.Lock()
+	defer m.Unlock()
+	existing, ok := m.messages[queueName][message.Key]
+	if !ok {
+		return ErrNotFound
+	}
+	if existing.Conflict() {
+		return ErrConflict
+	}
+	if !condition(copyMessage(existing)) {
+		return ErrConditionFailed
+	}
+	m.messages[queueName][message.Key] = copyMessage(message)
+	return nil
+}
+
+// DeleteMessage removes the message and its index entry
+func (m *MemoryBackend) DeleteMessage(queueName string, key string) error {
+	id, err := strconv.ParseInt(key, 10, 64)
+	if err != nil {
+		return err
+	}
+	m.Lock()
+	defer m.Unlock()
+	// Riak does not complain about deleting a key that isn't there, neither do we
+	delete(m.messages[queueName], key)
+	m.indexes[queueName] = removeID(m.indexes[queueName], id)
+	return nil
+}
+
+// DeleteMessageIf removes the message and its index entry if the condition holds, under the write lock
+func (m *MemoryBackend) DeleteMessageIf(queueName string, key string, condition func(stored *Message) bool) error {
+	id, err := strconv.ParseInt(key, 10, 64)
+	if err != nil {
+		return err
+	}
+	m.Lock()
+	defer m.Unlock()
+	existing, ok := m.messages[queueName][key]
+	if !ok {
+		return ErrNotFound
+	}
+	if existing.Conflict() {
+		return ErrConflict
+	}
+	if !condition(copyMessage(existing)) {
+		return ErrConditionFailed
+	}
+	delete(m.messages[queueName], key)
+	m.indexes[queueName] = removeID(m.indexes[queueName], id)
+	return nil
+}
+
+// FetchMap returns a snapshot of the map
+func (m *MemoryBackend) FetchMap(key string) (*Map, error) {
+	m.RLock()
+	defer m.RUnlock()
+	stored, ok := m.maps[key]
+	if !ok {
+		return NewMap(), ErrNotFound
+	}
+	return stored.Copy(), nil
+}
+
+// UpdateRegisters sets each register on the map, creating the map if needed
+func (m *MemoryBackend) UpdateRegisters(key string, registers map[string]string) error {
+	m.Lock()
+	defer m.Unlock()
+	stored := m.fetchOrCreateMap(key)
+	for name, value := range registers {
+		stored.Registers[name] = value
+	}
+	return nil
+}
+
+// AddToSet adds the value to the set on the map, creating the map if needed
+func (m *MemoryBackend) AddToSet(key string, set string, value string) error {
+	m.Lock()
+	defer m.Unlock()
+	stored := m.fetchOrCreateMap(key)
+	stored.Sets[set] = addToSet(stored.Sets[set], value)
+	return nil
+}
+
+// RemoveFromSet removes the value from the set on the map
+func (m *MemoryBackend) RemoveFromSet(key string, set string, value string) error {
+	m.Lock()
+	defer m.Unlock()
+	stored, ok := m.maps[key]
+	if !ok {
+		return ErrNotFound
+	}
+	stored.Sets[set] = removeFromSet(stored.Sets[set], value)
+	return nil
+}
+
+// DeleteMap removes the map
+func (m *MemoryBackend) DeleteMap(key string) error {
+	m.Lock()
+	defer m.Unlock()
+	if _, ok := m.maps[key]; !ok {
+		return ErrNotFound
+	}
+	delete(m.maps, key)
+	return nil
+}
+
+// FetchRecord returns a snapshot of the record
+func (m *MemoryBackend) FetchRecord(key string) (*Map, error) {
+	m.RLock()
+	defer m.RUnlock()
+	stored, ok := m.records[key]
+	if !ok {
+		return NewMap(), ErrNotFound
+	}
+	return stored.Copy(), nil
+}
+
+// UpdateRecordIf sets each register on the record if the condition holds, under the write lock
+func (m *MemoryBackend) UpdateRecordIf(key string, registers map[string]string, condition func(stored *Map) bool) error {
+	m.Lock()
+	defer m.Unlock()
+	stored, ok := m.records[key]
+	if !ok {
+		stored = NewMap()
+	}
+	if !condition(stored.Copy()) {
+		return ErrConditionFailed
+	}
+	for name, value := range registers {
+		stored.Registers[name] = value
+	}
+	m.records[key] = stored
+	return nil
+}
+
+// DeleteRecordIf removes the record if the condition holds, under the write lock
+func (m *MemoryBackend) DeleteRecordIf(key string, condition func(stored *Map) bool) error {
+	m.Lock()
+	defer m.Unlock()
+	stored, ok := m.records[key]
+	if !ok {
+		return ErrNotFound
+	}
+	if !condition(stored.Copy()) {
+		return ErrConditionFailed
+	}
+	delete(m.records, key)
+	return nil
+}
+
+func (m *MemoryBackend) fetchOrCreateMap(key string) *Map {
+	stored, ok := m.maps[key]
+	if !ok {
+		stored = NewMap()
+		m.maps[key] = stored
+	}
+	return stored
+}
+
+func copyMessage(message *Message) *Message {
+	c := *message
+	c.Data = append([]byte(nil), message.Data...)
+	if message.Meta != nil {
+		c.Meta = make(map[string]string)
+		for name, value := range message.Meta {
+			c.Meta[name] = value
+		}
+	}
+	c.Siblings = append([]Message(nil), message.Siblings...)
+	return &c
+}
+
+func insertID(index []int64, id int64) []int64 {
+	i := sort.Search(len(index), func(i int) bool { return index[i] >= id })
+	index = append(index, 0)
+	copy(index[i+1:], index[i:])
+	index[i] = id
+	return index
+}
+
+func removeID(index []int64, id int64) []int64 {
+	i := sort.Search(len(index), func(i int) bool { return index[i] >= id })
+	if i < len(index) && index[i] == id {
+		return append(index[:i], index[i+1:]...)
+	}
+	return index
+}
@@ -0,0 +1,163 @@
+package backend_test
+
+import (
+	"github.com/Tapjoy/dynamiq/app/backend"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("MemoryBackend", func() {
+
+	var store *backend.MemoryBackend
+
+	BeforeEach(func() {
+		store = backend.NewMemoryBackend()
+	})
+
+	Context("RangeScan", func() {
+		BeforeEach(func() {
+			for _, key := range []string{"30", "10", "50", "20", "40"} {
+				store.PutMessage("queue", &backend.Message{Key: key, Data: []byte(key)})
+			}
+		})
+
+		It("should return the keys in the range in id order", func() {
+			keys, continuation, err := store.RangeScan("queue", 15, 45, 10, "")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(keys).To(Equal([]string{"20", "30", "40"}))
+			Expect(continuation).To(BeEmpty())
+		})
+
+		It("should page through the range using the continuation", func() {
+			keys, continuation, _ := store.RangeScan("queue", 0, 100, 2, "")
+			Expect(keys).To(Equal([]string{"10", "20"}))
+			keys, continuation, _ = store.RangeScan("queue", 0, 100, 2, continuation)
+			Expect(keys).To(Equal([]string{"30", "40"}))
+			keys, continuation, _ = store.RangeScan("queue", 0, 100, 2, continuation)
+			Expect(keys).To(Equal([]string{"50"}))
+			Expect(continuation).To(BeEmpty())
+		})
+
+		It("should read the whole range without a limit", func() {
+			keys, continuation, err := store.RangeScan("queue", 0, 100, 0, "")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(keys).To(Equal([]string{"10", "20", "30", "40", "50"}))
+			Expect(continuation).To(BeEmpty())
+		})
+
+		It("should not return deleted keys", func() {
+			store.DeleteMessage("queue", "20")
+			keys, _, _ := store.RangeScan("queue", 0, 100, 10, "")
+			Expect(keys).To(Equal([]string{"10", "30", "40", "50"}))
+		})
+	})
+
+	Context("PutMessage", func() {
+		It("should keep both values as siblings when a key is written twice", func() {
+			store.PutMessage("queue", &backend.Message{Key: "1", Data: []byte("first")})
+			store.PutMessage("queue", &backend.Message{Key: "1", Data: []byte("second")})
+
+			message, err := store.GetMessage("queue", "1")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(message.Conflict()).To(BeTrue())
+			Expect(message.Data).To(BeEmpty())
+			Expect(message.Siblings).To(HaveLen(2))
+		})
+	})
+
+	Context("Conditional writes", func() {
+		receipt := func(want string) func(*backend.Message) bool {
+			return func(stored *backend.Message) bool { return stored.Meta["receipt"] == want }
+		}
+
+		BeforeEach(func() {
+			store.PutMessage("queue", &backend.Message{Key: "1", Data: []byte("first"), Meta: map[string]string{"receipt": "a"}})
+		})
+
+		It("should only update the message while the condition holds", func() {
+			Expect(store.UpdateMessageIf("queue", &backend.Message{Key: "1", Data: []byte("first"), Meta: map[string]string{"receipt": "b"}}, receipt("a"))).To(Succeed())
+			err := store.UpdateMessageIf("queue", &backend.Message{Key: "1", Data: []byte("first"), Meta: map[string]string{"receipt": "c"}}, receipt("a"))
+			Expect(err).To(Equal(backend.ErrConditionFailed))
+
+			message, _ := store.GetMessage("queue", "1")
+			Expect(message.Meta["receipt"]).To(Equal("b"))
+		})
+
+		It("should only delete the message while the condition holds", func() {
+			Expect(store.DeleteMessageIf("queue", "1", receipt("b"))).To(Equal(backend.ErrConditionFailed))
+			Expect(store.DeleteMessageIf("queue", "1", receipt("a"))).To(Succeed())
+			Expect(store.DeleteMessageIf("queue", "1", receipt("a"))).To(Equal(backend.ErrNotFound))
+		})
+	})
+
+	Context("GetMessage", func() {
+		It("should return ErrNotFound for a missing key", func() {
+			_, err := store.GetMessage("queue", "1")
+			Expect(err).To(Equal(backend.ErrNotFound))
+		})
+	})
+
+	Context("Records", func() {
+		unclaimed := func(stored *backend.Map) bool {
+			_, claimed := stored.FetchRegister("owner")
+			return !claimed
+		}
+
+		It("should only let the first of several writers claim a record", func() {
+			Expect(store.UpdateRecordIf("claim", map[string]string{"owner": "a"}, unclaimed)).To(Succeed())
+			Expect(store.UpdateRecordIf("claim", map[string]string{"owner": "b"}, unclaimed)).To(Equal(backend.ErrConditionFailed))
+
+			record, err := store.FetchRecord("claim")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(record.Registers).To(Equal(map[string]string{"owner": "a"}))
+		})
+
+		It("should only delete the record while the condition holds", func() {
+			store.UpdateRecordIf("claim", map[string]string{"owner": "a"}, unclaimed)
+			Expect(store.DeleteRecordIf("claim", unclaimed)).To(Equal(backend.ErrConditionFailed))
+			Expect(store.DeleteRecordIf("claim", func(*backend.Map) bool { return true })).To(Succeed())
+			_, err := store.FetchRecord("claim")
+			Expect(err).To(Equal(backend.ErrNotFound))
+		})
+	})
+
+	Context("Maps", func() {
+		It("should return an empty map and ErrNotFound for a missing map", func() {
+			m, err := store.FetchMap("config")
+			Expect(err).To(Equal(backend.ErrNotFound))
+			Expect(m.FetchSet("queues")).To(BeNil())
+		})
+
+		It("should store registers and sets", func() {
+			store.UpdateRegisters("config", map[string]string{"a": "1"})
+			store.AddToSet("config", "queues", "b")
+			store.AddToSet("config", "queues", "a")
+			store.AddToSet("config", "queues", "b")
+
+			m, err := store.FetchMap("config")
+			Expect(err).ToNot(HaveOccurred())
+			value, present := m.FetchRegister("a")
+			Expect(present).To(BeTrue())
+			Expect(value).To(Equal("1"))
+			Expect(m.FetchSet("queues")).To(Equal([]string{"a", "b"}))
+
+			store.RemoveFromSet("config", "queues", "a")
+			m, _ = store.FetchMap("config")
+			Expect(m.FetchSet("queues")).To(Equal([]string{"b"}))
+		})
+
+		It("should hand out snapshots that are not affected by later writes", func() {
+			store.AddToSet("config", "queues", "a")
+			m, _ := store.FetchMap("config")
+			store.AddToSet("config", "queues", "b")
+			Expect(m.FetchSet("queues")).To(Equal([]string{"a"}))
+		})
+
+		It("should delete maps", func() {
+			store.UpdateRegisters("config", map[string]string{"a": "1"})
+			Expect(store.DeleteMap("config")).To(Succeed())
+			_, err := store.FetchMap("config")
+			Expect(err).To(Equal(backend.ErrNotFound))
+		})
+	})
+})
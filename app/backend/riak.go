@@ -0,0 +1,392 @@
+package backend
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tpjg/goriakpbc"
+	"github.com/tpjg/goriakpbc/pb"
+)
+
+// MessagesBucketType is the riak bucket type holding a bucket of messages per queue
+const MessagesBucketType = "messages"
+
+// MapsBucketType is the riak bucket type holding the config maps
+const MapsBucketType = "maps"
+
+// RecordsBucketType is the riak bucket type holding the records. It must be created with consistent
+// set to true, so riak refuses a write made against an out of date vclock
+const RecordsBucketType = "records"
+
+// ConfigurationBucket is the name of the riak bucket holding the config
+const ConfigurationBucket = "config"
+
+// idIndex is the secondary index used to range scan messages by id
+const idIndex = "id_int"
+
+// messageMetaPrefix prefixes the registers, on a message record, holding the metadata of the message
+const messageMetaPrefix = "meta_"
+
+// messageDeleted is the register, on a message record, marking a message which is being deleted
+const messageDeleted = "deleted"
+
+// RiakBackend stores messages and config in Riak 2.0, using the id_int secondary
+// index for range scans and CRDT maps for config
+type RiakBackend struct {
+	pool *riak.Client
+}
+
+// NewRiakBackend returns a RiakBackend holding a pool of connections to one of the given hosts
+func NewRiakBackend(hosts []string, poolSize int) RiakBackend {
+	rand.Seed(time.Now().UnixNano())
+	// TODO this should just be 1 HAProxy
+	host := hosts[rand.Intn(len(hosts))]
+	return RiakBackend{
+		pool: riak.NewClientPool(host, poolSize),
+	}
+}
+
+// Connection returns a pointer to the current pool of riak connections, which
+// is abstracted inside of the riak.Client object
+func (r RiakBackend) Connection() *riak.Client {
+	return r.pool
+}
+
+// PutMessage stores the message in the queues bucket, indexing it on id_int
+func (r RiakBackend) PutMessage(queueName string, message *Message) error {
+	bucket, err := r.pool.NewBucketType(MessagesBucketType, queueName)
+	if err != nil {
+		return err
+	}
+	messageObj := bucket.NewObject(message.Key)
+	messageObj.Indexes[idIndex] = []string{message.Key}
+	messageObj.ContentType = message.ContentType
+	messageObj.Data = message.Data
+	for name, value := range message.Meta {
+		messageObj.Meta[name] = value
+	}
+	return messageObj.Store()
+}
+
+// GetMessage fetches the message from the queues bucket, including any siblings, along with the metadata
+// written to its record since it was put
+func (r RiakBackend) GetMessage(queueName string, key string) (*Message, error) {
+	var record *Map
+	var recordErr error
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		record, recordErr = r.FetchRecord(messageRecordName(queueName, key))
+	}()
+	message, err := r.fetchMessage(queueName, key)
+	wg.Wait()
+	if err != nil {
+		return nil, err
+	}
+	if recordErr != nil && recordErr != ErrNotFound {
+		return nil, recordErr
+	}
+	if _, deleted := record.FetchRegister(messageDeleted); deleted {
+		return nil, ErrNotFound
+	}
+	return withRecordMeta(message, record), nil
+}
+
+// UpdateMessage replaces the metadata of the message, as UpdateMessageIf does
+func (r RiakBackend) UpdateMessage(queueName string, message *Message) error {
+	return r.UpdateMessageIf(queueName, message, func(*Message) bool { return true })
+}
+
+// UpdateMessageIf checks the condition against the message, and stores its new metadata. The messages
+// bucket type can't be strongly consistent, as it needs the id_int index, and a write to it racing
+// another ends up as a sibling rather than being refused. So the metadata is written to a record of the
+// message in the records bucket type instead, which refuses a write made against an out of date vclock.
+// Only the metadata of a message changes once it is put, so the body is left alone
+func (r RiakBackend) UpdateMessageIf(queueName string, message *Message, condition func(stored *Message) bool) error {
+	stored, err := r.fetchMessage(queueName, message.Key)
+	if err != nil {
+		return err
+	}
+	if stored.Conflict() {
+		return ErrConflict
+	}
+	registers := make(map[string]string, len(message.Meta))
+	for name, value := range message.Meta {
+		registers[messageMetaPrefix+name] = value
+	}
+	return r.updateMessageRecordIf(queueName, stored, registers, condition)
+}
+
+// RangeScan pages through the id_int index of the queues bucket
+func (r RiakBackend) RangeScan(queueName string, bottom int, top int, limit uint32, continuation string) ([]string, string, error) {
+	bucket, err := r.pool.NewBucketType(MessagesBucketType, queueName)
+	if err != nil {
+		return nil, "", err
+	}
+	return bucket.IndexQueryRangePage(idIndex, strconv.Itoa(bottom), strconv.Itoa(top), limit, continuation)
+}
+
+// DeleteMessage deletes the message from the queues bucket, along with its record
+func (r RiakBackend) DeleteMessage(queueName string, key string) error {
+	bucket, err := r.pool.NewBucketType(MessagesBucketType, queueName)
+	if err != nil {
+		return err
+	}
+	err = bucket.Delete(key)
+	if err != nil {
+		return err
+	}
+	return r.deleteMessageRecord(queueName, key)
+}
+
+// DeleteMessageIf checks the condition against the message, and deletes it. As with UpdateMessageIf, the
+// check is made against the record of the message, which is first marked deleted, so no one else can
+// change it in between, and only then is the message itself deleted
+func (r RiakBackend) DeleteMessageIf(queueName string, key string, condition func(stored *Message) bool) error {
+	stored, err := r.fetchMessage(queueName, key)
+	if err != nil {
+		return err
+	}
+	if stored.Conflict() {
+		return ErrConflict
+	}
+	err = r.updateMessageRecordIf(queueName, stored, map[string]string{messageDeleted: "true"}, condition)
+	if err != nil {
+		return err
+	}
+	return r.DeleteMessage(queueName, key)
+}
+
+// updateMessageRecordIf sets the registers on the record of the message, only if the condition holds for
+// the message as it stands with the metadata from its record. Returns ErrNotFound if the message is being deleted
+func (r RiakBackend) updateMessageRecordIf(queueName string, stored *Message, registers map[string]string, condition func(stored *Message) bool) error {
+	deleted := false
+	err := r.UpdateRecordIf(messageRecordName(queueName, stored.Key), registers, func(record *Map) bool {
+		if _, deleted = record.FetchRegister(messageDeleted); deleted {
+			return false
+		}
+		return condition(withRecordMeta(stored, record))
+	})
+	if deleted {
+		return ErrNotFound
+	}
+	return err
+}
+
+// deleteMessageRecord deletes the record of the message, if it has one
+func (r RiakBackend) deleteMessageRecord(queueName string, key string) error {
+	err := r.DeleteRecordIf(messageRecordName(queueName, key), func(*Map) bool { return true })
+	if err == ErrNotFound {
+		return nil
+	}
+	return err
+}
+
+// fetchMessage reads the message as it was put, without the metadata from its record
+func (r RiakBackend) fetchMessage(queueName string, key string) (*Message, error) {
+	bucket, err := r.pool.NewBucketType(MessagesBucketType, queueName)
+	if err != nil {
+		return nil, err
+	}
+	rObject, err := bucket.Get(key)
+	if err != nil {
+		if err == riak.NotFound {
+			return nil, ErrNotFound
+		}
+		return nil, err
+	}
+	return messageFromObject(rObject), nil
+}
+
+// withRecordMeta returns a copy of the message holding the metadata from its record in place of the
+// metadata it was put with, if it has been written since
+func withRecordMeta(message *Message, record *Map) *Message {
+	merged := *message
+	if len(record.Registers) == 0 {
+		return &merged
+	}
+	merged.Meta = make(map[string]string)
+	for name, value := range record.Registers {
+		if strings.HasPrefix(name, messageMetaPrefix) {
+			merged.Meta[strings.TrimPrefix(name, messageMetaPrefix)] = value
+		}
+	}
+	return &merged
+}
+
+// messageRecordName returns the name of the record holding the metadata of the message. Queue names
+// can't hold a slash, so the name can't belong to another queue
+func messageRecordName(queueName string, key string) string {
+	return fmt.Sprintf("message_%s/%s", queueName, key)
+}
+
+// FetchMap reads the CRDT map from the config bucket
+func (r RiakBackend) FetchMap(key string) (*Map, error) {
+	rMap, err := r.fetchRiakMap(key)
+	if err != nil {
+		if err == riak.NotFound {
+			return NewMap(), ErrNotFound
+		}
+		return NewMap(), err
+	}
+	m := NewMap()
+	for mapKey, value := range rMap.Values {
+		switch mapKey.Type {
+		case pb.MapField_REGISTER:
+			m.Registers[mapKey.Key] = string(value.(*riak.RDtRegister).GetValue())
+		case pb.MapField_SET:
+			members := make([]string, 0)
+			for _, member := range value.(*riak.RDtSet).GetValue() {
+				members = append(members, string(member))
+			}
+			sort.Strings(members)
+			m.Sets[mapKey.Key] = members
+		}
+	}
+	return m, nil
+}
+
+// UpdateRegisters sets each register on the CRDT map and stores it
+func (r RiakBackend) UpdateRegisters(key string, registers map[string]string) error {
+	rMap, err := r.fetchRiakMap(key)
+	if err != nil && err != riak.NotFound {
+		return err
+	}
+	for name, value := range registers {
+		rMap.AddRegister(name).Update([]byte(value))
+	}
+	return rMap.Store()
+}
+
+// AddToSet adds the value to the set on the CRDT map and stores it
+func (r RiakBackend) AddToSet(key string, set string, value string) error {
+	rMap, err := r.fetchRiakMap(key)
+	if err != nil && err != riak.NotFound {
+		return err
+	}
+	// AddSet implicitly calls fetch set if the set already exists
+	rMap.AddSet(set).Add([]byte(value))
+	return rMap.Store()
+}
+
+// RemoveFromSet removes the value from the set on the CRDT map and stores it
+func (r RiakBackend) RemoveFromSet(key string, set string, value string) error {
+	rMap, err := r.fetchRiakMap(key)
+	if err != nil {
+		if err == riak.NotFound {
+			return ErrNotFound
+		}
+		return err
+	}
+	rMap.AddSet(set).Remove([]byte(value))
+	return rMap.Store()
+}
+
+// DeleteMap destroys the CRDT map
+func (r RiakBackend) DeleteMap(key string) error {
+	rMap, err := r.fetchRiakMap(key)
+	if err != nil {
+		if err == riak.NotFound {
+			return ErrNotFound
+		}
+		return err
+	}
+	return rMap.Destroy()
+}
+
+// FetchRecord reads the record from the config bucket of the records bucket type
+func (r RiakBackend) FetchRecord(key string) (*Map, error) {
+	_, m, err := r.fetchRecord(key)
+	return m, err
+}
+
+// UpdateRecordIf reads the record, checks the condition against it, and stores the new registers against
+// the vclock it was read with. The records bucket type is strongly consistent, so the write is refused if
+// the record changed in between
+func (r RiakBackend) UpdateRecordIf(key string, registers map[string]string, condition func(stored *Map) bool) error {
+	rObject, m, err := r.fetchRecord(key)
+	if err != nil && err != ErrNotFound {
+		return err
+	}
+	if !condition(m.Copy()) {
+		return ErrConditionFailed
+	}
+	for name, value := range registers {
+		m.Registers[name] = value
+	}
+	rObject.ContentType = "application/json"
+	rObject.Data, err = json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	return rObject.Store()
+}
+
+// DeleteRecordIf reads the record, checks the condition against it, and deletes it against the vclock it
+// was read with
+func (r RiakBackend) DeleteRecordIf(key string, condition func(stored *Map) bool) error {
+	rObject, m, err := r.fetchRecord(key)
+	if err != nil {
+		return err
+	}
+	if !condition(m) {
+		return ErrConditionFailed
+	}
+	return rObject.Destroy()
+}
+
+// fetchRecord reads the riak object holding the record, or returns a new one along with ErrNotFound
+// if there is none yet
+func (r RiakBackend) fetchRecord(key string) (*riak.RObject, *Map, error) {
+	bucket, err := r.pool.NewBucketType(RecordsBucketType, ConfigurationBucket)
+	if err != nil {
+		return nil, NewMap(), err
+	}
+	rObject, err := bucket.Get(key)
+	if err != nil {
+		if err == riak.NotFound {
+			return bucket.NewObject(key), NewMap(), ErrNotFound
+		}
+		return nil, NewMap(), err
+	}
+	m := NewMap()
+	err = json.Unmarshal(rObject.Data, m)
+	return rObject, m, err
+}
+
+func (r RiakBackend) fetchRiakMap(key string) (*riak.RDtMap, error) {
+	bucket, err := r.pool.NewBucketType(MapsBucketType, ConfigurationBucket)
+	if err != nil {
+		// most commonly, the error here relates to a fundamental issue talking to riak
+		// likely, the connection pool is larger than the allowable number of file handles
+		return nil, err
+	}
+	return bucket.FetchMap(key)
+}
+
+func messageFromObject(rObject *riak.RObject) *Message {
+	message := &Message{
+		Key:         rObject.Key,
+		ContentType: rObject.ContentType,
+		Data:        rObject.Data,
+		Meta:        rObject.Meta,
+	}
+	if rObject.Conflict() {
+		for _, sibling := range rObject.Siblings {
+			message.Siblings = append(message.Siblings, Message{
+				Key:         rObject.Key,
+				ContentType: sibling.ContentType,
+				Data:        sibling.Data,
+				Meta:        sibling.Meta,
+			})
+		}
+	}
+	return message
+}
@@ -3,28 +3,38 @@ package app
 import (
 	"errors"
 	"fmt"
-	"math/rand"
 	"strconv"
 	"strings"
 	"time"
 
 	"code.google.com/p/gcfg"
 	"github.com/Sirupsen/logrus"
+	"github.com/Tapjoy/dynamiq/app/backend"
 	"github.com/Tapjoy/dynamiq/app/compressor"
 	"github.com/Tapjoy/dynamiq/app/stats"
-	"github.com/tpjg/goriakpbc"
 )
 
 var (
 	// ErrConfigurationOptionNotFound represents the condition that occurs if an invalid
 	// location is specified for the config file
 	ErrConfigurationOptionNotFound = errors.New("Configuration Value Not Found")
+	// ErrInvalidDeadLetterQueue represents the condition where a queue is pointed at itself, or at
+	// a queue which does not exist, as its dead letter queue
+	ErrInvalidDeadLetterQueue = errors.New("Dead letter queue must be another existing queue")
+	// ErrInvalidDelay represents the condition where a negative delivery delay is requested
+	ErrInvalidDelay = errors.New("Delay seconds must not be negative")
+	// ErrInvalidRetentionPeriod represents the condition where a negative message retention period is requested
+	ErrInvalidRetentionPeriod = errors.New("Message retention period must not be negative")
+	// ErrInvalidWaitTime represents the condition where a wait time outside of 0 to MaxWaitTimeSeconds is requested
+	ErrInvalidWaitTime = fmt.Errorf("Wait time seconds must be between 0 and %d", MaxWaitTimeSeconds)
+	// ErrInvalidDeduplicationWindow represents the condition where a negative deduplication window is requested
+	ErrInvalidDeduplicationWindow = errors.New("Deduplication window must not be negative")
+	// ErrQueueExists represents the condition where a queue is created with different settings than
+	// the existing queue of the same name
+	ErrQueueExists = errors.New("Queue already exists with different settings")
 )
 
-// ConfigurationBucket is the name of the riak bucket holding the config
-const ConfigurationBucket = "config"
-
-// QueueConfigName is the key in the riak bucket holding the config
+// QueueConfigName is the key of the map holding the config
 const QueueConfigName = "queue_config"
 
 // QueueSetName is the crdt key holding the set of all queues
@@ -48,11 +58,44 @@ const MaxPartitionAge = "max_partition_age"
 // CompressedMessages is the name of the config setting name for controlling if the queue is using compression or not
 const CompressedMessages = "compressed_messages"
 
-// Settings Arrays and maps cannot be made immutable in golang
-var Settings = [...]string{VisibilityTimeout, PartitionCount, MinPartitions, MaxPartitions, MaxPartitionAge, CompressedMessages}
+// MaxReceiveCount is the name of the config setting name for controlling how many times a message can be received
+// before it is moved to the dead letter queue. 0 means there is no limit
+const MaxReceiveCount = "max_receive_count"
+
+// DeadLetterQueue is the name of the config setting name for controlling which queue receives messages over the max_receive_count
+const DeadLetterQueue = "dead_letter_queue"
+
+// DelaySeconds is the name of the config setting name for controlling how long new messages stay invisible before their first delivery
+const DelaySeconds = "delay_seconds"
+
+// MessageRetentionPeriod is the name of the config setting name for controlling how long a message is kept before it expires
+const MessageRetentionPeriod = "message_retention_period"
+
+// WaitTimeSeconds is the name of the config setting name for controlling how long a receive waits for messages when none are available
+const WaitTimeSeconds = "wait_time_seconds"
+
+// MaxWaitTimeSeconds is the longest a receive may wait for messages
+const MaxWaitTimeSeconds = 20
+
+// DeduplicationWindow is the name of the config setting name for controlling how many seconds a message with the
+// same deduplication id is treated as a duplicate. 0 turns deduplication off
+const DeduplicationWindow = "deduplication_window"
 
-// DefaultSettings is
-var DefaultSettings = map[string]string{VisibilityTimeout: "30", PartitionCount: "5", MinPartitions: "1", MaxPartitions: "10", MaxPartitionAge: "432000", CompressedMessages: "false"}
+// ContentBasedDeduplication is the name of the config setting name for controlling if messages published without a
+// deduplication id are deduplicated on a hash of their body
+const ContentBasedDeduplication = "content_based_deduplication"
+
+// Fifo is the name of the config setting name for controlling if messages are delivered in order within their message group
+const Fifo = "fifo"
+
+// DefaultExpiryInterval is how often, in milliseconds, expired messages are reaped if not configured
+const DefaultExpiryInterval = 60000
+
+// Settings is the name of every queue setting, in the order of the QueueSettings registry
+var Settings = settingNames()
+
+// DefaultSettings is the default of every queue setting, used for queues created without it
+var DefaultSettings = settingDefaults()
 
 // Config is
 type Config struct {
@@ -60,8 +103,13 @@ type Config struct {
 	Stats      Stats
 	Compressor compressor.Compressor
 	Queues     *Queues
-	RiakPool   *riak.Client
+	Storage    Storage
+	Backend    backend.Backend
 	Topics     *Topics
+	Topology   *Topology
+	Gossip     *Gossip
+	Drain      *Drain
+	Leases     *Leases
 }
 
 // Core is
@@ -75,10 +123,17 @@ type Core struct {
 	RiakNodes             string
 	BackendConnectionPool int
 	SyncConfigInterval    time.Duration
+	ExpiryInterval        time.Duration
 	LogLevel              logrus.Level
 	LogLevelString        string
 }
 
+// Storage is
+type Storage struct {
+	Type string
+	Path string
+}
+
 // Stats is
 type Stats struct {
 	Type          string
@@ -88,12 +143,22 @@ type Stats struct {
 	Client        stats.Client
 }
 
-func initRiakPool(cfg *Config) *riak.Client {
-	rand.Seed(time.Now().UnixNano())
-	// TODO this should just be 1 HAProxy
-	hosts := []string{cfg.Core.RiakNodes}
-	host := hosts[rand.Intn(len(hosts))]
-	return riak.NewClientPool(host, cfg.Core.BackendConnectionPool)
+func initBackend(cfg *Config) backend.Backend {
+	switch cfg.Storage.Type {
+	case "riak", "":
+		return backend.NewRiakBackend([]string{cfg.Core.RiakNodes}, cfg.Core.BackendConnectionPool)
+	case "memory":
+		return backend.NewMemoryBackend()
+	case "bolt":
+		store, err := backend.NewBoltBackend(cfg.Storage.Path)
+		if err != nil {
+			logrus.Fatal(err)
+		}
+		return store
+	default:
+		logrus.Fatalf("Unknown storage type %s", cfg.Storage.Type)
+	}
+	return nil
 }
 
 // GetCoreConfig is
@@ -113,8 +178,13 @@ func GetCoreConfig(configFile *string) (*Config, error) {
 		cfg.Core.SeedServers[i] = x + ":" + strconv.Itoa(cfg.Core.SeedPort)
 	}
 
-	cfg.RiakPool = initRiakPool(&cfg)
+	if cfg.Core.ExpiryInterval == 0 {
+		cfg.Core.ExpiryInterval = DefaultExpiryInterval
+	}
+
+	cfg.Backend = initBackend(&cfg)
 	cfg.Queues = loadQueuesConfig(&cfg)
+	cfg.Leases = NewLeases()
 	switch cfg.Stats.Type {
 	case "statsd":
 		cfg.Stats.Client = stats.NewStatsdClient(cfg.Stats.Address, cfg.Stats.Prefix, time.Second*time.Duration(cfg.Stats.FlushInterval))
@@ -138,38 +208,26 @@ func GetCoreConfig(configFile *string) (*Config, error) {
 func loadQueuesConfig(cfg *Config) *Queues {
 	// Create the Queues Config struct
 	queuesConfig := Queues{
-		QueueMap: make(map[string]*Queue),
+		QueueMap:     make(map[string]*Queue),
+		syncKiller:   make(chan struct{}),
+		expiryKiller: make(chan struct{}),
 	}
-	// Get the queues
-	client := cfg.RiakConnection()
 	// TODO: We should be handling errors here
-	// Get the bucket holding the map of config data
-	configBucket, err := client.NewBucketType("maps", ConfigurationBucket)
-	if err != nil {
-		// most commonly, the error here relates to a fundamental issue talking to riak
-		// likely, the connection pool is larger than the allowable number of file handles
-		logrus.Errorf("Error trying to get maps bucket type: %s", err)
-	}
 	// Fetch the object for holding the set of queues
-	config, err := configBucket.FetchMap(QueueConfigName)
-	if err != nil {
-		logrus.Errorf("Error trying to get queue config bucket: %s", err)
+	config, err := cfg.Backend.FetchMap(QueueConfigName)
+	if err != nil && err != backend.ErrNotFound {
+		// most commonly, the error here relates to a fundamental issue talking to the backend
+		// likely, the connection pool is larger than the allowable number of file handles
+		logrus.Errorf("Error trying to get queue config map: %s", err)
+	} else {
+		queuesConfig.lastSynced = time.Now()
 	}
 	queuesConfig.Config = config
 
-	// AddSet implicitly calls fetch set if the set already exists
-	queueSet := config.AddSet(QueueSetName)
-	if queueSet == nil {
-		queueSet.Add([]byte("default_queue"))
-		config.Store()
-		config, _ = configBucket.FetchMap(QueueConfigName)
-	}
 	// For each queue we have in the system
-	for _, elem := range queueSet.GetValue() {
-		// Convert it's name into a string
-		name := string(elem[:])
-		// Get the Riak RdtMap of Settings for this queue
-		configMap, _ := configBucket.FetchMap(queueConfigRecordName(name))
+	for _, name := range config.FetchSet(QueueSetName) {
+		// Get the map of Settings for this queue
+		configMap, _ := cfg.Backend.FetchMap(queueConfigRecordName(name))
 		// Pre-warm the Settings object
 		queue := &Queue{
 			Name:   name,
@@ -186,208 +244,265 @@ func loadQueuesConfig(cfg *Config) *Queues {
 
 // InitializeQueue is
 func (cfg *Config) InitializeQueue(queueName string) error {
-	// Create the configuration data in Riak first
+	return cfg.initializeQueue(queueName, nil)
+}
+
+// InitializeQueueWithSettings creates the queue with the given settings in place of the defaults. The
+// settings are validated against the defaults, and stored in the same write as the rest of the queues
+// config, before any node can see the queue, so it is never served with the defaults. Creating a queue
+// which already exists with the same settings does nothing and returns false, otherwise ErrQueueExists is returned
+func (cfg *Config) InitializeQueueWithSettings(queueName string, settings map[string]string) (bool, error) {
+	err := cfg.validateQueueSettings(queueName, DefaultSettings, settings)
+	if err != nil {
+		return false, err
+	}
+	if cfg.Queues.Exists(cfg, queueName) {
+		return false, cfg.matchQueueSettings(queueName, settings)
+	}
+	return true, cfg.initializeQueue(queueName, settings)
+}
+
+// matchQueueSettings returns ErrQueueExists unless the stored settings of the queue are the defaults
+// with the given settings in place
+func (cfg *Config) matchQueueSettings(queueName string, settings map[string]string) error {
+	stored, err := cfg.queueSettings(queueName)
+	if err != nil {
+		return err
+	}
+	for name, value := range queueRegisters(settings) {
+		if stored[name] != value {
+			return ErrQueueExists
+		}
+	}
+	return nil
+}
+
+func (cfg *Config) initializeQueue(queueName string, settings map[string]string) error {
+	// Create the configuration data in the backend first
 	// This way it'll be there once the queue is added to the known set
-	configMap, err := cfg.createConfigForQueue(queueName)
+	configMap, err := cfg.createConfigForQueue(queueName, settings)
 	if err != nil {
 		return err
 	}
-	// Add to the known set of queues
+	// Add to the known set of queues. Without it the config syncs of every node would drop the queue
+	// again, so it isn't served or announced
 	err = cfg.addToKnownQueues(queueName)
+	if err != nil {
+		return err
+	}
 	// Now, add the queue into our memory-cache of data
-	cfg.Queues.QueueMap[queueName] = &Queue{
+	queue := cfg.Queues.addQueue(&Queue{
 		Name:   queueName,
 		Parts:  InitPartitions(cfg, queueName),
 		Config: configMap,
-	}
-	return err
+	})
+	// It may have been picked up by a config sync already, from the config written above
+	queue.updateConfig(configMap)
+	cfg.Gossip.Announce(ConfigQueue, queueName)
+	return nil
 }
 
 func (cfg *Config) addToKnownQueues(queueName string) error {
 	// If we disallow topicless-queues, we can remove this and put it into Topic.AddQueue
-	client := cfg.RiakConnection()
-	// We purposefully read from Riak here, we'll enventually-consist with the in memory cache
-	bucket, _ := client.NewBucketType("maps", ConfigurationBucket)
-	queueConfig, _ := bucket.FetchMap(QueueConfigName)
-	queueSet := queueConfig.AddSet(QueueSetName)
-	queueSet.Add([]byte(queueName))
-	return queueConfig.Store()
+	// We purposefully write to the backend here, we'll enventually-consist with the in memory cache
+	return cfg.Backend.AddToSet(QueueConfigName, QueueSetName, queueName)
 }
 
 func (cfg *Config) removeFromKnownQueues(queueName string) error {
 	// If we disallow topicless-queues, we can remove this and put it into Topic.RemoveQueue
-	client := cfg.RiakConnection()
-	// We purposefully read from Riak here, we'll enventually-consist with the in memory cache
-	bucket, _ := client.NewBucketType("maps", ConfigurationBucket)
-	queueConfig, _ := bucket.FetchMap(QueueConfigName)
-	queueSet := queueConfig.AddSet(QueueSetName)
-	queueSet.Remove([]byte(queueName))
-	return queueConfig.Store()
-}
-
-// TODO: Take in a map which overrides the defaults
-func (cfg *Config) createConfigForQueue(queueName string) (*riak.RDtMap, error) {
-	client := cfg.RiakConnection()
-	// Get the bucket for holding maps of config data
-	// TODO: Find a nice way to DRY this up - it's a lil copy/pasty
-	bucket, _ := client.NewBucketType("maps", ConfigurationBucket)
-	// Get the object for this queues Settings
-	obj, _ := bucket.FetchMap(queueConfigRecordName(queueName))
-	// For each known setting
+	// We purposefully write to the backend here, we'll enventually-consist with the in memory cache
+	return cfg.Backend.RemoveFromSet(QueueConfigName, QueueSetName, queueName)
+}
+
+func (cfg *Config) createConfigForQueue(queueName string, settings map[string]string) (*backend.Map, error) {
+	// Save the object, returns an error up the callchain if needed
+	err := cfg.Backend.UpdateRegisters(queueConfigRecordName(queueName), queueRegisters(settings))
+	if err != nil {
+		return nil, err
+	}
+	return cfg.Backend.FetchMap(queueConfigRecordName(queueName))
+}
+
+// queueRegisters returns the default value of every known setting, overridden by the given settings
+func queueRegisters(settings map[string]string) map[string]string {
+	registers := make(map[string]string)
 	for _, elem := range Settings {
-		// Get the reigster for this setting
-		reg := obj.AddRegister(elem)
-		// Convert the default value to a bytearray, set it on the Register
-		reg.Update([]byte(DefaultSettings[elem]))
+		registers[elem] = DefaultSettings[elem]
 	}
-	// Save the object, returns an error up the callchain if needed
-	return obj, obj.Store()
+	for name, value := range settings {
+		registers[name] = value
+	}
+	return registers
 }
 
 // SETTERS AND GETTERS FOR QUEUE CONFIG
 
 // GetVisibilityTimeout is
 func (cfg *Config) GetVisibilityTimeout(queueName string) (float64, error) {
-	val, err := cfg.getQueueSetting(VisibilityTimeout, queueName)
-	parsed, err := strconv.ParseFloat(val, 32)
-	return parsed, err
+	return cfg.getFloatSetting(VisibilityTimeout, queueName)
 }
 
 // SetVisibilityTimeout is
 func (cfg *Config) SetVisibilityTimeout(queueName string, timeout float64) error {
-	return cfg.setQueueSetting(VisibilityTimeout, queueName, strconv.FormatFloat(timeout, 'f', -1, 64))
+	return cfg.SetQueueSettings(queueName, map[string]string{VisibilityTimeout: strconv.FormatFloat(timeout, 'f', -1, 64)})
 }
 
 // GetMinPartitions is
 func (cfg *Config) GetMinPartitions(queueName string) (int, error) {
-	val, _ := cfg.getQueueSetting(MinPartitions, queueName)
-	return strconv.Atoi(val)
+	return cfg.getIntSetting(MinPartitions, queueName)
 }
 
 // SetMinPartitions is
 func (cfg *Config) SetMinPartitions(queueName string, timeout int) error {
 	// TODO do we handle any resizing here? Or does the system "self-adjust"
-	return cfg.setQueueSetting(MinPartitions, queueName, strconv.Itoa(timeout))
+	return cfg.SetQueueSettings(queueName, map[string]string{MinPartitions: strconv.Itoa(timeout)})
 }
 
 // GetMaxPartitions is
 func (cfg *Config) GetMaxPartitions(queueName string) (int, error) {
-	val, _ := cfg.getQueueSetting(MaxPartitions, queueName)
-	return strconv.Atoi(val)
+	return cfg.getIntSetting(MaxPartitions, queueName)
 }
 
 // SetMaxPartitions is
 func (cfg *Config) SetMaxPartitions(queueName string, timeout int) error {
 	// TODO do we handle any resizing here? Or does the system "self-adjust"
-	return cfg.setQueueSetting(MaxPartitions, queueName, strconv.Itoa(timeout))
+	return cfg.SetQueueSettings(queueName, map[string]string{MaxPartitions: strconv.Itoa(timeout)})
 }
 
 // SetMaxPartitionAge is
 func (cfg *Config) SetMaxPartitionAge(queueName string, age float64) error {
-	return cfg.setQueueSetting(MaxPartitionAge, queueName, strconv.FormatFloat(age, 'f', -1, 64))
+	return cfg.SetQueueSettings(queueName, map[string]string{MaxPartitionAge: strconv.FormatFloat(age, 'f', -1, 64)})
 }
 
 // GetMaxPartitionAge is
 func (cfg *Config) GetMaxPartitionAge(queueName string) (float64, error) {
-	val, _ := cfg.getQueueSetting(MaxPartitionAge, queueName)
-	return strconv.ParseFloat(val, 32)
+	return cfg.getFloatSetting(MaxPartitionAge, queueName)
 }
 
 // GetCompressedMessages is
 func (cfg *Config) GetCompressedMessages(queueName string) (bool, error) {
-	val, _ := cfg.getQueueSetting(CompressedMessages, queueName)
-	return strconv.ParseBool(val)
+	return cfg.getBoolSetting(CompressedMessages, queueName)
 }
 
 // SetCompressedMessages is
 func (cfg *Config) SetCompressedMessages(queueName string, compressedMessages bool) error {
-	return cfg.setQueueSetting(CompressedMessages, queueName, strconv.FormatBool(compressedMessages))
+	return cfg.SetQueueSettings(queueName, map[string]string{CompressedMessages: strconv.FormatBool(compressedMessages)})
+}
+
+// GetMaxReceiveCount is
+func (cfg *Config) GetMaxReceiveCount(queueName string) (int, error) {
+	return cfg.getIntSetting(MaxReceiveCount, queueName)
+}
+
+// SetMaxReceiveCount is
+func (cfg *Config) SetMaxReceiveCount(queueName string, count int) error {
+	return cfg.SetQueueSettings(queueName, map[string]string{MaxReceiveCount: strconv.Itoa(count)})
+}
+
+// GetDeadLetterQueue is
+func (cfg *Config) GetDeadLetterQueue(queueName string) (string, error) {
+	return cfg.getQueueSetting(DeadLetterQueue, queueName)
+}
+
+// SetDeadLetterQueue is. An empty name turns dead lettering off
+func (cfg *Config) SetDeadLetterQueue(queueName string, deadLetterQueue string) error {
+	return cfg.SetQueueSettings(queueName, map[string]string{DeadLetterQueue: deadLetterQueue})
+}
+
+// GetDelaySeconds is
+func (cfg *Config) GetDelaySeconds(queueName string) (float64, error) {
+	return cfg.getFloatSetting(DelaySeconds, queueName)
+}
+
+// SetDelaySeconds is
+func (cfg *Config) SetDelaySeconds(queueName string, delay float64) error {
+	return cfg.SetQueueSettings(queueName, map[string]string{DelaySeconds: strconv.FormatFloat(delay, 'f', -1, 64)})
+}
+
+// GetMessageRetentionPeriod is
+func (cfg *Config) GetMessageRetentionPeriod(queueName string) (float64, error) {
+	return cfg.getFloatSetting(MessageRetentionPeriod, queueName)
+}
+
+// SetMessageRetentionPeriod is. A period of 0 keeps messages forever
+func (cfg *Config) SetMessageRetentionPeriod(queueName string, period float64) error {
+	return cfg.SetQueueSettings(queueName, map[string]string{MessageRetentionPeriod: strconv.FormatFloat(period, 'f', -1, 64)})
+}
+
+// GetWaitTimeSeconds is
+func (cfg *Config) GetWaitTimeSeconds(queueName string) (float64, error) {
+	return cfg.getFloatSetting(WaitTimeSeconds, queueName)
+}
+
+// SetWaitTimeSeconds is
+func (cfg *Config) SetWaitTimeSeconds(queueName string, wait float64) error {
+	return cfg.SetQueueSettings(queueName, map[string]string{WaitTimeSeconds: strconv.FormatFloat(wait, 'f', -1, 64)})
+}
+
+// GetDeduplicationWindow is
+func (cfg *Config) GetDeduplicationWindow(queueName string) (float64, error) {
+	return cfg.getFloatSetting(DeduplicationWindow, queueName)
+}
+
+// SetDeduplicationWindow is
+func (cfg *Config) SetDeduplicationWindow(queueName string, window float64) error {
+	return cfg.SetQueueSettings(queueName, map[string]string{DeduplicationWindow: strconv.FormatFloat(window, 'f', -1, 64)})
+}
+
+// GetContentBasedDeduplication is
+func (cfg *Config) GetContentBasedDeduplication(queueName string) (bool, error) {
+	return cfg.getBoolSetting(ContentBasedDeduplication, queueName)
+}
+
+// SetContentBasedDeduplication is
+func (cfg *Config) SetContentBasedDeduplication(queueName string, contentBased bool) error {
+	return cfg.SetQueueSettings(queueName, map[string]string{ContentBasedDeduplication: strconv.FormatBool(contentBased)})
+}
+
+// GetFifo is
+func (cfg *Config) GetFifo(queueName string) (bool, error) {
+	return cfg.getBoolSetting(Fifo, queueName)
+}
+
+// SetFifo is
+func (cfg *Config) SetFifo(queueName string, fifo bool) error {
+	return cfg.SetQueueSettings(queueName, map[string]string{Fifo: strconv.FormatBool(fifo)})
 }
 
 // TODO Find a proper way to scope this to a queue VS a topic
 func (cfg *Config) getQueueSetting(paramName string, queueName string) (string, error) {
-	// Read from local cache
-	value := ""
-	var err error
 	// If cfg.Queues is nil, it means we're in the middle of booting, and we're trying to configure
-	// partition counts. If this is the case, skip to reading directly from Riak
-	// This means booting up will incur a number of extra reads to Riak
+	// partition counts. If this is the case, skip to reading directly from the backend
+	// This means booting up will incur a number of extra reads to the backend
 	// We can likely improve this, but it works for the time being
 
-	// If cfg.Queues.QueueMap[queuename] is nil, it means this server hasn't yet synced with Riak
-	// While we wait, go and read from Riak directly
+	// If cfg.Queues.QueueMap[queuename] is nil, it means this server hasn't yet synced with the backend
+	// While we wait, go and read from the backend directly
+	var configMap *backend.Map
 	if cfg.Queues != nil {
-		if _, ok := cfg.Queues.QueueMap[queueName]; ok {
-			regValue := cfg.Queues.QueueMap[queueName].getConfig().FetchRegister(paramName)
-			if regValue != nil {
-				value, err = registerValueToString(regValue)
-				if err != nil {
-					return value, err
-				}
-			} else {
-				// There is a chance the queue pre-dated the existence of the given parameter. If so, use the
-				// configured default value for now
-				// TODO - Need to backfill missing params when they're detected
-				value = DefaultSettings[paramName]
-			}
+		if queue, ok := cfg.Queues.getQueue(queueName); ok {
+			configMap = queue.getConfig()
 		}
 	}
-
-	if value == "" {
-		// Read from riak
-		client := cfg.RiakConnection()
-		bucket, _ := client.NewBucketType("maps", ConfigurationBucket)
-		obj, err := bucket.FetchMap(queueConfigRecordName(queueName))
-
+	if configMap == nil {
+		var err error
+		configMap, err = cfg.Backend.FetchMap(queueConfigRecordName(queueName))
 		// if not found... no config existed for that queue - should not happen hashtagcrossfingers
-		if err == riak.NotFound {
-			// Log out an error here
+		if err != nil {
 			return "", err
 		}
-
-		val := obj.FetchRegister(paramName)
-
-		if val != nil {
-			// We had a register with this name, return the value
-			value, err = registerValueToString(val)
-		}
 	}
-	return value, err
-}
-
-// TODO Find a proper way to scope this to a queue VS a topic
-func (cfg *Config) setQueueSetting(paramName string, queueName string, value string) error {
-	// Write to Riak
-	client := cfg.RiakConnection()
-	bucket, _ := client.NewBucketType("maps", ConfigurationBucket)
-	obj, err := bucket.FetchMap(queueConfigRecordName(queueName))
-	// if not found... no config existed for that queue - should not happen hashtagcrossfingers
-	if err == riak.NotFound {
-		// Log out an error here
-		return err
+	value, present := configMap.FetchRegister(paramName)
+	if !present {
+		// There is a chance the queue pre-dated the existence of the given parameter. If so, use the
+		// registered default value
+		value = DefaultSettings[paramName]
 	}
-	val := obj.AddRegister(paramName)
-	val.NewValue = []byte(value)
-	// Write to Riak
-	return obj.Store()
+	return value, nil
 }
 
 // HELPERS
 
-func registerValueToString(reg *riak.RDtRegister) (string, error) {
-	// The register might have been deleted at this point, so handle nil case.
-	if reg == nil {
-		return "", errors.New("Register is nil.")
-	}
-	return string(reg.Value[:]), nil
-}
-
-// RiakConnection returns a pointer to the current pool of riak connections, which
-// is abstracted inside of the riak.Client object
-func (cfg *Config) RiakConnection() *riak.Client {
-	return cfg.RiakPool
-}
-
 func queueConfigRecordName(queueName string) string {
 	return fmt.Sprintf("queue_%s_config", queueName)
 }
@@ -1,13 +1,24 @@
 package app_test
 
 import (
+	"errors"
 	"strconv"
 
 	"github.com/Tapjoy/dynamiq/app"
+	"github.com/Tapjoy/dynamiq/app/backend"
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
 )
 
+// setlessBackend fails every write to a set, such as the set of known queues
+type setlessBackend struct {
+	backend.Backend
+}
+
+func (b setlessBackend) AddToSet(key string, set string, value string) error {
+	return errors.New("connection refused")
+}
+
 var _ = Describe("Config", func() {
 
 	Context("GetVisibilityTimeout", func() {
@@ -24,10 +35,108 @@ var _ = Describe("Config", func() {
 		})
 	})
 
-	Context("GetMinPartitions", func() {
-		It("should return the configured MaxPartitions for the given queue", func() {
-			intMinPartitions, _ := strconv.Atoi(app.DefaultSettings[app.MaxPartitions])
-			Expect(cfg.GetMinPartitions(testQueueName)).To(Equal(intMinPartitions))
+	Context("InitializeQueueWithSettings", func() {
+		queueName := "settings_queue"
+		settings := map[string]string{app.VisibilityTimeout: "5", app.Fifo: "true"}
+
+		AfterEach(func() {
+			queues.DeleteQueue(queueName, cfg)
+		})
+
+		It("should create the queue with the settings in place of the defaults", func() {
+			created, err := cfg.InitializeQueueWithSettings(queueName, settings)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(created).To(BeTrue())
+
+			Expect(cfg.GetVisibilityTimeout(queueName)).To(Equal(5.0))
+			Expect(cfg.GetFifo(queueName)).To(BeTrue())
+			intMinPartitions, _ := strconv.Atoi(app.DefaultSettings[app.MinPartitions])
+			Expect(cfg.GetMinPartitions(queueName)).To(Equal(intMinPartitions))
+		})
+
+		It("should do nothing when the queue already exists with the same settings", func() {
+			_, err := cfg.InitializeQueueWithSettings(queueName, settings)
+			Expect(err).ToNot(HaveOccurred())
+
+			created, err := cfg.InitializeQueueWithSettings(queueName, settings)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(created).To(BeFalse())
+		})
+
+		It("should refuse to create the queue again with different settings", func() {
+			_, err := cfg.InitializeQueueWithSettings(queueName, settings)
+			Expect(err).ToNot(HaveOccurred())
+
+			_, err = cfg.InitializeQueueWithSettings(queueName, map[string]string{app.VisibilityTimeout: "5"})
+			Expect(err).To(Equal(app.ErrQueueExists))
+		})
+
+		It("should not serve the queue when it couldn't be added to the known queues", func() {
+			setlessCfg := *cfg
+			setlessCfg.Backend = setlessBackend{cfg.Backend}
+			_, err := setlessCfg.InitializeQueueWithSettings(queueName, settings)
+			Expect(err).To(MatchError("connection refused"))
+			Expect(queues.QueueMap).ToNot(HaveKey(queueName))
+		})
+	})
+
+	Context("Queue settings", func() {
+		queueName := "registry_queue"
+
+		BeforeEach(func() {
+			Expect(cfg.InitializeQueue(queueName)).To(Succeed())
+		})
+
+		AfterEach(func() {
+			queues.DeleteQueue(queueName, cfg)
+		})
+
+		It("should store every setting in one go", func() {
+			err := cfg.SetQueueSettings(queueName, map[string]string{app.MinPartitions: "3", app.MaxPartitions: "4"})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(cfg.ValidateQueueSettings(queueName, map[string]string{app.MinPartitions: "4"})).To(Succeed())
+			Expect(cfg.ValidateQueueSettings(queueName, map[string]string{app.MinPartitions: "5"})).To(Equal(app.ErrInvalidPartitionRange))
+		})
+
+		It("should not store settings for a queue which doesn't exist", func() {
+			err := cfg.SetQueueSettings("no_such_queue", map[string]string{app.VisibilityTimeout: "5"})
+			Expect(err).To(Equal(backend.ErrNotFound))
+		})
+
+		It("should refuse values out of range", func() {
+			err := cfg.SetQueueSettings(queueName, map[string]string{app.VisibilityTimeout: "-1"})
+			Expect(err).To(Equal(app.ErrInvalidVisibilityTimeout))
+			Expect(app.InvalidSetting(err)).To(BeTrue())
+		})
+
+		It("should refuse more min_partitions than max_partitions, storing neither", func() {
+			err := cfg.SetQueueSettings(queueName, map[string]string{app.MinPartitions: "5", app.MaxPartitions: "2"})
+			Expect(err).To(Equal(app.ErrInvalidPartitionRange))
+
+			intMaxPartitions, _ := strconv.Atoi(app.DefaultSettings[app.MaxPartitions])
+			Expect(cfg.SetMinPartitions(queueName, intMaxPartitions+1)).To(Equal(app.ErrInvalidPartitionRange))
+		})
+
+		It("should refuse unknown settings and values of the wrong type", func() {
+			err := cfg.SetQueueSettings(queueName, map[string]string{"no_such_setting": "1"})
+			Expect(err).To(BeAssignableToTypeOf(&app.SettingError{}))
+			err = cfg.SetQueueSettings(queueName, map[string]string{app.MaxReceiveCount: "1.5"})
+			Expect(err).To(BeAssignableToTypeOf(&app.SettingError{}))
+			Expect(app.InvalidSetting(err)).To(BeTrue())
+		})
+
+		It("should use the default for queues created without a setting", func() {
+			delete(queues.QueueMap[queueName].Config.Registers, app.MaxPartitions)
+			intMaxPartitions, _ := strconv.Atoi(app.DefaultSettings[app.MaxPartitions])
+			Expect(cfg.GetMaxPartitions(queueName)).To(Equal(intMaxPartitions))
+		})
+
+		It("should use the default, and return the error, for values which don't parse", func() {
+			queues.QueueMap[queueName].Config.Registers[app.MinPartitions] = "many"
+			minPartitions, err := cfg.GetMinPartitions(queueName)
+			Expect(err).To(HaveOccurred())
+			intMinPartitions, _ := strconv.Atoi(app.DefaultSettings[app.MinPartitions])
+			Expect(minPartitions).To(Equal(intMinPartitions))
 		})
 	})
 })
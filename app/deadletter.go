@@ -0,0 +1,143 @@
+package app
+
+import (
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/Tapjoy/dynamiq/app/backend"
+	"github.com/Tapjoy/dynamiq/app/stats"
+)
+
+// QueueDeadLetteredStatsSuffix is
+const QueueDeadLetteredStatsSuffix = "dead_lettered.count"
+
+// QueueRedrivenStatsSuffix is
+const QueueRedrivenStatsSuffix = "redriven.count"
+
+// RedriveBatchSize is the number of messages read from the dead letter queue at a time during a redrive
+const RedriveBatchSize = 100
+
+func recordDeadLettered(c stats.Client, queueName string, numberOfMessages int64) error {
+	// Increment # Dead lettered
+	key := fmt.Sprintf("%s.%s", queueName, QueueDeadLetteredStatsSuffix)
+	err := c.Incr(key, numberOfMessages)
+	// Decrement Depth count, the message now lives in the dead letter queue
+	key = fmt.Sprintf("%s.%s", queueName, QueueDepthStatsSuffix)
+	err = c.DecrGauge(key, numberOfMessages)
+	return err
+}
+
+func recordRedriven(c stats.Client, queueName string, numberOfMessages int64) error {
+	// Increment # Redriven
+	key := fmt.Sprintf("%s.%s", queueName, QueueRedrivenStatsSuffix)
+	err := c.Incr(key, numberOfMessages)
+	// Decrement Depth count, the message now lives in its source queue
+	key = fmt.Sprintf("%s.%s", queueName, QueueDepthStatsSuffix)
+	err = c.DecrGauge(key, numberOfMessages)
+	return err
+}
+
+// deadLetter moves the message onto the queue's dead letter queue, remembering where it
+// came from so it can be redriven later. Returns false, leaving the message where it is,
+// if there is no dead letter queue to move it to, or it was received again since it was read
+func (queue *Queue) deadLetter(cfg *Config, message *backend.Message) bool {
+	name, _ := cfg.GetDeadLetterQueue(queue.Name)
+	if name == "" {
+		return false
+	}
+	deadLetterQueue, present := cfg.Queues.getQueue(name)
+	if !present {
+		logrus.Errorf("Dead letter queue %s for %s does not exist", name, queue.Name)
+		return false
+	}
+	// Each queue compresses according to its own settings, so hand the raw body over
+	body := queue.decompressMessages(cfg, []backend.Message{*message})[0].Data
+	meta := movedMeta(message)
+	meta[SourceQueueMeta] = queue.Name
+	if !queue.moveMessage(cfg, message, deadLetterQueue, body, meta) {
+		return false
+	}
+	defer recordDeadLettered(cfg.Stats.Client, queue.Name, 1)
+	return true
+}
+
+// moveMessage takes the message off of this queue and puts the body onto the destination queue with the
+// given metadata. The message is only taken if it hasn't been received again since it was read, so it is
+// never taken from under a receiver, and returns false leaving the message where it is otherwise. If it
+// can't be put onto the destination, it is put back, so it always ends up on exactly one of the queues
+func (queue *Queue) moveMessage(cfg *Config, message *backend.Message, destination *Queue, body []byte, meta map[string]string) bool {
+	err := cfg.Backend.DeleteMessageIf(queue.Name, message.Key, func(stored *backend.Message) bool {
+		return MessageReceipt(stored) == MessageReceipt(message) && MessageReceiveCount(stored) == MessageReceiveCount(message)
+	})
+	if err != nil {
+		if err != backend.ErrConditionFailed && err != backend.ErrNotFound {
+			logrus.Error(err)
+		}
+		return false
+	}
+	_, err = destination.putMessage(cfg, body, message.ContentType, meta)
+	if err != nil {
+		logrus.Error(err)
+		err = cfg.Backend.PutMessage(queue.Name, message)
+		if err != nil {
+			logrus.Error(err)
+		}
+		return false
+	}
+	return true
+}
+
+// Redrive moves every message which isn't in flight from this dead letter queue back onto
+// the queue it was dead lettered from, returning how many were moved. Messages whose source
+// queue no longer exists are left in place
+func (queue *Queue) Redrive(cfg *Config) (int, error) {
+	moved := 0
+	continuation := ""
+	for {
+		ids, next, err := cfg.Backend.RangeScan(queue.Name, 0, math.MaxInt64, RedriveBatchSize, continuation)
+		if err != nil {
+			return moved, err
+		}
+		moved += queue.redriveMessages(cfg, ids)
+		if next == "" {
+			return moved, nil
+		}
+		continuation = next
+	}
+}
+
+// movedMeta returns the metadata a message keeps when it moves between queues. It keeps its attributes, priority,
+// its message group, and its enqueue time, so it still expires on time and keeps its place in its group
+func movedMeta(message *backend.Message) map[string]string {
+	meta := make(map[string]string)
+	for _, name := range []string{EnqueuedAtMeta, AttributesMeta, MessageGroupMeta, PriorityMeta} {
+		if value, ok := message.Meta[name]; ok {
+			meta[name] = value
+		}
+	}
+	return meta
+}
+
+func (queue *Queue) redriveMessages(cfg *Config, ids []string) int {
+	moved := 0
+	now := time.Now()
+	for _, message := range queue.fetchMessages(cfg, ids) {
+		if messageInFlight(&message, now) {
+			continue
+		}
+		source, present := cfg.Queues.getQueue(message.Meta[SourceQueueMeta])
+		if !present {
+			logrus.Debugf("Source queue %s of message %s does not exist", message.Meta[SourceQueueMeta], message.Key)
+			continue
+		}
+		// The message goes back with a fresh receive count
+		body := queue.decompressMessages(cfg, []backend.Message{message})[0].Data
+		if queue.moveMessage(cfg, &message, source, body, movedMeta(&message)) {
+			moved++
+		}
+	}
+	defer recordRedriven(cfg.Stats.Client, queue.Name, int64(moved))
+	return moved
+}
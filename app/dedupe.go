@@ -0,0 +1,166 @@
+package app
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/Tapjoy/dynamiq/app/backend"
+	"github.com/Tapjoy/dynamiq/app/stats"
+)
+
+// QueueDeduplicatedStatsSuffix is
+const QueueDeduplicatedStatsSuffix = "deduplicated.count"
+
+// dedupeIDSet is the set, on the queues dedupe index map, holding every deduplication id with a record
+const dedupeIDSet = "ids"
+
+// dedupeMessageID is the register, on a dedupe record, holding the id of the original message
+const dedupeMessageID = "message_id"
+
+// dedupeExpiresAt is the register, on a dedupe record, holding when the record stops applying in unix nanoseconds
+const dedupeExpiresAt = "expires_at"
+
+// dedupeClaimedAt is the register, on a dedupe record, holding when the record was claimed in unix nanoseconds
+const dedupeClaimedAt = "claimed_at"
+
+func recordDeduplicated(c stats.Client, queueName string, numberOfMessages int64) error {
+	key := fmt.Sprintf("%s.%s", queueName, QueueDeduplicatedStatsSuffix)
+	return c.Incr(key, numberOfMessages)
+}
+
+// deduplicationID returns the id to deduplicate the message on, or an empty string if the queue
+// doesn't deduplicate it. Without an explicit deduplication id, the body hash is used if the queue
+// has content based deduplication turned on
+func (queue *Queue) deduplicationID(cfg *Config, message PublishMessage) string {
+	window, _ := cfg.GetDeduplicationWindow(queue.Name)
+	if window <= 0 {
+		return ""
+	}
+	if message.DeduplicationID != "" {
+		return message.DeduplicationID
+	}
+	contentBased, _ := cfg.GetContentBasedDeduplication(queue.Name)
+	if !contentBased {
+		return ""
+	}
+	hash := sha256.Sum256([]byte(message.Body))
+	return hex.EncodeToString(hash[:])
+}
+
+// reserveDeduplication claims the deduplication id for the message about to be published with the
+// given id, for the length of the window. If another message already holds it, its id is returned
+// instead. The claim is a conditional write to the backend, made before the message is stored, so only
+// one of several publishes of the same message racing each other, on any node, is stored
+func (queue *Queue) reserveDeduplication(cfg *Config, deduplicationID string, messageID string) (string, bool) {
+	window, _ := cfg.GetDeduplicationWindow(queue.Name)
+	claimedAt := time.Now()
+	expiresAt := claimedAt.Add(time.Duration(window * float64(time.Second)))
+	original := ""
+	err := cfg.Backend.UpdateRecordIf(dedupeRecordName(queue.Name, deduplicationID), map[string]string{
+		dedupeMessageID: messageID,
+		dedupeExpiresAt: strconv.FormatInt(expiresAt.UnixNano(), 10),
+		dedupeClaimedAt: strconv.FormatInt(claimedAt.UnixNano(), 10),
+	}, func(record *backend.Map) bool {
+		held, present := record.FetchRegister(dedupeMessageID)
+		if !present || dedupeRecordExpired(record, time.Now()) {
+			return true
+		}
+		original = held
+		return false
+	})
+	if err == backend.ErrConditionFailed {
+		return original, true
+	}
+	if err != nil {
+		// Better to let a duplicate through than to refuse the message
+		logrus.Error(err)
+		return "", false
+	}
+	// Index the record so it can be pruned once it expires
+	err = cfg.Backend.AddToSet(dedupeIndexName(queue.Name), dedupeIDSet, deduplicationID)
+	if err != nil {
+		logrus.Error(err)
+	}
+	return "", false
+}
+
+// releaseDeduplication gives up the claim on the deduplication id made for a message which then
+// couldn't be stored, so it can be published again
+func (queue *Queue) releaseDeduplication(cfg *Config, deduplicationID string, messageID string) {
+	err := cfg.Backend.DeleteRecordIf(dedupeRecordName(queue.Name, deduplicationID), func(record *backend.Map) bool {
+		held, _ := record.FetchRegister(dedupeMessageID)
+		return held == messageID
+	})
+	if err != nil && err != backend.ErrNotFound && err != backend.ErrConditionFailed {
+		logrus.Error(err)
+	}
+}
+
+// pruneDeduplication deletes the dedupe records which have expired, along with any claimed before the
+// given time, returning how many were deleted. Records claimed since then are kept, so pruning what a
+// deleted queue left behind doesn't touch the records of a queue recreated with the same name
+func (queue *Queue) pruneDeduplication(cfg *Config, claimedBefore time.Time) int {
+	index, err := cfg.Backend.FetchMap(dedupeIndexName(queue.Name))
+	if err != nil {
+		if err != backend.ErrNotFound {
+			logrus.Error(err)
+		}
+		return 0
+	}
+	now := time.Now()
+	pruned := 0
+	for _, deduplicationID := range index.FetchSet(dedupeIDSet) {
+		// Checked as part of the delete, so a record claimed again since it expired is kept
+		err := cfg.Backend.DeleteRecordIf(dedupeRecordName(queue.Name, deduplicationID), func(record *backend.Map) bool {
+			return dedupeRecordExpired(record, now) || dedupeRecordClaimedBefore(record, claimedBefore)
+		})
+		if err == backend.ErrConditionFailed {
+			continue
+		}
+		if err != nil && err != backend.ErrNotFound {
+			logrus.Error(err)
+			continue
+		}
+		err = cfg.Backend.RemoveFromSet(dedupeIndexName(queue.Name), dedupeIDSet, deduplicationID)
+		if err != nil {
+			logrus.Error(err)
+			continue
+		}
+		pruned++
+	}
+	return pruned
+}
+
+func dedupeRecordExpired(record *backend.Map, now time.Time) bool {
+	value, _ := record.FetchRegister(dedupeExpiresAt)
+	expiresAt, err := strconv.ParseInt(value, 10, 64)
+	return err != nil || !now.Before(time.Unix(0, expiresAt))
+}
+
+// dedupeRecordClaimedBefore returns true if the record was claimed before the given time. Records from
+// before claims were timed count as claimed before any time
+func dedupeRecordClaimedBefore(record *backend.Map, before time.Time) bool {
+	if before.IsZero() {
+		return false
+	}
+	value, _ := record.FetchRegister(dedupeClaimedAt)
+	claimedAt, err := strconv.ParseInt(value, 10, 64)
+	return err != nil || time.Unix(0, claimedAt).Before(before)
+}
+
+// dedupeIndexName returns the name of the map indexing the dedupe records of the queue. It has its own
+// prefix, rather than queue_, so it can't be mistaken for the config of a queue with a similar name
+func dedupeIndexName(queueName string) string {
+	return fmt.Sprintf("dedupe_%s", queueName)
+}
+
+// dedupeRecordName returns the name of the dedupe record for the deduplication id. Queue names can't
+// hold a slash, as they are part of the url path, so whatever the id holds the name can't belong to
+// another queue
+func dedupeRecordName(queueName string, deduplicationID string) string {
+	return fmt.Sprintf("dedupe_%s/%s", queueName, deduplicationID)
+}
@@ -0,0 +1,101 @@
+package app
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/Tapjoy/dynamiq/app/backend"
+)
+
+// ErrDeletionInProgress represents the condition where a queue is deleted while an earlier deletion of it is still running
+var ErrDeletionInProgress = errors.New("A deletion is already in progress for this queue")
+
+// DeleteQueue deletes the given queue. It is removed from the set of known queues, unsubscribed from
+// every topic, and its partitions on this node are stopped straight away. Its messages, and the rest
+// of its records, are deleted in the background. Returns the status of the deletion, which can be
+// followed with DeletionStatus
+func (queues *Queues) DeleteQueue(name string, cfg *Config) (JobStatus, error) {
+	recordName := deletionRecordName(name)
+	inProgress := ErrDeletionInProgress
+	if cfg.Queues.Exists(cfg, name) {
+		// Recreated since any deletion still running started, which won't touch its new messages
+		inProgress = nil
+	}
+	status, err := startJob(cfg, recordName, inProgress)
+	if err != nil {
+		return status, err
+	}
+	err = cfg.removeFromKnownQueues(name)
+	if err != nil {
+		finishJob(cfg, recordName, status.StartedAt, 0, err)
+		return status, err
+	}
+	err = unsubscribeFromTopics(cfg, name)
+	if err != nil {
+		// The other nodes drop subscriptions to queues which no longer exist as they sync
+		logrus.Error(err)
+	}
+
+	queue, present := queues.dropQueue(name)
+	if present {
+		queue.Parts.Stop()
+	} else {
+		// Not yet synced to this node, but its messages still need deleting
+		queue = &Queue{Name: name}
+	}
+	cfg.Backend.DeleteMap(queueConfigRecordName(name))
+	cfg.Backend.DeleteMap(purgeRecordName(name))
+	resetDepth(cfg.Stats.Client, name)
+	cfg.Gossip.Announce(ConfigQueue, name)
+
+	go func() {
+		// Messages put after the deletion started belong to a queue recreated with the same name
+		deleted, err := queue.deleteMessagesBefore(cfg, status.StartedAt, recordName, func(int) {})
+		if err != nil {
+			logrus.Error(err)
+		}
+		// Only those of the deleted queue, the index is shared with any queue recreated with the same name
+		queue.pruneDeduplication(cfg, status.StartedAt)
+		if !cfg.Queues.Exists(cfg, name) {
+			cfg.Backend.DeleteMap(dedupeIndexName(name))
+		}
+		finishJob(cfg, recordName, status.StartedAt, deleted, err)
+		logrus.Debugf("Deleted %d messages from deleted queue %s", deleted, name)
+	}()
+	return status, nil
+}
+
+// DeletionStatus returns the progress of the latest deletion of the named queue, or false if it was never deleted
+func (queues *Queues) DeletionStatus(cfg *Config, name string) (JobStatus, bool, error) {
+	return fetchJob(cfg, deletionRecordName(name))
+}
+
+// unsubscribeFromTopics removes the queue from the subscribers of every topic in the backend, as
+// well as from the topics known to this node
+func unsubscribeFromTopics(cfg *Config, name string) error {
+	topicsConfig, err := cfg.Backend.FetchMap("topicsConfig")
+	if err != nil && err != backend.ErrNotFound {
+		return err
+	}
+	for _, topicName := range topicsConfig.FetchSet("topics") {
+		if cfg.Topics != nil {
+			topic, present := cfg.Topics.getTopic(topicName)
+			if present {
+				// Also refreshes the subscribers known to this node
+				topic.DeleteQueue(cfg, name)
+				continue
+			}
+		}
+		err = cfg.Backend.RemoveFromSet(topicConfigRecordName(topicName), "queues", name)
+		if err != nil && err != backend.ErrNotFound {
+			return err
+		}
+		cfg.Gossip.Announce(ConfigTopic, topicName)
+	}
+	return nil
+}
+
+func deletionRecordName(queueName string) string {
+	return fmt.Sprintf("queue_%s_deletion", queueName)
+}
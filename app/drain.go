@@ -0,0 +1,206 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/hashicorp/memberlist"
+)
+
+// DrainTimeout is the longest a drain waits on requests in flight before carrying on without them.
+// It is longer than the longest wait a receive can ask for
+const DrainTimeout = 30 * time.Second
+
+// LeaveTimeout is the longest a drain waits on its leave being gossiped to the rest of the cluster
+const LeaveTimeout = 5 * time.Second
+
+// ErrDraining represents the condition where a receive is made from a node which is draining
+var ErrDraining = errors.New("This node is draining, and no longer serving receives")
+
+// DrainStatus represents how far a drain has got
+type DrainStatus struct {
+	Draining   bool       `json:"draining"`
+	Drained    bool       `json:"drained"`
+	StartedAt  *time.Time `json:"started_at,omitempty"`
+	FinishedAt *time.Time `json:"finished_at,omitempty"`
+}
+
+// Drain takes this node out of service without losing track of any messages. It stops serving
+// receives, lets those in flight finish, stops syncing config, gives up the partitions of every queue
+// and the leases on the keyspace so the other nodes take them over, and leaves the cluster
+type Drain struct {
+	sync.Mutex
+	cfg    *Config
+	list   *memberlist.Memberlist
+	status DrainStatus
+	// Closed once receives stop being served
+	stopped chan struct{}
+	// Closed once a shutdown has finished, and the process can exit
+	exited   chan struct{}
+	once     sync.Once
+	receives sync.WaitGroup
+}
+
+// NewDrain creates the drain for this node
+func NewDrain(cfg *Config, list *memberlist.Memberlist) *Drain {
+	return &Drain{
+		cfg:     cfg,
+		list:    list,
+		stopped: make(chan struct{}),
+		exited:  make(chan struct{}),
+	}
+}
+
+// Status returns how far the drain has got
+func (drain *Drain) Status() DrainStatus {
+	drain.Lock()
+	defer drain.Unlock()
+	return drain.status
+}
+
+// Draining returns true once the node has started draining. Never true without a drain
+func (drain *Drain) Draining() bool {
+	if drain == nil {
+		return false
+	}
+	drain.Lock()
+	defer drain.Unlock()
+	return drain.status.Draining
+}
+
+// beginReceive counts a receive in flight, or returns false if the node is draining
+func (drain *Drain) beginReceive() bool {
+	if drain == nil {
+		return true
+	}
+	drain.Lock()
+	defer drain.Unlock()
+	if drain.status.Draining {
+		return false
+	}
+	drain.receives.Add(1)
+	return true
+}
+
+// endReceive counts a receive as finished
+func (drain *Drain) endReceive() {
+	if drain != nil {
+		drain.receives.Done()
+	}
+}
+
+// stopping returns a channel which is closed once receives stop being served
+func (drain *Drain) stopping() <-chan struct{} {
+	if drain == nil {
+		return nil
+	}
+	return drain.stopped
+}
+
+// stopReceives stops any more receives being served, and wakes those waiting on messages
+func (drain *Drain) stopReceives() {
+	drain.Lock()
+	defer drain.Unlock()
+	if drain.status.Draining {
+		return
+	}
+	now := time.Now()
+	drain.status.Draining = true
+	drain.status.StartedAt = &now
+	close(drain.stopped)
+	logrus.Info("Draining, no longer serving receives")
+}
+
+// Start begins draining the node in the background, returning straight away
+func (drain *Drain) Start() DrainStatus {
+	drain.stopReceives()
+	go drain.Drain()
+	return drain.Status()
+}
+
+// Drain drains the node, returning once it is drained. The node keeps serving every other request,
+// so messages received before the drain can still be deleted. Calling it again waits on the first drain
+func (drain *Drain) Drain() DrainStatus {
+	drain.stopReceives()
+	drain.once.Do(drain.finish)
+	return drain.Status()
+}
+
+// finish drains the node, once receives have stopped
+func (drain *Drain) finish() {
+	finished := make(chan struct{})
+	go func() {
+		drain.receives.Wait()
+		close(finished)
+	}()
+	select {
+	case <-finished:
+	case <-time.After(DrainTimeout):
+		logrus.Warn("Gave up waiting on receives in flight to finish")
+	}
+
+	// The config sync is stopped first, so it doesn't bring back queues while their partitions are given up
+	drain.cfg.Queues.stopSync()
+	if drain.cfg.Topics != nil {
+		drain.cfg.Topics.stopSync()
+	}
+
+	// Partitions are given up first, then the leases on the keyspace, so the other nodes can take
+	// over the segments of this node the moment they see it leave
+	for _, queue := range drain.cfg.Queues.queueList() {
+		queue.Parts.Stop()
+	}
+	drain.cfg.Leases.stopRenewal()
+	RenewPartitionLeases(drain.cfg, drain.list)
+	logrus.Info("Released the partitions of this node, leaving the cluster")
+	err := drain.list.Leave(LeaveTimeout)
+	if err != nil {
+		logrus.Error(err)
+	}
+
+	drain.Lock()
+	defer drain.Unlock()
+	now := time.Now()
+	drain.status.Drained = true
+	drain.status.FinishedAt = &now
+	logrus.Info("Drained")
+}
+
+// Shutdown drains the node for the process to exit. Every request in flight on the server is
+// finished before the partitions are given up, and the node shuts down its memberlist once drained
+func (drain *Drain) Shutdown(server *http.Server) {
+	defer close(drain.exited)
+	drain.stopReceives()
+	ctx, cancel := context.WithTimeout(context.Background(), DrainTimeout)
+	defer cancel()
+	err := server.Shutdown(ctx)
+	if err != nil {
+		logrus.Error(err)
+	}
+	drain.Drain()
+	err = drain.list.Shutdown()
+	if err != nil {
+		logrus.Error(err)
+	}
+}
+
+// ShutdownOnSignal waits on SIGTERM or an interrupt, then shuts the node down
+func (drain *Drain) ShutdownOnSignal(server *http.Server) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, os.Interrupt)
+	received := <-signals
+	logrus.Infof("Received %s, shutting down", received)
+	drain.Shutdown(server)
+}
+
+// Wait returns once a shutdown has finished
+func (drain *Drain) Wait() {
+	<-drain.exited
+}
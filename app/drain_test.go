@@ -0,0 +1,111 @@
+package app_test
+
+import (
+	"time"
+
+	"github.com/Tapjoy/dynamiq/app"
+	"github.com/hashicorp/memberlist"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Drain", func() {
+
+	var (
+		drainCfg  app.Config
+		drainList *memberlist.Memberlist
+		queue     *app.Queue
+		queueName = "drain_queue"
+	)
+
+	BeforeEach(func() {
+		Expect(cfg.InitializeQueue(queueName)).To(Succeed())
+		queue = queues.QueueMap[queueName]
+
+		// A node of its own to drain, so the rest of the suite keeps its node
+		drainCfg = *cfg
+		drainCfg.Queues = &app.Queues{QueueMap: map[string]*app.Queue{queueName: queue}}
+		drainCfg.Topology = app.NewTopology(&drainCfg)
+		drainList, _, _ = app.InitMemberList("drain_node", 8010, []string{"127.0.0.1:8000"}, core.SeedPort, drainCfg.Topology, nil)
+		drainCfg.Drain = app.NewDrain(&drainCfg, drainList)
+		drainCfg.Leases = app.NewLeases()
+		drainCfg.Topology.Rebalance(drainList)
+		// It takes its share once this node gives it up
+		Eventually(cfg.Topology.Members).Should(HaveKey("drain_node"))
+		cfg.Topology.Rebalance(memberList)
+		app.ScheduleLeaseRenewal(&drainCfg, drainList)
+	})
+
+	AfterEach(func() {
+		drainList.Shutdown()
+		queues.DeleteQueue(queueName, cfg)
+		Eventually(cfg.Topology.Members).ShouldNot(HaveKey("drain_node"))
+		cfg.Topology.Rebalance(memberList)
+	})
+
+	It("should refuse receives once draining", func() {
+		Expect(drainCfg.Drain.Draining()).To(BeFalse())
+		_, err := queue.GetWithWait(&drainCfg, drainList, 1, 0)
+		Expect(err).ToNot(Equal(app.ErrDraining))
+
+		status := drainCfg.Drain.Drain()
+		Expect(status.Draining).To(BeTrue())
+		Expect(status.Drained).To(BeTrue())
+		Expect(*status.FinishedAt).To(BeTemporally(">=", *status.StartedAt))
+
+		_, err = queue.GetWithWait(&drainCfg, drainList, 1, 0)
+		Expect(err).To(Equal(app.ErrDraining))
+	})
+
+	It("should hand back receivers waiting on messages straight away", func() {
+		done := make(chan error)
+		go func() {
+			_, err := queue.GetWithWait(&drainCfg, drainList, 1, 10*time.Second)
+			done <- err
+		}()
+		// Let the receive start waiting
+		time.Sleep(50 * time.Millisecond)
+
+		started := time.Now()
+		drainCfg.Drain.Drain()
+		Expect(time.Since(started)).To(BeNumerically("<", 5*time.Second))
+		Eventually(done).Should(Receive(Not(Equal(app.ErrDraining))))
+	})
+
+	It("should give up its partitions while queues are refreshed", func() {
+		// Another node keeps creating and deleting a queue of its own
+		otherName := "drain_other_queue"
+		refresh := app.ConfigChange{Kind: app.ConfigQueue, Name: otherName, Node: "other"}
+		gossip := app.NewGossip(&drainCfg)
+		done := make(chan struct{})
+		refreshed := make(chan struct{})
+		go func() {
+			defer close(refreshed)
+			for {
+				select {
+				case <-done:
+					return
+				default:
+					cfg.Backend.AddToSet(app.QueueConfigName, app.QueueSetName, otherName)
+					gossip.Refresh(refresh)
+					cfg.Backend.RemoveFromSet(app.QueueConfigName, app.QueueSetName, otherName)
+					gossip.Refresh(refresh)
+				}
+			}
+		}()
+		drainCfg.Drain.Drain()
+		close(done)
+		<-refreshed
+		Expect(queue.Parts.PartitionCount()).To(BeZero())
+	})
+
+	It("should give up its partitions and leases, and leave the cluster", func() {
+		Expect(app.GetNodeRanges(&drainCfg, drainList)).ToNot(BeEmpty())
+
+		drainCfg.Drain.Drain()
+		Expect(queue.Parts.PartitionCount()).To(BeZero())
+		Expect(app.GetNodeRanges(&drainCfg, drainList)).To(BeEmpty())
+		Expect(app.NodePartitionLeases(&drainCfg)).To(BeEmpty())
+		Expect(drainCfg.Topology.Members()).ToNot(HaveKey("drain_node"))
+	})
+})
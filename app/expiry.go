@@ -0,0 +1,106 @@
+package app
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/Tapjoy/dynamiq/app/stats"
+	"github.com/hashicorp/memberlist"
+)
+
+// QueueExpiredStatsSuffix is
+const QueueExpiredStatsSuffix = "expired.count"
+
+// ExpiryBatchSize is the number of messages read at a time while looking for expired messages
+const ExpiryBatchSize = 100
+
+func recordExpired(c stats.Client, queueName string, numberOfMessages int64) error {
+	// Increment # Expired
+	key := fmt.Sprintf("%s.%s", queueName, QueueExpiredStatsSuffix)
+	err := c.Incr(key, numberOfMessages)
+	// Decrement Depth count
+	key = fmt.Sprintf("%s.%s", queueName, QueueDepthStatsSuffix)
+	err = c.DecrGauge(key, numberOfMessages)
+	return err
+}
+
+// ScheduleExpiry starts reaping expired messages from every queue on an interval. Each node
+// only reaps the range of the keyspace it serves messages from
+func (queues *Queues) ScheduleExpiry(cfg *Config, list *memberlist.Memberlist) {
+	// If we haven't created it yet, create the ticker
+	if queues.expiryScheduler == nil {
+		queues.expiryScheduler = time.NewTicker(cfg.Core.ExpiryInterval * time.Millisecond)
+	}
+	// Go routine to listen to either the scheduler or the killer
+	go func(config *Config) {
+		for {
+			select {
+			// Check to see if we have a tick
+			case <-queues.expiryScheduler.C:
+				queues.expireMessages(config, list)
+			// Check to see if we've been stopped
+			case <-queues.expiryKiller:
+				queues.expiryScheduler.Stop()
+				return
+			}
+		}
+	}(cfg)
+}
+
+func (queues *Queues) expireMessages(cfg *Config, list *memberlist.Memberlist) {
+	for _, queue := range queues.queueList() {
+		expired, err := queue.ExpireMessages(cfg, list)
+		if err != nil {
+			logrus.Error(err)
+		}
+		logrus.Debugf("Expired %d messages from %s", expired, queue.Name)
+		pruned := queue.pruneDeduplication(cfg, time.Time{})
+		logrus.Debugf("Pruned %d deduplication records from %s", pruned, queue.Name)
+	}
+}
+
+// ExpireMessages deletes the messages in this nodes range of the keyspace which have been on the
+// queue for longer than its message_retention_period, returning how many were deleted
+func (queue *Queue) ExpireMessages(cfg *Config, list *memberlist.Memberlist) (int, error) {
+	retention, _ := cfg.GetMessageRetentionPeriod(queue.Name)
+	if retention <= 0 {
+		return 0, nil
+	}
+	expireBefore := time.Now().Add(-time.Duration(retention * float64(time.Second)))
+	nodeRanges := GetNodeRanges(cfg, list)
+
+	expired := 0
+	defer func() { recordExpired(cfg.Stats.Client, queue.Name, int64(expired)) }()
+	// The node has a slice of the band of every priority, for every range it owns
+	for _, nodeRange := range nodeRanges {
+		for priority := 0; priority < PriorityLevels; priority++ {
+			bottom, top := priorityRange(priority, nodeRange.Bottom, nodeRange.Top)
+			continuation := ""
+			for {
+				ids, next, err := cfg.Backend.RangeScan(queue.Name, bottom, top, ExpiryBatchSize, continuation)
+				if err != nil {
+					return expired, err
+				}
+				for _, message := range queue.fetchMessages(cfg, ids) {
+					enqueuedAt, ok := messageEnqueuedAt(&message)
+					// Messages from before enqueue times were recorded can't be aged, so they are kept
+					if !ok || enqueuedAt.After(expireBefore) {
+						continue
+					}
+					err = cfg.Backend.DeleteMessage(queue.Name, message.Key)
+					if err != nil {
+						logrus.Error(err)
+						continue
+					}
+					expired++
+				}
+				if next == "" {
+					break
+				}
+				continuation = next
+			}
+		}
+	}
+	return expired, nil
+}
@@ -0,0 +1,271 @@
+package app
+
+import (
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/Tapjoy/dynamiq/app/backend"
+)
+
+// fifoGroupBits is the number of low bits of a fifo message id which order the messages of a group.
+// The bits above them are taken from a hash of the message group, so each group lives in one block of
+// the keyspace
+const fifoGroupBits = 47
+
+// fifoSequenceBits is the number of low bits of a fifo message id counting the messages put within the
+// same millisecond. The bits above them, up to fifoGroupBits, hold the millisecond
+const fifoSequenceBits = 7
+
+// FifoSequenceAttempts is the number of times a publish tries to take the next id of a block of the
+// keyspace, while others are taking ids from the same block, before giving up
+const FifoSequenceAttempts = 50
+
+// fifoSequence is the register, on a block sequence record, holding the order bits of the last id taken
+const fifoSequence = "sequence"
+
+// FifoGroupPageSize is the number of ids read at a time while scanning the block of a message group
+const FifoGroupPageSize = 100
+
+// FifoGroupClaimTime is how long a receiver may hold the claim on a message group while it picks the
+// messages to hand out from it. A claim left behind by a receiver which went away expires after this
+const FifoGroupClaimTime = 5 * time.Second
+
+// fifoGroupClaim is the register, on a group claim record, holding the token of the receiver holding it
+const fifoGroupClaim = "claim"
+
+// fifoGroupClaimExpiresAt is the register, on a group claim record, holding when the claim lapses in unix nanoseconds
+const fifoGroupClaimExpiresAt = "expires_at"
+
+// fifoEpoch is the time fifo message ids count milliseconds from. The 40 bits left for them last ~34 years
+var fifoEpoch = time.Date(2020, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+// fifoGroupPrefix returns the bottom of the block of the keyspace belonging to the message group
+func fifoGroupPrefix(group string) int64 {
+	hash := fnv.New32a()
+	hash.Write([]byte(group))
+	// 16 bits of hash above the order bits keeps the id within 63 bits
+	return int64(hash.Sum32()>>16) << fifoGroupBits
+}
+
+// fifoMessageID returns an id inside of the block of the keyspace belonging to the message group. The
+// order bits are taken from a sequence kept in the backend for the block, and only ever go up, whichever
+// node the message is published through, so the ids of a group sort in publish order and never collide.
+// The sequence starts from the time, so ids stay spread out if the record is ever lost
+func (queue *Queue) fifoMessageID(cfg *Config, group string) (string, error) {
+	prefix := fifoGroupPrefix(group)
+	name := fifoSequenceName(queue.Name, prefix)
+	for attempt := 0; attempt < FifoSequenceAttempts; attempt++ {
+		record, err := cfg.Backend.FetchRecord(name)
+		if err != nil && err != backend.ErrNotFound {
+			return "", err
+		}
+		last, taken := record.FetchRegister(fifoSequence)
+		next := int64(time.Since(fifoEpoch)/time.Millisecond) << fifoSequenceBits
+		if taken {
+			previous, _ := strconv.ParseInt(last, 10, 64)
+			if next <= previous {
+				// Taken already this millisecond, or by a node whose clock is ahead of ours, so follow on from it
+				next = previous + 1
+			}
+		}
+		// Only take the id if no one else took one from the block since we read the sequence
+		err = cfg.Backend.UpdateRecordIf(name, map[string]string{fifoSequence: strconv.FormatInt(next, 10)}, func(record *backend.Map) bool {
+			stored, held := record.FetchRegister(fifoSequence)
+			return held == taken && stored == last
+		})
+		if err == nil {
+			return strconv.FormatInt(prefix|next&(1<<fifoGroupBits-1), 10), nil
+		}
+		if err != backend.ErrConditionFailed {
+			return "", err
+		}
+	}
+	return "", ErrFifoSequenceContended
+}
+
+// fifoGroupRange returns the bottom and top of the block of the keyspace belonging to the message group
+func fifoGroupRange(group string) (int, int) {
+	bottom := fifoGroupPrefix(group)
+	return int(bottom), int(bottom | (1<<fifoGroupBits - 1))
+}
+
+// byID orders messages by their ids
+type byID []backend.Message
+
+func (m byID) Len() int      { return len(m) }
+func (m byID) Swap(i, j int) { m[i], m[j] = m[j], m[i] }
+func (m byID) Less(i, j int) bool {
+	left, _ := strconv.ParseInt(m[i].Key, 10, 64)
+	right, _ := strconv.ParseInt(m[j].Key, 10, 64)
+	return left < right
+}
+
+// receiveFifoMessages hands out up to limit messages, in publish order from the head of each message group
+// found among the given messages. Messages put before the queue was made fifo have no group, and are
+// handed out as they would be on any other queue
+func (queue *Queue) receiveFifoMessages(cfg *Config, messages []backend.Message, ranges []KeyRange, limit int64, visibleAt time.Time) []backend.Message {
+	groups := make([]string, 0)
+	seen := make(map[string]bool)
+	ungrouped := make([]backend.Message, 0)
+	for _, message := range messages {
+		group := MessageGroup(&message)
+		if group == "" {
+			ungrouped = append(ungrouped, message)
+			continue
+		}
+		if !seen[group] {
+			seen[group] = true
+			groups = append(groups, group)
+		}
+	}
+
+	received := make([]backend.Message, 0, limit)
+	for _, group := range groups {
+		if int64(len(received)) == limit {
+			return received
+		}
+		received = append(received, queue.receiveGroup(cfg, group, ranges, limit-int64(len(received)), visibleAt)...)
+	}
+	selected := queue.selectMessages(cfg, ungrouped, limit-int64(len(received)), visibleAt)
+	return append(received, queue.recordReceipts(cfg, selected)...)
+}
+
+// receiveGroup hands out up to limit messages from the head of the message group, in publish order. A
+// group whose oldest message is in flight is skipped entirely, so its later messages aren't handed out
+// until the earlier one is deleted or times out. The group is only served by the partition whose ranges
+// hold its oldest message, and only while this receiver holds the claim on it in the backend, so no one
+// else can hand out its messages in the meantime
+func (queue *Queue) receiveGroup(cfg *Config, group string, ranges []KeyRange, limit int64, visibleAt time.Time) []backend.Message {
+	token, claimed := queue.claimGroup(cfg, group)
+	if !claimed {
+		// Someone else is receiving from the group right now
+		return nil
+	}
+	defer queue.releaseGroup(cfg, group, token)
+
+	bottom, top := fifoGroupRange(group)
+	now := time.Now()
+	head := true
+	candidates := make([]backend.Message, 0, limit)
+	continuation := ""
+	// Read from the head of the block until the batch is full, or we reach a message in flight
+	for pages := 0; pages < MaxReceivePages && int64(len(candidates)) < limit; pages++ {
+		ids, next, err := cfg.Backend.RangeScan(queue.Name, bottom, top, FifoGroupPageSize, continuation)
+		if err != nil {
+			logrus.Error(err)
+			break
+		}
+		messages := queue.fetchMessages(cfg, ids)
+		sort.Sort(byID(messages))
+		for _, message := range messages {
+			// Other groups may hash to the same block
+			if MessageGroup(&message) != group {
+				continue
+			}
+			if head && !inRanges(ranges, message.Key) {
+				// The group belongs to the partition holding its head
+				return nil
+			}
+			head = false
+			if messageInFlight(&message, now) {
+				// Everything after this in the group has to wait for it. It is only dead lettered once
+				// whoever holds it lets it time out
+				return queue.recordGroupReceipts(cfg, candidates)
+			}
+			if queue.overReceiveLimit(cfg, &message) {
+				continue
+			}
+			markInFlight(&message, visibleAt)
+			candidates = append(candidates, message)
+			if int64(len(candidates)) == limit {
+				break
+			}
+		}
+		if next == "" {
+			break
+		}
+		continuation = next
+	}
+	return queue.recordGroupReceipts(cfg, candidates)
+}
+
+// recordGroupReceipts stores the in-flight state of the messages of a group one at a time, in order. It
+// stops at the first which couldn't be stored, so a later message is never handed out without the earlier ones
+func (queue *Queue) recordGroupReceipts(cfg *Config, candidates []backend.Message) []backend.Message {
+	for i := range candidates {
+		if len(queue.recordReceipts(cfg, candidates[i:i+1])) == 0 {
+			return candidates[:i]
+		}
+	}
+	return candidates
+}
+
+// claimGroup claims the message group in the backend for this receiver, unless someone else already holds
+// it. Returns the token to release the claim with
+func (queue *Queue) claimGroup(cfg *Config, group string) (string, bool) {
+	token := newReceiptHandle()
+	expiresAt := time.Now().Add(FifoGroupClaimTime)
+	err := cfg.Backend.UpdateRecordIf(fifoGroupClaimName(queue.Name, group), map[string]string{
+		fifoGroupClaim:          token,
+		fifoGroupClaimExpiresAt: strconv.FormatInt(expiresAt.UnixNano(), 10),
+	}, func(record *backend.Map) bool {
+		_, held := record.FetchRegister(fifoGroupClaim)
+		return !held || fifoGroupClaimExpired(record, time.Now())
+	})
+	if err != nil {
+		if err != backend.ErrConditionFailed {
+			logrus.Error(err)
+		}
+		return "", false
+	}
+	return token, true
+}
+
+// releaseGroup gives up the claim on the message group, if it is still ours
+func (queue *Queue) releaseGroup(cfg *Config, group string, token string) {
+	err := cfg.Backend.DeleteRecordIf(fifoGroupClaimName(queue.Name, group), func(record *backend.Map) bool {
+		held, _ := record.FetchRegister(fifoGroupClaim)
+		return held == token
+	})
+	if err != nil && err != backend.ErrNotFound && err != backend.ErrConditionFailed {
+		logrus.Error(err)
+	}
+}
+
+func fifoGroupClaimExpired(record *backend.Map, now time.Time) bool {
+	value, _ := record.FetchRegister(fifoGroupClaimExpiresAt)
+	expiresAt, err := strconv.ParseInt(value, 10, 64)
+	return err != nil || !now.Before(time.Unix(0, expiresAt))
+}
+
+// inRanges returns true if the message id falls in one of the ranges, as scanned by Get
+func inRanges(ranges []KeyRange, key string) bool {
+	id, err := strconv.ParseInt(key, 10, 64)
+	if err != nil {
+		return false
+	}
+	// Get scans each range in every priority band, the position undoes that
+	position := priorityPosition(id)
+	for _, keyRange := range ranges {
+		if position >= int64(keyRange.Bottom) && position <= int64(keyRange.Top) {
+			return true
+		}
+	}
+	return false
+}
+
+// fifoGroupClaimName returns the name of the record claiming the message group. Queue names can't hold
+// a slash, so whatever the group holds the name can't belong to another queue
+func fifoGroupClaimName(queueName string, group string) string {
+	return fmt.Sprintf("fifo_%s/%s", queueName, group)
+}
+
+// fifoSequenceName returns the name of the record holding the sequence of the block of the keyspace
+// starting at the prefix. Every group hashing to the block shares it, so their ids can't collide either
+func fifoSequenceName(queueName string, prefix int64) string {
+	return fmt.Sprintf("fifo_sequence_%s/%d", queueName, prefix)
+}
@@ -0,0 +1,163 @@
+package app
+
+import (
+	"encoding/json"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/hashicorp/memberlist"
+)
+
+// GossipRetransmits scales how many times each announcement is gossiped, by the log of the number of
+// members, so it reaches every node even if some of the packets are lost
+const GossipRetransmits = 4
+
+// GossipBacklog is the most announcements from other nodes waiting to be refreshed. Any past it are
+// dropped, and picked up by the next config sync instead
+const GossipBacklog = 1024
+
+// The kinds of record a config change can be announced for
+const (
+	ConfigQueue = "queue"
+	ConfigTopic = "topic"
+)
+
+// ConfigChange announces that the config of a queue or topic was changed by a node, so the other
+// nodes refresh that record from the backend straight away, rather than on their next config sync
+type ConfigChange struct {
+	Kind string `json:"kind"`
+	Name string `json:"name"`
+	Node string `json:"node"`
+}
+
+// Gossip announces config changes made on this node to the rest of the cluster, and refreshes the
+// records other nodes announce. It is the memberlist Delegate, so announcements ride on the gossip
+// memberlist already sends. The periodic config sync stays as a backstop for any which are lost
+type Gossip struct {
+	cfg        *Config
+	node       string
+	broadcasts *memberlist.TransmitLimitedQueue
+	refreshes  chan ConfigChange
+}
+
+// NewGossip creates the gossip for this node, which is named by the core config
+func NewGossip(cfg *Config) *Gossip {
+	gossip := &Gossip{
+		cfg:       cfg,
+		node:      cfg.Core.Name,
+		refreshes: make(chan ConfigChange, GossipBacklog),
+	}
+	gossip.broadcasts = &memberlist.TransmitLimitedQueue{
+		NumNodes:       gossip.numNodes,
+		RetransmitMult: GossipRetransmits,
+	}
+	return gossip
+}
+
+// numNodes returns the number of members the announcements need to reach
+func (gossip *Gossip) numNodes() int {
+	if gossip.cfg.Topology == nil {
+		return 1
+	}
+	return gossip.cfg.Topology.NumMembers()
+}
+
+// Announce tells the other nodes the config of the queue or topic changed. Only the latest
+// announcement for a record waiting to be gossiped is kept. Does nothing without gossip
+func (gossip *Gossip) Announce(kind string, name string) {
+	if gossip == nil {
+		return
+	}
+	message, err := json.Marshal(ConfigChange{Kind: kind, Name: name, Node: gossip.node})
+	if err != nil {
+		logrus.Error(err)
+		return
+	}
+	logrus.Debugf("Announcing the config of %s %s changed", kind, name)
+	gossip.broadcasts.QueueBroadcast(&configBroadcast{name: kind + "/" + name, message: message})
+}
+
+// NodeMeta is called by memberlist for the metadata of this node, of which there is none
+func (gossip *Gossip) NodeMeta(limit int) []byte {
+	return nil
+}
+
+// NotifyMsg is called by memberlist with each announcement gossiped to this node. It must not block
+// the packets being received, so the refresh is left to ScheduleRefresh
+func (gossip *Gossip) NotifyMsg(message []byte) {
+	var change ConfigChange
+	err := json.Unmarshal(message, &change)
+	if err != nil {
+		logrus.Error(err)
+		return
+	}
+	if change.Node == gossip.node {
+		return
+	}
+	select {
+	case gossip.refreshes <- change:
+	default:
+		logrus.Warnf("Dropped the announcement of a change to %s %s, leaving it to the next config sync", change.Kind, change.Name)
+	}
+}
+
+// GetBroadcasts is called by memberlist for the announcements to gossip along with its own messages
+func (gossip *Gossip) GetBroadcasts(overhead int, limit int) [][]byte {
+	return gossip.broadcasts.GetBroadcasts(overhead, limit)
+}
+
+// LocalState is called by memberlist for the state to exchange with another node. The full config
+// lives in the backend, and is read by the config sync, so there is none
+func (gossip *Gossip) LocalState(join bool) []byte {
+	return nil
+}
+
+// MergeRemoteState is called by memberlist with the state of another node, of which there is none
+func (gossip *Gossip) MergeRemoteState(state []byte, join bool) {
+}
+
+// Refresh brings the record announced as changed up to date with the backend
+func (gossip *Gossip) Refresh(change ConfigChange) {
+	logrus.Debugf("Refreshing %s %s, announced as changed by %s", change.Kind, change.Name, change.Node)
+	switch change.Kind {
+	case ConfigQueue:
+		gossip.cfg.Queues.refreshQueue(gossip.cfg, change.Name)
+	case ConfigTopic:
+		if gossip.cfg.Topics != nil {
+			gossip.cfg.Topics.refreshTopic(gossip.cfg, change.Name)
+		}
+	default:
+		logrus.Warnf("Ignoring the announcement of a change to unknown kind of record %s", change.Kind)
+	}
+}
+
+// ScheduleRefresh starts refreshing the records other nodes announce as changed, one at a time
+func (gossip *Gossip) ScheduleRefresh() {
+	go func() {
+		for change := range gossip.refreshes {
+			gossip.Refresh(change)
+		}
+	}()
+}
+
+// configBroadcast is an announcement waiting to be gossiped. It is named by the record it is for, so
+// a later announcement for the same record replaces it
+type configBroadcast struct {
+	name    string
+	message []byte
+}
+
+func (broadcast *configBroadcast) Invalidates(other memberlist.Broadcast) bool {
+	named, ok := other.(memberlist.NamedBroadcast)
+	return ok && named.Name() == broadcast.name
+}
+
+func (broadcast *configBroadcast) Name() string {
+	return broadcast.name
+}
+
+func (broadcast *configBroadcast) Message() []byte {
+	return broadcast.message
+}
+
+func (broadcast *configBroadcast) Finished() {
+}
@@ -0,0 +1,151 @@
+package app_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/Tapjoy/dynamiq/app"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Gossip", func() {
+
+	var (
+		gossip   *app.Gossip
+		previous *app.Gossip
+	)
+
+	// Returns the announcements waiting to be gossiped
+	announced := func() []app.ConfigChange {
+		changes := make([]app.ConfigChange, 0)
+		for _, message := range gossip.GetBroadcasts(0, 65536) {
+			var change app.ConfigChange
+			Expect(json.Unmarshal(message, &change)).To(Succeed())
+			changes = append(changes, change)
+		}
+		return changes
+	}
+
+	BeforeEach(func() {
+		// A gossip of its own, so announcements from other specs don't get in the way
+		previous = cfg.Gossip
+		gossip = app.NewGossip(cfg)
+		cfg.Gossip = gossip
+	})
+
+	AfterEach(func() {
+		cfg.Gossip = previous
+	})
+
+	Context("Announcing", func() {
+		It("should announce a change to the settings of a queue, once", func() {
+			Expect(cfg.SetMaxReceiveCount(testQueueName, 5)).To(Succeed())
+			Expect(cfg.SetMaxReceiveCount(testQueueName, 0)).To(Succeed())
+			Expect(announced()).To(Equal([]app.ConfigChange{{Kind: app.ConfigQueue, Name: testQueueName, Node: core.Name}}))
+		})
+
+		It("should apply a change to the settings of a queue on this node straight away", func() {
+			Expect(cfg.SetMaxReceiveCount(testQueueName, 5)).To(Succeed())
+			defer cfg.SetMaxReceiveCount(testQueueName, 0)
+			value, _ := queues.QueueMap[testQueueName].Config.FetchRegister(app.MaxReceiveCount)
+			Expect(value).To(Equal("5"))
+		})
+
+		It("should announce a queue being created and deleted", func() {
+			Expect(cfg.InitializeQueue("gossip_queue")).To(Succeed())
+			Expect(announced()).To(ContainElement(app.ConfigChange{Kind: app.ConfigQueue, Name: "gossip_queue", Node: core.Name}))
+
+			_, err := queues.DeleteQueue("gossip_queue", cfg)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(announced()).To(ContainElement(app.ConfigChange{Kind: app.ConfigQueue, Name: "gossip_queue", Node: core.Name}))
+		})
+	})
+
+	Context("Refreshing", func() {
+		queueName := "gossip_peer_queue"
+		recordName := fmt.Sprintf("queue_%s_config", queueName)
+		change := app.ConfigChange{Kind: app.ConfigQueue, Name: queueName, Node: "other"}
+
+		AfterEach(func() {
+			cfg.Backend.RemoveFromSet(app.QueueConfigName, app.QueueSetName, queueName)
+			gossip.Refresh(change)
+			cfg.Backend.DeleteMap(recordName)
+		})
+
+		It("should pick up a queue created, changed and deleted by another node", func() {
+			// As another node would create it, without this node knowing
+			settings := make(map[string]string)
+			for _, setting := range app.QueueSettings {
+				settings[setting.Name] = setting.Default
+			}
+			Expect(cfg.Backend.UpdateRegisters(recordName, settings)).To(Succeed())
+			Expect(cfg.Backend.AddToSet(app.QueueConfigName, app.QueueSetName, queueName)).To(Succeed())
+			Expect(queues.QueueMap).ToNot(HaveKey(queueName))
+
+			gossip.Refresh(change)
+			Expect(queues.QueueMap).To(HaveKey(queueName))
+
+			Expect(cfg.Backend.UpdateRegisters(recordName, map[string]string{app.MaxReceiveCount: "3"})).To(Succeed())
+			gossip.Refresh(change)
+			Expect(cfg.GetMaxReceiveCount(queueName)).To(Equal(3))
+
+			Expect(cfg.Backend.RemoveFromSet(app.QueueConfigName, app.QueueSetName, queueName)).To(Succeed())
+			gossip.Refresh(change)
+			Expect(queues.QueueMap).ToNot(HaveKey(queueName))
+		})
+
+		It("should refresh a queue while this node is reading the queues it knows", func() {
+			settings := map[string]string{app.MaxReceiveCount: "3"}
+			Expect(cfg.Backend.UpdateRegisters(recordName, settings)).To(Succeed())
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				for i := 0; i < 20; i++ {
+					cfg.Backend.AddToSet(app.QueueConfigName, app.QueueSetName, queueName)
+					gossip.Refresh(change)
+					cfg.Backend.RemoveFromSet(app.QueueConfigName, app.QueueSetName, queueName)
+					gossip.Refresh(change)
+				}
+			}()
+			for reading := true; reading; {
+				select {
+				case <-done:
+					reading = false
+				default:
+					cfg.GetMaxReceiveCount(queueName)
+				}
+			}
+			Expect(queues.QueueMap).ToNot(HaveKey(queueName))
+		})
+
+		It("should leave the topics of a queue deleted by another node to that node", func() {
+			// Never synced, the spec refreshes what it needs
+			topicCfg := *cfg
+			topicCfg.Core.SyncConfigInterval = time.Hour
+			cfg.Topics = app.InitTopics(&topicCfg, queues)
+			defer func() {
+				cfg.Topics.DeleteTopic(cfg, "gossip_peer_topic")
+				cfg.Topics = nil
+			}()
+			Expect(cfg.Backend.UpdateRegisters(recordName, map[string]string{})).To(Succeed())
+			Expect(cfg.Backend.AddToSet(app.QueueConfigName, app.QueueSetName, queueName)).To(Succeed())
+			gossip.Refresh(change)
+			cfg.Topics.CreateTopic(cfg, "gossip_peer_topic")
+			Expect(cfg.Backend.AddToSet("topic_gossip_peer_topic_config", "queues", queueName)).To(Succeed())
+			gossip.Refresh(app.ConfigChange{Kind: app.ConfigTopic, Name: "gossip_peer_topic", Node: "other"})
+			// Start over, without the announcements made setting up
+			gossip = app.NewGossip(cfg)
+			cfg.Gossip = gossip
+
+			// The deleting node unsubscribes the queue from its topics, and announces that itself
+			Expect(cfg.Backend.RemoveFromSet(app.QueueConfigName, app.QueueSetName, queueName)).To(Succeed())
+			gossip.Refresh(change)
+			Expect(queues.QueueMap).ToNot(HaveKey(queueName))
+			Expect(announced()).To(BeEmpty())
+			topicConfig, _ := cfg.Backend.FetchMap("topic_gossip_peer_topic_config")
+			Expect(topicConfig.FetchSet("queues")).To(ContainElement(queueName))
+		})
+	})
+})
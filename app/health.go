@@ -0,0 +1,93 @@
+package app
+
+import (
+	"math"
+	"time"
+
+	"github.com/Tapjoy/dynamiq/app/backend"
+	"github.com/hashicorp/memberlist"
+)
+
+// MaxHealthScore is the highest memberlist health score a healthy node has. The score is 0 while the
+// node keeps up with probing its peers, and goes up, to 7 with the default config, as it falls behind,
+// most likely because it is overloaded or cut off from the rest of the cluster
+const MaxHealthScore = 4
+
+// MaxMissedSyncs is the number of config syncs in a row a node can miss and still be ready. Past it,
+// the node may be serving queues and topics which were changed or deleted long ago
+const MaxMissedSyncs = 3
+
+// HealthCheck is the outcome of checking one thing the node depends on, along with what was found
+type HealthCheck struct {
+	Healthy bool        `json:"healthy"`
+	Value   interface{} `json:"value,omitempty"`
+	Error   string      `json:"error,omitempty"`
+}
+
+// CheckHealth checks the node can reach the backend, and is keeping up with the rest of the cluster.
+// Returns true if every check passed, along with each check by name
+func CheckHealth(cfg *Config, list *memberlist.Memberlist) (bool, map[string]HealthCheck) {
+	checks := map[string]HealthCheck{
+		"backend":    checkBackend(cfg),
+		"memberlist": checkMemberlist(list),
+	}
+	return allHealthy(checks), checks
+}
+
+// CheckReadiness checks the node is healthy, and ready to serve traffic: it isn't draining, its config
+// was synced recently, and it holds some of the keyspace to receive from. Returns true if every check
+// passed, along with each check by name
+func CheckReadiness(cfg *Config, list *memberlist.Memberlist) (bool, map[string]HealthCheck) {
+	_, checks := CheckHealth(cfg, list)
+	checks["draining"] = HealthCheck{Healthy: !cfg.Drain.Draining(), Value: cfg.Drain.Draining()}
+	checks["queues_synced"] = checkSynced(cfg, cfg.Queues.LastSynced())
+	if cfg.Topics != nil {
+		checks["topics_synced"] = checkSynced(cfg, cfg.Topics.LastSynced())
+	}
+	checks["keyspace"] = checkKeyspace(cfg)
+	return allHealthy(checks), checks
+}
+
+// checkBackend reads the set of known queues, which every node needs, timing how long it takes
+func checkBackend(cfg *Config) HealthCheck {
+	started := time.Now()
+	_, err := cfg.Backend.FetchMap(QueueConfigName)
+	if err != nil && err != backend.ErrNotFound {
+		return HealthCheck{Healthy: false, Error: err.Error()}
+	}
+	return HealthCheck{Healthy: true, Value: time.Since(started).String()}
+}
+
+// checkMemberlist checks the memberlist health score of the node
+func checkMemberlist(list *memberlist.Memberlist) HealthCheck {
+	score := list.GetHealthScore()
+	return HealthCheck{Healthy: score <= MaxHealthScore, Value: score}
+}
+
+// checkSynced checks the config was synced within the last MaxMissedSyncs sync intervals
+func checkSynced(cfg *Config, lastSynced time.Time) HealthCheck {
+	if lastSynced.IsZero() {
+		return HealthCheck{Healthy: false, Error: "never synced"}
+	}
+	limit := MaxMissedSyncs * cfg.Core.SyncConfigInterval * time.Millisecond
+	return HealthCheck{Healthy: time.Since(lastSynced) <= limit, Value: lastSynced}
+}
+
+// checkKeyspace checks the node holds the lease on some of the keyspace, giving the share it holds. The
+// leases are read as of their last renewal, so a probe never renews them or waits on the backend for them
+func checkKeyspace(cfg *Config) HealthCheck {
+	share := 0.0
+	for _, keyRange := range leasedRanges(cfg) {
+		share += float64(keyRange.Top-keyRange.Bottom) / math.MaxInt64
+	}
+	return HealthCheck{Healthy: share > 0, Value: share}
+}
+
+func allHealthy(checks map[string]HealthCheck) bool {
+	for _, check := range checks {
+		if !check.Healthy {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,95 @@
+package app_test
+
+import (
+	"errors"
+	"sync/atomic"
+
+	"github.com/Tapjoy/dynamiq/app"
+	"github.com/Tapjoy/dynamiq/app/backend"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// unreachableBackend fails every read of a config map or record, as a backend which can't be reached would
+type unreachableBackend struct {
+	backend.Backend
+}
+
+func (b unreachableBackend) FetchMap(key string) (*backend.Map, error) {
+	return nil, errors.New("connection refused")
+}
+
+func (b unreachableBackend) FetchRecord(name string) (*backend.Map, error) {
+	return nil, errors.New("connection refused")
+}
+
+// recordCountingBackend counts the reads and writes of records, such as leases
+type recordCountingBackend struct {
+	backend.Backend
+	calls *int32
+}
+
+func (b recordCountingBackend) FetchRecord(name string) (*backend.Map, error) {
+	atomic.AddInt32(b.calls, 1)
+	return b.Backend.FetchRecord(name)
+}
+
+func (b recordCountingBackend) UpdateRecordIf(name string, registers map[string]string, condition func(*backend.Map) bool) error {
+	atomic.AddInt32(b.calls, 1)
+	return b.Backend.UpdateRecordIf(name, registers, condition)
+}
+
+func (b recordCountingBackend) DeleteRecordIf(name string, condition func(*backend.Map) bool) error {
+	atomic.AddInt32(b.calls, 1)
+	return b.Backend.DeleteRecordIf(name, condition)
+}
+
+var _ = Describe("Health", func() {
+
+	Context("Checking health", func() {
+		It("should be healthy while it can reach the backend and keeps up with the cluster", func() {
+			healthy, checks := app.CheckHealth(cfg, memberList)
+			Expect(healthy).To(BeTrue())
+			Expect(checks["backend"].Healthy).To(BeTrue())
+			Expect(checks["memberlist"]).To(Equal(app.HealthCheck{Healthy: true, Value: 0}))
+		})
+
+		It("should be unhealthy when it can't reach the backend", func() {
+			unreachableCfg := *cfg
+			unreachableCfg.Backend = unreachableBackend{cfg.Backend}
+			healthy, checks := app.CheckHealth(&unreachableCfg, memberList)
+			Expect(healthy).To(BeFalse())
+			Expect(checks["backend"]).To(Equal(app.HealthCheck{Healthy: false, Error: "connection refused"}))
+		})
+	})
+
+	Context("Checking readiness", func() {
+		It("should report each check", func() {
+			_, checks := app.CheckReadiness(cfg, memberList)
+			Expect(checks).To(HaveKey("backend"))
+			Expect(checks).To(HaveKey("memberlist"))
+			Expect(checks["draining"]).To(Equal(app.HealthCheck{Healthy: true, Value: false}))
+			Expect(checks["keyspace"].Healthy).To(BeTrue())
+			Expect(checks["keyspace"].Value).To(BeNumerically("~", 1, 0.0001))
+		})
+
+		It("should read the leases it holds without renewing them", func() {
+			var calls int32
+			countingCfg := *cfg
+			countingCfg.Backend = recordCountingBackend{cfg.Backend, &calls}
+			held := app.NodePartitionLeases(cfg)
+
+			_, checks := app.CheckReadiness(&countingCfg, memberList)
+			Expect(checks["keyspace"].Healthy).To(BeTrue())
+			Expect(atomic.LoadInt32(&calls)).To(BeZero())
+			Expect(app.NodePartitionLeases(cfg)).To(ConsistOf(held))
+		})
+
+		It("should not be ready until the queues config has been synced", func() {
+			// The queues of the suite are never synced with the backend
+			ready, checks := app.CheckReadiness(cfg, memberList)
+			Expect(ready).To(BeFalse())
+			Expect(checks["queues_synced"]).To(Equal(app.HealthCheck{Healthy: false, Error: "never synced"}))
+		})
+	})
+})
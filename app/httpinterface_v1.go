@@ -6,33 +6,78 @@ package app
 
 import (
 	"bytes"
+	"encoding/json"
 	"fmt"
+	"io"
 	"net/http"
 	"strconv"
 	"strings"
 	"time"
 
 	"github.com/Sirupsen/logrus"
+	"github.com/Tapjoy/dynamiq/app/backend"
 	"github.com/go-martini/martini"
 	"github.com/hashicorp/memberlist"
 	"github.com/martini-contrib/binding"
 	"github.com/martini-contrib/render"
 )
 
-// TODO Should this live in the config package?
-// Using pointers lets us differentiate between a natural 0, and an int-default 0
-// omitempty tells it to ignore anything where the name was provided, but an empty value
-// inside of a request body.
-
-// ConfigRequest is
-type ConfigRequest struct {
-	VisibilityTimeout  *float64 `json:"visibility_timeout,omitempty"`
-	MinPartitions      *int     `json:"min_partitions,omitempty"`
-	MaxPartitions      *int     `json:"max_partitions,omitempty"`
-	MaxPartitionAge    *float64 `json:"max_partition_age,omitempty"`
-	CompressedMessages *bool    `json:"compressed_messages,omitempty"`
+// readSettings reads the queue settings from the JSON body of the request, in the form they are stored
+// in the queues config. Settings given as null are left alone, and an empty body holds no settings
+func readSettings(req *http.Request) (map[string]string, error) {
+	settings := make(map[string]string)
+	values := make(map[string]interface{})
+	err := json.NewDecoder(req.Body).Decode(&values)
+	if err == io.EOF {
+		return settings, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	for name, value := range values {
+		setting, known := LookupQueueSetting(name)
+		if !known {
+			return nil, &SettingError{Setting: name, Reason: "is not a known setting"}
+		}
+		if value == nil {
+			continue
+		}
+		settings[name], err = setting.Format(value)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return settings, nil
+}
+
+// VisibilityRequest is
+type VisibilityRequest struct {
+	Receipt           string   `json:"receipt"`
+	VisibilityTimeout *float64 `json:"visibility_timeout"`
+}
+
+// BatchVisibilityRequest is
+type BatchVisibilityRequest struct {
+	Messages []VisibilityChange `json:"messages"`
+}
+
+// BatchPublishRequest is
+type BatchPublishRequest struct {
+	Messages []PublishMessage `json:"messages"`
 }
 
+// AttributesHeader is the request header holding the JSON encoded attributes of a published message
+const AttributesHeader = "X-Dynamiq-Attributes"
+
+// DeduplicationIDHeader is the request header holding the deduplication id of a published message
+const DeduplicationIDHeader = "X-Dynamiq-Deduplication-Id"
+
+// MessageGroupIDHeader is the request header holding the message group of a message published to a fifo queue
+const MessageGroupIDHeader = "X-Dynamiq-Message-Group-Id"
+
+// PriorityHeader is the request header holding the priority of a published message
+const PriorityHeader = "X-Dynamiq-Priority"
+
 // TODO make message definitions more explicit
 
 func logrusLogger() martini.Handler {
@@ -99,16 +144,45 @@ func (h HTTPApiV1) InitWebserver(list *memberlist.Memberlist, cfg *Config) {
 		})
 
 		m.Get("/status/partitionrange", func(r render.Render, params martini.Params) {
-			bottom, top := GetNodePartitionRange(cfg, list)
-			r.JSON(200, map[string]interface{}{"bottom": strconv.Itoa(bottom), "top": strconv.Itoa(top)})
+			nodeRanges := GetNodeRanges(cfg, list)
+			if len(nodeRanges) == 0 {
+				r.JSON(200, map[string]interface{}{"bottom": "0", "top": "0", "ranges": nodeRanges})
+				return
+			}
+			// The bounds of the ranges, as the node used to own a single range
+			bottom, top := nodeRanges[0].Bottom, nodeRanges[len(nodeRanges)-1].Top
+			r.JSON(200, map[string]interface{}{"bottom": strconv.Itoa(bottom), "top": strconv.Itoa(top), "ranges": nodeRanges})
+		})
+
+		m.Get("/status/ownership", func(r render.Render) {
+			r.JSON(200, map[string]interface{}{"nodes": nodeRing(cfg, list).Ownership()})
+		})
+
+		m.Get("/status/topology", func(r render.Render) {
+			if cfg.Topology == nil {
+				r.JSON(404, map[string]interface{}{"error": "the members of the cluster aren't being followed"})
+				return
+			}
+			r.JSON(200, map[string]interface{}{"members": cfg.Topology.Members(), "changes": cfg.Topology.History()})
+		})
+
+		m.Get("/status/leases", func(r render.Render) {
+			r.JSON(200, map[string]interface{}{"leases": NodePartitionLeases(cfg)})
+		})
+
+		m.Get("/drain", func(r render.Render) {
+			r.JSON(200, map[string]interface{}{"drain": cfg.Drain.Status()})
+		})
+
+		m.Post("/drain", func(r render.Render) {
+			r.JSON(202, map[string]interface{}{"drain": cfg.Drain.Start()})
 		})
 		// END STATUS / STATISTICS API BLOCK
 
 		// CONFIGURATION API BLOCK
 
 		m.Delete("/topics/:topic", func(r render.Render, params martini.Params) {
-			var present bool
-			_, present = topics.TopicMap[params["topic"]]
+			_, present := topics.getTopic(params["topic"])
 			if present == true {
 				deleted := topics.DeleteTopic(cfg, params["topic"])
 				r.JSON(200, map[string]interface{}{"Deleted": deleted})
@@ -118,182 +192,221 @@ func (h HTTPApiV1) InitWebserver(list *memberlist.Memberlist, cfg *Config) {
 		})
 
 		m.Delete("/queues/:queue", func(r render.Render, params martini.Params) {
-			var present bool
-			_, present = queues.QueueMap[params["queue"]]
+			_, present := queues.getQueue(params["queue"])
 			if present == true {
-				queues.DeleteQueue(params["queue"], cfg)
+				status, err := queues.DeleteQueue(params["queue"], cfg)
+				if err == ErrDeletionInProgress {
+					r.JSON(409, map[string]interface{}{"error": err.Error(), "deletion": status})
+					return
+				}
+				if err != nil {
+					logrus.Error(err)
+					r.JSON(500, map[string]interface{}{"error": err.Error()})
+					return
+				}
 				deleted := true
-				r.JSON(200, map[string]interface{}{"Deleted": deleted})
+				r.JSON(200, map[string]interface{}{"Deleted": deleted, "deletion": status})
 			} else {
 				r.JSON(404, map[string]interface{}{"error": "Queue did not exist."})
 			}
 		})
 
-		m.Put("/queues/:queue", func(r render.Render, params martini.Params) {
-			var present bool
-			_, present = queues.QueueMap[params["queue"]]
-			if present != true {
-				cfg.InitializeQueue(params["queue"])
+		m.Get("/queues/:queue/deletion", func(r render.Render, params martini.Params) {
+			status, found, err := queues.DeletionStatus(cfg, params["queue"])
+			if err != nil {
+				logrus.Error(err)
+				r.JSON(500, map[string]interface{}{"error": err.Error()})
+				return
+			}
+			if !found {
+				r.JSON(404, map[string]interface{}{"error": fmt.Sprintf("Queue %s has never been deleted", params["queue"])})
+				return
+			}
+			r.JSON(200, map[string]interface{}{"deletion": status})
+		})
+
+		m.Put("/queues/:queue", func(r render.Render, params martini.Params, req *http.Request) {
+			settings, err := readSettings(req)
+			if err != nil {
+				r.JSON(422, map[string]interface{}{"error": err.Error()})
+				return
+			}
+			created, err := cfg.InitializeQueueWithSettings(params["queue"], settings)
+			if err == ErrQueueExists {
+				r.JSON(422, map[string]interface{}{"error": "Queue already exists."})
+				return
+			}
+			if InvalidSetting(err) {
+				r.JSON(422, map[string]interface{}{"error": err.Error()})
+				return
+			}
+			if err != nil {
+				logrus.Error(err)
+				r.JSON(500, map[string]interface{}{"error": err.Error()})
+				return
+			}
+			if created {
 				r.JSON(201, "created")
 			} else {
-				r.JSON(422, map[string]interface{}{"error": "Queue already exists."})
+				// Creating it again with the same settings is fine
+				r.JSON(200, "exists")
 			}
 		})
 
 		m.Put("/topics/:topic", func(r render.Render, params martini.Params) {
-			var present bool
-			_, present = topics.TopicMap[params["topic"]]
+			topic, present := topics.getTopic(params["topic"])
 			if present != true {
-				topics.InitTopic(params["topic"])
-				r.JSON(201, map[string]interface{}{"Queues": topics.TopicMap[params["topic"]].ListQueues()})
+				topics.CreateTopic(cfg, params["topic"])
+				topic, _ = topics.getTopic(params["topic"])
+				r.JSON(201, map[string]interface{}{"Queues": topic.ListQueues()})
 			} else {
 				r.JSON(422, map[string]interface{}{"error": "Topic already exists."})
 			}
 		})
 
 		m.Put("/topics/:topic/queues/:queue", func(r render.Render, params martini.Params) {
-			var present bool
-			_, present = topics.TopicMap[params["topic"]]
+			topic, present := topics.getTopic(params["topic"])
 			if present != true {
 				r.JSON(422, map[string]interface{}{"error": "Topic does not exist. Please create it first."})
 			} else {
-				_, present = queues.QueueMap[params["queue"]]
+				_, present = queues.getQueue(params["queue"])
 				if present != true {
 					r.JSON(422, map[string]interface{}{"error": "Queue does not exist. Please create it first"})
 				} else {
-					topics.TopicMap[params["topic"]].AddQueue(cfg, params["queue"])
-					r.JSON(200, map[string]interface{}{"Queues": topics.TopicMap[params["topic"]].ListQueues()})
+					topic.AddQueue(cfg, params["queue"])
+					r.JSON(200, map[string]interface{}{"Queues": topic.ListQueues()})
 				}
 			}
 		})
 
 		// neeeds a little work....
 		m.Delete("/topics/:topic/queues/:queue", func(r render.Render, params martini.Params) {
-			var present bool
-			_, present = topics.TopicMap[params["topic"]]
+			topic, present := topics.getTopic(params["topic"])
 			if present != true {
-				topics.InitTopic(params["topic"])
+				topics.CreateTopic(cfg, params["topic"])
+				topic, _ = topics.getTopic(params["topic"])
 			}
-			topics.TopicMap[params["topic"]].DeleteQueue(cfg, params["queue"])
-			r.JSON(200, map[string]interface{}{"Queues": topics.TopicMap[params["topic"]].ListQueues()})
+			topic.DeleteQueue(cfg, params["queue"])
+			r.JSON(200, map[string]interface{}{"Queues": topic.ListQueues()})
 		})
 
-		m.Patch("/queues/:queue", binding.Json(ConfigRequest{}), func(configRequest ConfigRequest, r render.Render, params martini.Params) {
-			// Not sure of better way to get the queue name from the request, but would be good to not
-			// Have to reach into params - better to bind it
-
-			// There is probably an optimal order to set these in, depending on if the values for min/max
-			// have shrunk or grown, so the system can self-adjust in the correct fashion. Or, maybe it's fine to do it however
-
-			// Should we detect and throw errors on incorrect configuration names? Would make debugging simpler
-
-			// Likely all of this belongs in config, where we just pass in an interface to the request object, and it
-			// returns the first error it runs across. Would simplify the code here greatly.
-			var err error
-			if configRequest.VisibilityTimeout != nil {
-				err = cfg.SetVisibilityTimeout(params["queue"], *configRequest.VisibilityTimeout)
-				// We really need a proper way to generalize error handling
-				// Writing this out every time is going to be silly
-				if err != nil {
-					logrus.Println(err)
-					r.JSON(500, map[string]interface{}{"error": err.Error()})
-					return
-				}
+		m.Patch("/queues/:queue", func(r render.Render, params martini.Params, req *http.Request) {
+			settings, err := readSettings(req)
+			if err != nil {
+				r.JSON(422, map[string]interface{}{"error": err.Error()})
+				return
 			}
-
-			if configRequest.MinPartitions != nil {
-				err = cfg.SetMinPartitions(params["queue"], *configRequest.MinPartitions)
-				if err != nil {
-					logrus.Println(err)
-					r.JSON(500, map[string]interface{}{"error": err.Error()})
-					return
-				}
+			// Every setting is validated, against each other and the rest of the queues settings, before any are stored
+			err = cfg.SetQueueSettings(params["queue"], settings)
+			if InvalidSetting(err) {
+				r.JSON(422, map[string]interface{}{"error": err.Error()})
+				return
 			}
-
-			if configRequest.MinPartitions != nil {
-				err = cfg.SetMinPartitions(params["queue"], *configRequest.MinPartitions)
-				if err != nil {
-					logrus.Println(err)
-					r.JSON(500, map[string]interface{}{"error": err.Error()})
-					return
-				}
+			if err == backend.ErrNotFound {
+				r.JSON(404, map[string]interface{}{"error": fmt.Sprintf("There is no queue named %s", params["queue"])})
+				return
 			}
-			if configRequest.MaxPartitionAge != nil {
-				err = cfg.SetMaxPartitionAge(params["queue"], *configRequest.MaxPartitionAge)
-				if err != nil {
-					logrus.Println(err)
-					r.JSON(500, map[string]interface{}{"error": err.Error()})
-					return
-				}
+			if err != nil {
+				logrus.Println(err)
+				r.JSON(500, map[string]interface{}{"error": err.Error()})
+				return
 			}
-
-			if configRequest.CompressedMessages != nil {
-				err = cfg.SetCompressedMessages(params["queue"], *configRequest.CompressedMessages)
-				if err != nil {
-					logrus.Println(err)
-					r.JSON(500, map[string]interface{}{"error": err.Error()})
-					return
-				}
-			}
-
 			r.JSON(200, "ok")
 		})
 
+		m.Get("/settings", func(r render.Render) {
+			r.JSON(200, map[string]interface{}{"settings": QueueSettings})
+		})
+
 		// END CONFIGURATION API BLOCK
 
 		// DATA INTERACTION API BLOCK
 
 		m.Get("/topics", func(r render.Render) {
 			topicList := make([]string, 0, 10)
-			for topicName := range topics.TopicMap {
-				topicList = append(topicList, topicName)
+			for _, topic := range topics.topicList() {
+				topicList = append(topicList, topic.Name)
 			}
 			r.JSON(200, map[string]interface{}{"topics": topicList})
 		})
 
 		m.Get("/topics/:topic", func(r render.Render, params martini.Params) {
-			var present bool
-			_, present = topics.TopicMap[params["topic"]]
+			topic, present := topics.getTopic(params["topic"])
 			if present != true {
-				topics.InitTopic(params["topic"])
+				topics.CreateTopic(cfg, params["topic"])
+				topic, _ = topics.getTopic(params["topic"])
 			}
 
-			r.JSON(200, map[string]interface{}{"Queues": topics.TopicMap[params["topic"]].ListQueues()})
+			r.JSON(200, map[string]interface{}{"Queues": topic.ListQueues()})
 		})
 
 		m.Put("/topics/:topic/message", func(r render.Render, params martini.Params, req *http.Request) {
-			var present bool
-			_, present = topics.TopicMap[params["topic"]]
+			topic, present := topics.getTopic(params["topic"])
+			if present != true {
+				topics.CreateTopic(cfg, params["topic"])
+				topic, _ = topics.getTopic(params["topic"])
+			}
+			message, err := readPublishMessage(req)
+			if err != nil {
+				r.JSON(422, map[string]interface{}{"error": err.Error()})
+				return
+			}
+
+			response := topic.Publish(cfg, message)
+			r.JSON(200, response)
+		})
+
+		m.Put("/topics/:topic/messages", binding.Json(BatchPublishRequest{}), func(publishRequest BatchPublishRequest, errs binding.Errors, r render.Render, params martini.Params, req *http.Request) {
+			topic, present := topics.getTopic(params["topic"])
 			if present != true {
-				topics.InitTopic(params["topic"])
+				topics.CreateTopic(cfg, params["topic"])
+				topic, _ = topics.getTopic(params["topic"])
+			}
+			if errs.Len() > 0 {
+				r.JSON(400, map[string]interface{}{"error": errs[0].Error()})
+				return
+			}
+			err := applyBatchDelay(publishRequest.Messages, req)
+			if err != nil {
+				r.JSON(422, map[string]interface{}{"error": err.Error()})
+				return
+			}
+			if len(publishRequest.Messages) == 0 || len(publishRequest.Messages) > MaxPublishBatchSize {
+				r.JSON(422, map[string]interface{}{"error": fmt.Sprintf("Batches must hold from 1 to %d messages", MaxPublishBatchSize)})
+				return
 			}
-			var buf bytes.Buffer
-			buf.ReadFrom(req.Body)
 
-			response := topics.TopicMap[params["topic"]].Broadcast(cfg, buf.String())
+			response := topic.BatchBroadcast(cfg, publishRequest.Messages)
 			r.JSON(200, response)
 		})
 
 		m.Get("/queues", func(r render.Render, params martini.Params) {
 			queueList := make([]string, 0, 10)
-			for queueName := range queues.QueueMap {
-				queueList = append(queueList, queueName)
+			for _, queue := range queues.queueList() {
+				queueList = append(queueList, queue.Name)
 			}
 			r.JSON(200, map[string]interface{}{"queues": queueList})
 		})
 
 		m.Get("/queues/:queue", func(r render.Render, params martini.Params) {
 			//check if we've initialized this queue yet
-			var present bool
-			_, present = queues.QueueMap[params["queue"]]
+			queue, present := queues.getQueue(params["queue"])
 			if present == true {
 				queueReturn := make(map[string]interface{})
 				queueReturn["VisibilityTimeout"], _ = cfg.GetVisibilityTimeout(params["queue"])
 				queueReturn["MinPartitions"], _ = cfg.GetMinPartitions(params["queue"])
-				queueReturn["MaxPartitions"], _ = cfg.GetMinPartitions(params["queue"])
+				queueReturn["MaxPartitions"], _ = cfg.GetMaxPartitions(params["queue"])
 				queueReturn["MaxPartitionAge"], _ = cfg.GetMaxPartitionAge(params["queue"])
 				queueReturn["CompressedMessages"], _ = cfg.GetCompressedMessages(params["queue"])
-				queueReturn["partitions"] = queues.QueueMap[params["queue"]].Parts.PartitionCount()
+				queueReturn["MaxReceiveCount"], _ = cfg.GetMaxReceiveCount(params["queue"])
+				queueReturn["DeadLetterQueue"], _ = cfg.GetDeadLetterQueue(params["queue"])
+				queueReturn["DelaySeconds"], _ = cfg.GetDelaySeconds(params["queue"])
+				queueReturn["MessageRetentionPeriod"], _ = cfg.GetMessageRetentionPeriod(params["queue"])
+				queueReturn["WaitTimeSeconds"], _ = cfg.GetWaitTimeSeconds(params["queue"])
+				queueReturn["DeduplicationWindow"], _ = cfg.GetDeduplicationWindow(params["queue"])
+				queueReturn["ContentBasedDeduplication"], _ = cfg.GetContentBasedDeduplication(params["queue"])
+				queueReturn["Fifo"], _ = cfg.GetFifo(params["queue"])
+				queueReturn["partitions"] = queue.Parts.PartitionCount()
 				r.JSON(200, queueReturn)
 			} else {
 				r.JSON(404, fmt.Sprintf("There is no queue named %s", params["queue"]))
@@ -301,11 +414,15 @@ func (h HTTPApiV1) InitWebserver(list *memberlist.Memberlist, cfg *Config) {
 		})
 
 		m.Get("/queues/:queue/message/:messageId", func(r render.Render, params martini.Params) {
-			queue := queues.QueueMap[params["queue"]]
+			queue, _ := queues.getQueue(params["queue"])
 			if queue != nil {
 				messages := queue.RetrieveMessages(strings.Fields(params["messageId"]), cfg)
 				if (len(messages)) > 0 {
-					r.JSON(200, map[string]interface{}{"messages": messages})
+					messageList := make([]map[string]interface{}, 0, len(messages))
+					for _, object := range messages {
+						messageList = append(messageList, formatMessage(object))
+					}
+					r.JSON(200, map[string]interface{}{"messages": messageList})
 				} else {
 					r.JSON(404, map[string]interface{}{"error": fmt.Sprintf("Messages with id: %s not found.", params["message"])})
 				}
@@ -314,21 +431,31 @@ func (h HTTPApiV1) InitWebserver(list *memberlist.Memberlist, cfg *Config) {
 			}
 		})
 
-		m.Get("/queues/:queue/messages/:batchSize", func(r render.Render, params martini.Params) {
+		m.Get("/queues/:queue/messages/:batchSize", func(r render.Render, params martini.Params, req *http.Request) {
 			//check if we've initialized this queue yet
-			var present bool
-			_, present = queues.QueueMap[params["queue"]]
+			queue, present := queues.getQueue(params["queue"])
 			if present == true {
 				batchSize, err := strconv.ParseInt(params["batchSize"], 10, 64)
 				if err != nil {
 					//log the error for unparsable input
 					logrus.Error(err)
 					r.JSON(422, err.Error())
+					return
 				}
 				if batchSize <= 0 {
 					r.JSON(422, fmt.Sprint("Batchsizes must be non-negative integers greater than 0"))
+					return
+				}
+				wait, err := parseWaitTimeSeconds(cfg, params["queue"], req)
+				if err != nil {
+					r.JSON(422, err.Error())
+					return
+				}
+				messages, err := queue.GetWithWait(cfg, list, batchSize, wait)
+				if err == ErrDraining {
+					r.JSON(503, map[string]interface{}{"error": err.Error()})
+					return
 				}
-				messages, err := queues.QueueMap[params["queue"]].Get(cfg, list, batchSize)
 
 				if err != nil && err.Error() != NoPartitions {
 					// We're choosing to ignore nopartitions issues for now and treat them as normal 200s
@@ -340,10 +467,7 @@ func (h HTTPApiV1) InitWebserver(list *memberlist.Memberlist, cfg *Config) {
 				messageList := make([]map[string]interface{}, 0, 10)
 				//Format response
 				for _, object := range messages {
-					message := make(map[string]interface{})
-					message["id"] = object.Key
-					message["body"] = string(object.Data[:])
-					messageList = append(messageList, message)
+					messageList = append(messageList, formatMessage(object))
 				}
 				if err != nil && err.Error() != NoPartitions {
 					logrus.Error(err)
@@ -357,45 +481,324 @@ func (h HTTPApiV1) InitWebserver(list *memberlist.Memberlist, cfg *Config) {
 			}
 		})
 
-		m.Put("/queues/:queue/message", func(params martini.Params, req *http.Request) string {
-			var present bool
-			_, present = queues.QueueMap[params["queue"]]
+		m.Put("/queues/:queue/message", func(params martini.Params, req *http.Request) (int, string) {
+			queue, present := queues.getQueue(params["queue"])
 			if present == true {
-				// parse the request body into a sting
 				// TODO clean this up, full json api?
-				var buf bytes.Buffer
-				buf.ReadFrom(req.Body)
-				uuid := queues.QueueMap[params["queue"]].Put(cfg, buf.String())
+				message, err := readPublishMessage(req)
+				if err != nil {
+					return 422, err.Error()
+				}
+				uuid, err := queue.Publish(cfg, message)
+				if err == ErrMissingMessageGroup {
+					return 422, err.Error()
+				}
+				if err != nil {
+					//Actually want to handle this in some other way
+					logrus.Error(err)
+				}
 
-				return uuid
+				return 200, uuid
 			}
 			// V2 TODO - proper response code
-			return ""
+			return 200, ""
 		})
 
-		m.Delete("/queues/:queue/message/:messageId", func(r render.Render, params martini.Params) {
-			var present bool
-			_, present = queues.QueueMap[params["queue"]]
+		m.Put("/queues/:queue/messages", binding.Json(BatchPublishRequest{}), func(publishRequest BatchPublishRequest, errs binding.Errors, r render.Render, params martini.Params, req *http.Request) {
+			queue, present := queues.getQueue(params["queue"])
+			if present != true {
+				r.JSON(404, map[string]interface{}{"error": fmt.Sprintf("There is no queue named %s", params["queue"])})
+				return
+			}
+			if errs.Len() > 0 {
+				r.JSON(400, map[string]interface{}{"error": errs[0].Error()})
+				return
+			}
+			err := applyBatchDelay(publishRequest.Messages, req)
+			if err != nil {
+				r.JSON(422, map[string]interface{}{"error": err.Error()})
+				return
+			}
+			if len(publishRequest.Messages) == 0 || len(publishRequest.Messages) > MaxPublishBatchSize {
+				r.JSON(422, map[string]interface{}{"error": fmt.Sprintf("Batches must hold from 1 to %d messages", MaxPublishBatchSize)})
+				return
+			}
+
+			results := queue.BatchPut(cfg, publishRequest.Messages)
+			r.JSON(200, map[string]interface{}{"messages": results})
+		})
+
+		m.Delete("/queues/:queue/message/:messageId", func(r render.Render, params martini.Params, req *http.Request) {
+			queue, present := queues.getQueue(params["queue"])
 			if present != true {
 				cfg.InitializeQueue(params["queue"])
+				queue, _ = queues.getQueue(params["queue"])
+			}
+
+			// Only delete if the receipt from the clients receive is still current
+			deleted, err := queue.Delete(cfg, params["messageId"], req.URL.Query().Get("receipt"))
+			switch err {
+			case nil:
+				r.JSON(200, deleted)
+			case ErrMissingReceipt:
+				r.JSON(422, map[string]interface{}{"error": err.Error()})
+			case ErrInvalidReceipt:
+				r.JSON(409, map[string]interface{}{"error": err.Error()})
+			default:
+				r.JSON(500, map[string]interface{}{"error": err.Error()})
+			}
+		})
+
+		m.Patch("/queues/:queue/message/:messageId/visibility", binding.Json(VisibilityRequest{}), func(visibilityRequest VisibilityRequest, errs binding.Errors, r render.Render, params martini.Params) {
+			queue, present := queues.getQueue(params["queue"])
+			if present != true {
+				r.JSON(404, map[string]interface{}{"error": fmt.Sprintf("There is no queue named %s", params["queue"])})
+				return
+			}
+			if errs.Len() > 0 {
+				r.JSON(400, map[string]interface{}{"error": errs[0].Error()})
+				return
+			}
+			if visibilityRequest.VisibilityTimeout == nil {
+				r.JSON(422, map[string]interface{}{"error": "visibility_timeout is required"})
+				return
+			}
+			err := queue.ChangeVisibility(cfg, params["messageId"], visibilityRequest.Receipt, *visibilityRequest.VisibilityTimeout)
+			if err != nil {
+				r.JSON(visibilityErrorStatus(err), map[string]interface{}{"error": err.Error()})
+				return
+			}
+			r.JSON(200, "ok")
+		})
+
+		m.Patch("/queues/:queue/messages/visibility", binding.Json(BatchVisibilityRequest{}), func(batchRequest BatchVisibilityRequest, errs binding.Errors, r render.Render, params martini.Params) {
+			queue, present := queues.getQueue(params["queue"])
+			if present != true {
+				r.JSON(404, map[string]interface{}{"error": fmt.Sprintf("There is no queue named %s", params["queue"])})
+				return
+			}
+			if errs.Len() > 0 {
+				r.JSON(400, map[string]interface{}{"error": errs[0].Error()})
+				return
+			}
+			errors := queue.BatchChangeVisibility(cfg, batchRequest.Messages)
+			failed := make(map[string]string)
+			for id, err := range errors {
+				failed[id] = err.Error()
+			}
+			r.JSON(200, map[string]interface{}{"changed": len(batchRequest.Messages) - len(errors), "errors": failed})
+		})
+
+		m.Post("/queues/:queue/redrive", func(r render.Render, params martini.Params) {
+			queue, present := queues.getQueue(params["queue"])
+			if present != true {
+				r.JSON(404, map[string]interface{}{"error": fmt.Sprintf("There is no queue named %s", params["queue"])})
+				return
+			}
+			redriven, err := queue.Redrive(cfg)
+			if err != nil {
+				logrus.Error(err)
+				r.JSON(500, map[string]interface{}{"error": err.Error(), "redriven": redriven})
+				return
+			}
+			r.JSON(200, map[string]interface{}{"redriven": redriven})
+		})
+
+		m.Post("/queues/:queue/purge", func(r render.Render, params martini.Params) {
+			queue, present := queues.getQueue(params["queue"])
+			if present != true {
+				r.JSON(404, map[string]interface{}{"error": fmt.Sprintf("There is no queue named %s", params["queue"])})
+				return
 			}
+			status, err := queue.Purge(cfg)
+			if err == ErrPurgeInProgress {
+				r.JSON(409, map[string]interface{}{"error": err.Error(), "purge": status})
+				return
+			}
+			if err != nil {
+				logrus.Error(err)
+				r.JSON(500, map[string]interface{}{"error": err.Error()})
+				return
+			}
+			r.JSON(202, map[string]interface{}{"purge": status})
+		})
 
-			r.JSON(200, queues.QueueMap[params["queue"]].Delete(cfg, params["messageId"]))
+		m.Get("/queues/:queue/purge", func(r render.Render, params martini.Params) {
+			queue, present := queues.getQueue(params["queue"])
+			if present != true {
+				r.JSON(404, map[string]interface{}{"error": fmt.Sprintf("There is no queue named %s", params["queue"])})
+				return
+			}
+			status, found, err := queue.PurgeStatus(cfg)
+			if err != nil {
+				logrus.Error(err)
+				r.JSON(500, map[string]interface{}{"error": err.Error()})
+				return
+			}
+			if !found {
+				r.JSON(404, map[string]interface{}{"error": fmt.Sprintf("Queue %s has never been purged", params["queue"])})
+				return
+			}
+			r.JSON(200, map[string]interface{}{"purge": status})
 		})
 
-		m.Delete("/queues/:queue/messages/:messageIds", func(r render.Render, params martini.Params) {
-			var present bool
-			_, present = queues.QueueMap[params["queue"]]
+		m.Delete("/queues/:queue/messages/:messageIds", func(r render.Render, params martini.Params, req *http.Request) {
+			queue, present := queues.getQueue(params["queue"])
 			if present != true {
 				r.JSON(404, map[string]interface{}{"error": fmt.Sprintf("There is no queue named %s", params["queue"])})
 			} else {
 				ids := strings.Split(params["messageIds"], ",")
+				// One receipt per id, in the same order
+				receipts := strings.Split(req.URL.Query().Get("receipts"), ",")
+				if len(receipts) != len(ids) {
+					r.JSON(422, map[string]interface{}{"error": ErrMissingReceipt.Error()})
+					return
+				}
 				// The error returned here is already logged during the call
-				errorCount, _ := queues.QueueMap[params["queue"]].BatchDelete(cfg, ids)
+				errorCount, _ := queue.BatchDelete(cfg, ids, receipts)
 				r.JSON(200, map[string]interface{}{"deleted": len(ids) - errorCount})
 			}
 		})
 		// DATA INTERACTION API BLOCK
 	})
-	logrus.Fatal(http.ListenAndServe(":"+strconv.Itoa(cfg.Core.HTTPPort), m))
+	// Unversioned, for load balancers and orchestrators
+	m.Get("/health", func(r render.Render) {
+		healthy, checks := CheckHealth(cfg, list)
+		status := 200
+		if !healthy {
+			status = 503
+		}
+		r.JSON(status, map[string]interface{}{"healthy": healthy, "checks": checks})
+	})
+
+	m.Get("/ready", func(r render.Render) {
+		ready, checks := CheckReadiness(cfg, list)
+		status := 200
+		if !ready {
+			status = 503
+		}
+		r.JSON(status, map[string]interface{}{"ready": ready, "checks": checks})
+	})
+
+	server := &http.Server{Addr: ":" + strconv.Itoa(cfg.Core.HTTPPort), Handler: m}
+	go cfg.Drain.ShutdownOnSignal(server)
+	err := server.ListenAndServe()
+	if err != http.ErrServerClosed {
+		logrus.Fatal(err)
+	}
+	// The server stops listening as soon as the shutdown starts, so wait on the rest of it
+	cfg.Drain.Wait()
+}
+
+// readPublishMessage builds the message to publish from the request body, its Content-Type header,
+// the attributes, deduplication, message group and priority headers, and the delay_seconds query param
+func readPublishMessage(req *http.Request) (PublishMessage, error) {
+	delay, delayed, err := parseDelaySeconds(req)
+	if err != nil {
+		return PublishMessage{}, err
+	}
+	// parse the request body into a sting
+	var buf bytes.Buffer
+	buf.ReadFrom(req.Body)
+	message := PublishMessage{
+		Body:            buf.String(),
+		ContentType:     req.Header.Get("Content-Type"),
+		DeduplicationID: req.Header.Get(DeduplicationIDHeader),
+		MessageGroupID:  req.Header.Get(MessageGroupIDHeader),
+	}
+	if delayed {
+		message.DelaySeconds = &delay
+	}
+	if header := req.Header.Get(AttributesHeader); header != "" {
+		err = json.Unmarshal([]byte(header), &message.Attributes)
+		if err != nil {
+			return message, ErrInvalidAttribute
+		}
+	}
+	if header := req.Header.Get(PriorityHeader); header != "" {
+		priority, err := strconv.Atoi(header)
+		if err != nil {
+			return message, ErrInvalidPriority
+		}
+		message.Priority = &priority
+	}
+	return message, message.Validate()
+}
+
+// applyBatchDelay gives the delay_seconds query param, if provided, to every message in the batch without its own
+func applyBatchDelay(messages []PublishMessage, req *http.Request) error {
+	delay, delayed, err := parseDelaySeconds(req)
+	if err != nil || !delayed {
+		return err
+	}
+	for i := range messages {
+		if messages[i].DelaySeconds == nil {
+			messages[i].DelaySeconds = &delay
+		}
+	}
+	return nil
+}
+
+// formatMessage converts a message into its representation in the API
+func formatMessage(object backend.Message) map[string]interface{} {
+	message := make(map[string]interface{})
+	message["id"] = object.Key
+	message["body"] = string(object.Data[:])
+	message["content_type"] = object.ContentType
+	message["attributes"] = MessageAttributes(&object)
+	message["receipt"] = MessageReceipt(&object)
+	message["receive_count"] = MessageReceiveCount(&object)
+	if group := MessageGroup(&object); group != "" {
+		message["message_group_id"] = group
+	} else {
+		message["priority"] = MessagePriority(&object)
+	}
+	return message
+}
+
+// parseDelaySeconds reads the optional delay_seconds query param, returning false if it wasn't provided
+func parseDelaySeconds(req *http.Request) (float64, bool, error) {
+	param := req.URL.Query().Get("delay_seconds")
+	if param == "" {
+		return 0, false, nil
+	}
+	delay, err := strconv.ParseFloat(param, 64)
+	if err != nil {
+		return 0, false, err
+	}
+	if delay < 0 {
+		return 0, false, ErrInvalidDelay
+	}
+	return delay, true, nil
+}
+
+// parseWaitTimeSeconds reads the optional wait_time_seconds query param, falling back to the queues setting
+func parseWaitTimeSeconds(cfg *Config, queueName string, req *http.Request) (time.Duration, error) {
+	param := req.URL.Query().Get("wait_time_seconds")
+	if param == "" {
+		wait, _ := cfg.GetWaitTimeSeconds(queueName)
+		return time.Duration(wait * float64(time.Second)), nil
+	}
+	wait, err := strconv.ParseFloat(param, 64)
+	if err != nil {
+		return 0, err
+	}
+	if wait < 0 || wait > MaxWaitTimeSeconds {
+		return 0, ErrInvalidWaitTime
+	}
+	return time.Duration(wait * float64(time.Second)), nil
+}
+
+// visibilityErrorStatus maps the errors from changing message visibility onto response codes
+func visibilityErrorStatus(err error) int {
+	switch err {
+	case backend.ErrNotFound:
+		return 404
+	case ErrInvalidReceipt, ErrMessageNotInFlight:
+		return 409
+	case ErrInvalidVisibilityTimeout:
+		return 422
+	default:
+		return 500
+	}
 }
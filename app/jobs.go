@@ -0,0 +1,196 @@
+package app
+
+import (
+	"math"
+	"strconv"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/Tapjoy/dynamiq/app/backend"
+)
+
+// JobBatchSize is the number of messages read at a time by a background job sweeping a queue
+const JobBatchSize = 100
+
+// JobHeartbeatTimeout is how long a running job can go without recording progress before it is
+// considered abandoned, such as by the node running it going away, and it may be started again
+const JobHeartbeatTimeout = 60 * time.Second
+
+// JobRunning is the status of a background job still deleting messages
+const JobRunning = "running"
+
+// JobComplete is the status of a background job which finished
+const JobComplete = "complete"
+
+// JobFailed is the status of a background job which stopped on an error
+const JobFailed = "failed"
+
+// The registers on a job record
+const (
+	jobStatus     = "status"
+	jobDeleted    = "deleted"
+	jobStartedAt  = "started_at"
+	jobUpdatedAt  = "updated_at"
+	jobFinishedAt = "finished_at"
+	jobError      = "error"
+)
+
+// JobStatus is the progress of a background job over the messages of a queue, such as a purge. It
+// is kept in the backend, so it can be followed from any node
+type JobStatus struct {
+	Status     string     `json:"status"`
+	Deleted    int        `json:"deleted"`
+	StartedAt  time.Time  `json:"started_at"`
+	FinishedAt *time.Time `json:"finished_at,omitempty"`
+	Error      string     `json:"error,omitempty"`
+	updatedAt  time.Time
+}
+
+// running returns true if the job is running, and has recorded progress recently enough that it isn't abandoned
+func (status JobStatus) running(now time.Time) bool {
+	return status.Status == JobRunning && now.Sub(status.updatedAt) < JobHeartbeatTimeout
+}
+
+// fetchJob returns the status of the job stored in the record, or false if there is none
+func fetchJob(cfg *Config, recordName string) (JobStatus, bool, error) {
+	record, err := cfg.Backend.FetchMap(recordName)
+	if err == backend.ErrNotFound {
+		return JobStatus{}, false, nil
+	}
+	if err != nil {
+		return JobStatus{}, false, err
+	}
+	status := JobStatus{}
+	status.Status, _ = record.FetchRegister(jobStatus)
+	if status.Status == "" {
+		return JobStatus{}, false, nil
+	}
+	deleted, _ := record.FetchRegister(jobDeleted)
+	status.Deleted, _ = strconv.Atoi(deleted)
+	status.StartedAt = jobTime(record, jobStartedAt)
+	status.updatedAt = jobTime(record, jobUpdatedAt)
+	if finishedAt := jobTime(record, jobFinishedAt); !finishedAt.IsZero() {
+		status.FinishedAt = &finishedAt
+	}
+	status.Error, _ = record.FetchRegister(jobError)
+	return status, true, nil
+}
+
+// startJob records a new running job in the record, unless one is already running, in which case
+// its status is returned along with inProgress. If inProgress is nil, the new job replaces the running
+// one, which stops recording its progress. Two nodes starting a job at the same moment may both
+// succeed, which is harmless for jobs which only delete
+func startJob(cfg *Config, recordName string, inProgress error) (JobStatus, error) {
+	current, found, err := fetchJob(cfg, recordName)
+	if err != nil {
+		return JobStatus{}, err
+	}
+	now := time.Now()
+	if found && current.running(now) && inProgress != nil {
+		return current, inProgress
+	}
+	startedAt := strconv.FormatInt(now.UnixNano(), 10)
+	err = cfg.Backend.UpdateRegisters(recordName, map[string]string{
+		jobStatus:     JobRunning,
+		jobDeleted:    "0",
+		jobStartedAt:  startedAt,
+		jobUpdatedAt:  startedAt,
+		jobFinishedAt: "",
+		jobError:      "",
+	})
+	if err != nil {
+		return JobStatus{}, err
+	}
+	// Read back as it was stored, so it can be matched against the record later
+	return JobStatus{Status: JobRunning, StartedAt: time.Unix(0, now.UnixNano()), updatedAt: now}, nil
+}
+
+// currentJob returns true if the record still belongs to the job started at startedAt
+func currentJob(cfg *Config, recordName string, startedAt time.Time) bool {
+	status, found, err := fetchJob(cfg, recordName)
+	if err != nil {
+		logrus.Error(err)
+		return false
+	}
+	return found && status.StartedAt.Equal(startedAt)
+}
+
+func recordJobProgress(cfg *Config, recordName string, startedAt time.Time, deleted int) {
+	if !currentJob(cfg, recordName, startedAt) {
+		return
+	}
+	err := cfg.Backend.UpdateRegisters(recordName, map[string]string{
+		jobDeleted:   strconv.Itoa(deleted),
+		jobUpdatedAt: strconv.FormatInt(time.Now().UnixNano(), 10),
+	})
+	if err != nil {
+		logrus.Error(err)
+	}
+}
+
+func finishJob(cfg *Config, recordName string, startedAt time.Time, deleted int, jobErr error) {
+	if !currentJob(cfg, recordName, startedAt) {
+		return
+	}
+	now := strconv.FormatInt(time.Now().UnixNano(), 10)
+	registers := map[string]string{
+		jobStatus:     JobComplete,
+		jobDeleted:    strconv.Itoa(deleted),
+		jobUpdatedAt:  now,
+		jobFinishedAt: now,
+	}
+	if jobErr != nil {
+		registers[jobStatus] = JobFailed
+		registers[jobError] = jobErr.Error()
+	}
+	err := cfg.Backend.UpdateRegisters(recordName, registers)
+	if err != nil {
+		logrus.Error(err)
+	}
+}
+
+// deleteMessagesBefore deletes every message in the queue put before startedAt, recording progress
+// in the job record after each page. deleted is called with the number of messages deleted from each page
+func (queue *Queue) deleteMessagesBefore(cfg *Config, startedAt time.Time, recordName string, deleted func(int)) (int, error) {
+	total := 0
+	continuation := ""
+	for {
+		ids, next, err := cfg.Backend.RangeScan(queue.Name, 0, math.MaxInt64, JobBatchSize, continuation)
+		if err != nil {
+			return total, err
+		}
+		count := 0
+		for _, message := range queue.fetchMessages(cfg, ids) {
+			if message.Data == nil && message.Meta == nil {
+				// Already gone
+				continue
+			}
+			// Messages from before enqueue times were recorded were certainly put before the job
+			if enqueuedAt, ok := messageEnqueuedAt(&message); ok && !enqueuedAt.Before(startedAt) {
+				continue
+			}
+			err = cfg.Backend.DeleteMessage(queue.Name, message.Key)
+			if err != nil {
+				logrus.Error(err)
+				continue
+			}
+			count++
+		}
+		total += count
+		deleted(count)
+		if next == "" {
+			return total, nil
+		}
+		continuation = next
+		recordJobProgress(cfg, recordName, startedAt, total)
+	}
+}
+
+func jobTime(record *backend.Map, register string) time.Time {
+	value, _ := record.FetchRegister(register)
+	nanos, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return time.Time{}
+	}
+	return time.Unix(0, nanos)
+}
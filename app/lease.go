@@ -0,0 +1,462 @@
+package app
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/Tapjoy/dynamiq/app/backend"
+	"github.com/hashicorp/memberlist"
+)
+
+// LeaseDuration is how long a node holds the lease on a segment of the keyspace without renewing it. A
+// node which goes away keeps its segments from being served by anyone else for this long
+const LeaseDuration = 30 * time.Second
+
+// LeaseRenewInterval is how often a node renews the leases on the segments it serves
+const LeaseRenewInterval = 10 * time.Second
+
+// LeaseFenceTime is how close to expiring a lease is before each receive checks it is still held in the
+// backend. A lease renewed on time never gets this close, so receives only go to the backend once a
+// renewal is running late
+const LeaseFenceTime = LeaseDuration - LeaseRenewInterval*3/2
+
+// The registers on a lease record
+const (
+	leaseOwner     = "owner"
+	leaseExpiresAt = "expires_at"
+	leaseToken     = "token"
+	leaseBottom    = "bottom"
+)
+
+// PartitionLease is the right of a node to serve a segment of the keyspace, the range between two
+// points of the ring, until it expires. Leases are kept in the backend, so every node sees them. The
+// token goes up every time the segment changes hands, so a lease can be told apart from any later one,
+// even one held by the same node. The lease covers the keys from the bottom up to the segment, as the
+// range stood on the ring of its owner when it was last renewed
+type PartitionLease struct {
+	Segment   int       `json:"segment,string"`
+	Bottom    int       `json:"bottom,string"`
+	Owner     string    `json:"owner"`
+	ExpiresAt time.Time `json:"expires_at"`
+	Token     int64     `json:"token"`
+}
+
+// live returns true if the lease is held by someone, and has yet to expire
+func (lease PartitionLease) live(now time.Time) bool {
+	return lease.Owner != "" && now.Before(lease.ExpiresAt)
+}
+
+// ranges returns the ranges of the keyspace the lease covers, in order
+func (lease PartitionLease) ranges() []KeyRange {
+	if lease.Bottom < lease.Segment {
+		return []KeyRange{{Bottom: lease.Bottom, Top: lease.Segment}}
+	}
+	// The range wraps around past the last point to the first
+	return []KeyRange{{Bottom: 0, Top: lease.Segment}, {Bottom: lease.Bottom, Top: math.MaxInt64}}
+}
+
+// FetchPartitionLease returns the lease on the segment, or false if it has never been leased
+func FetchPartitionLease(cfg *Config, segment int) (PartitionLease, bool, error) {
+	record, err := cfg.Backend.FetchRecord(leaseRecordName(segment))
+	if err == backend.ErrNotFound {
+		// Read as it would be by a conditional write, with no registers
+		return leaseFromRecord(segment, backend.NewMap()), false, nil
+	}
+	if err != nil {
+		return PartitionLease{Segment: segment}, false, err
+	}
+	return leaseFromRecord(segment, record), true, nil
+}
+
+// leaseFromRecord reads the lease on the segment from its record
+func leaseFromRecord(segment int, record *backend.Map) PartitionLease {
+	lease := PartitionLease{Segment: segment}
+	lease.Owner, _ = record.FetchRegister(leaseOwner)
+	expiresAt, _ := record.FetchRegister(leaseExpiresAt)
+	nanos, _ := strconv.ParseInt(expiresAt, 10, 64)
+	lease.ExpiresAt = time.Unix(0, nanos)
+	token, _ := record.FetchRegister(leaseToken)
+	lease.Token, _ = strconv.ParseInt(token, 10, 64)
+	bottom, _ := record.FetchRegister(leaseBottom)
+	lease.Bottom, _ = strconv.Atoi(bottom)
+	return lease
+}
+
+// AcquirePartitionLease leases the segment, covering the keys from the bottom up to it, to the node for
+// the duration, renewing the lease if the node already holds it. Returns false, along with the current
+// lease, if another node holds a live lease on it. The lease is only written if it is unchanged since it
+// was read, so of two nodes taking the same free segment at the same moment, only one gets it
+func AcquirePartitionLease(cfg *Config, node string, segment int, bottom int, duration time.Duration) (PartitionLease, bool, error) {
+	current, _, err := FetchPartitionLease(cfg, segment)
+	if err != nil {
+		return current, false, err
+	}
+	now := time.Now()
+	if current.Owner != node && current.live(now) {
+		return current, false, nil
+	}
+	lease := PartitionLease{Segment: segment, Bottom: bottom, Owner: node, ExpiresAt: now.Add(duration), Token: current.Token}
+	if current.Owner != node {
+		lease.Token++
+	}
+	err = cfg.Backend.UpdateRecordIf(leaseRecordName(segment), map[string]string{
+		leaseOwner:     lease.Owner,
+		leaseExpiresAt: strconv.FormatInt(lease.ExpiresAt.UnixNano(), 10),
+		leaseToken:     strconv.FormatInt(lease.Token, 10),
+		leaseBottom:    strconv.Itoa(lease.Bottom),
+	}, func(record *backend.Map) bool {
+		stored := leaseFromRecord(segment, record)
+		return stored.Owner == current.Owner && stored.Token == current.Token && stored.ExpiresAt.Equal(current.ExpiresAt)
+	})
+	if err == backend.ErrConditionFailed {
+		// Someone else got to it first
+		latest, _, err := FetchPartitionLease(cfg, segment)
+		return latest, false, err
+	}
+	if err != nil {
+		return current, false, err
+	}
+	return lease, true, nil
+}
+
+// ReleasePartitionLease gives up the lease, so another node can take the segment over straight away. It
+// does nothing if the segment has since changed hands
+func ReleasePartitionLease(cfg *Config, lease PartitionLease) error {
+	// The token is kept, so it keeps going up
+	err := cfg.Backend.UpdateRecordIf(leaseRecordName(lease.Segment), map[string]string{
+		leaseOwner:     "",
+		leaseExpiresAt: "0",
+	}, func(record *backend.Map) bool {
+		stored := leaseFromRecord(lease.Segment, record)
+		return stored.Owner == lease.Owner && stored.Token == lease.Token
+	})
+	if err == backend.ErrConditionFailed {
+		return nil
+	}
+	return err
+}
+
+// Leases are the leases this node holds on segments of the keyspace, and the ranges of the keyspace they
+// cover, as of their last renewal
+type Leases struct {
+	sync.RWMutex
+	// Held while renewing, so only one renewal runs at a time
+	renewing sync.Mutex
+	ring     *Ring
+	node     string
+	leases   map[int]PartitionLease
+	segments map[int][]KeyRange
+	// Nodes which left the ring, whose lease records are yet to be deleted. Only used while renewing
+	departed map[string]bool
+	// Channels / Timer for renewing the leases
+	renewScheduler *time.Ticker
+	renewKiller    chan struct{}
+}
+
+// NewLeases creates the leases of this node, which holds none until they are first renewed
+func NewLeases() *Leases {
+	return &Leases{
+		leases:      make(map[int]PartitionLease),
+		segments:    make(map[int][]KeyRange),
+		departed:    make(map[string]bool),
+		renewKiller: make(chan struct{}),
+	}
+}
+
+// RenewPartitionLeases takes, or renews, the lease on every segment this node owns on the ring of the
+// current members, and releases the leases on any segments it no longer owns. Segments another node
+// still holds a live lease on, or whose keys are still covered by the live lease of another node on a
+// segment it was split from, are left to it, and taken over once it releases or narrows them, or they
+// expire. Once the node is draining, every lease it holds is released
+func RenewPartitionLeases(cfg *Config, list *memberlist.Memberlist) {
+	leases := cfg.Leases
+	if leases == nil {
+		return
+	}
+	leases.renewing.Lock()
+	defer leases.renewing.Unlock()
+	leases.renew(cfg, list)
+}
+
+func (leases *Leases) renew(cfg *Config, list *memberlist.Memberlist) {
+	ring := nodeRing(cfg, list)
+	node := list.LocalNode().Name
+
+	leases.RLock()
+	held := leases.leases
+	previous := leases.ring
+	leases.RUnlock()
+
+	segments := ring.segments(node)
+	if cfg.Drain.Draining() {
+		// A draining node takes no segments, so gives up all it holds
+		segments = nil
+	}
+	leases.narrow(segments)
+
+	leases.noteDeparted(previous, ring)
+	waiting := leases.deleteDeparted(cfg, ring)
+	covered := leases.coveredElsewhere(cfg, ring, node, segments, held)
+
+	acquired := make(map[int]PartitionLease)
+	for segment, ranges := range segments {
+		if waiting[segment] {
+			logrus.Debugf("Waiting on the lease of a node which left to expire before taking segment %d", segment)
+			delete(segments, segment)
+			continue
+		}
+		if owner, ok := covered[segment]; ok {
+			logrus.Debugf("Waiting on %s to give up the keys of segment %d", owner, segment)
+			delete(segments, segment)
+			continue
+		}
+		lease, ok, err := AcquirePartitionLease(cfg, node, segment, ranges[0].Bottom, LeaseDuration)
+		if err != nil {
+			logrus.Error(err)
+			delete(segments, segment)
+			continue
+		}
+		if !ok {
+			logrus.Debugf("Waiting on %s to give up segment %d", lease.Owner, segment)
+			delete(segments, segment)
+			continue
+		}
+		acquired[segment] = lease
+		// In order, as they are intersected with the ranges of each receive
+		segments[segment] = mergeRanges(ranges)
+	}
+	for segment, lease := range held {
+		if _, kept := acquired[segment]; kept || lease.Owner != node {
+			continue
+		}
+		err := ReleasePartitionLease(cfg, lease)
+		if err != nil {
+			logrus.Error(err)
+		}
+	}
+
+	leases.Lock()
+	defer leases.Unlock()
+	leases.ring = ring
+	leases.node = node
+	leases.leases = acquired
+	leases.segments = segments
+}
+
+// narrow stops serving the keys of the held segments which are no longer in them on the ring, before
+// their leases are renewed over their narrower ranges, and another node takes the keys over on seeing them
+func (leases *Leases) narrow(segments map[int][]KeyRange) {
+	leases.Lock()
+	defer leases.Unlock()
+	narrowed := make(map[int][]KeyRange)
+	for segment, held := range leases.segments {
+		owned := append([]KeyRange{}, segments[segment]...)
+		narrowed[segment] = intersectRanges(mergeRanges(append([]KeyRange{}, held...)), mergeRanges(owned))
+	}
+	leases.segments = narrowed
+}
+
+// coveredElsewhere returns the segments this node is yet to hold whose keys are still covered by the live
+// lease of another node, along with its owner. A node joining the ring splits the segments of the points
+// after its own, which their owners keep serving in full until they rebalance and renew their leases over
+// the narrower ranges. As no two live leases cover the same keys, only the first live lease after each
+// segment can cover it, passing over the points which have no live lease, such as those of other nodes
+// joining at the same time
+func (leases *Leases) coveredElsewhere(cfg *Config, ring *Ring, node string, segments map[int][]KeyRange, held map[int]PartitionLease) map[int]string {
+	covered := make(map[int]string)
+	fetched := make(map[int]PartitionLease)
+	now := time.Now()
+	for segment, ranges := range segments {
+		if _, ok := held[segment]; ok {
+			continue
+		}
+		owned := mergeRanges(append([]KeyRange{}, ranges...))
+		for point := ring.points[ring.pointIndex(segment)]; point.position != segment; point = ring.points[ring.pointIndex(point.position)] {
+			lease, ok := fetched[point.position]
+			if !ok {
+				var err error
+				lease, _, err = FetchPartitionLease(cfg, point.position)
+				if err != nil {
+					logrus.Error(err)
+					// Unsure who holds the keys, so leave them be until the next renewal
+					covered[segment] = ""
+					break
+				}
+				fetched[point.position] = lease
+			}
+			if !lease.live(now) {
+				continue
+			}
+			if lease.Owner != node && len(intersectRanges(owned, lease.ranges())) > 0 {
+				covered[segment] = lease.Owner
+			}
+			break
+		}
+	}
+	return covered
+}
+
+// noteDeparted keeps track of the nodes on the previous ring which are not on the current one, until
+// their lease records are deleted. A node which comes back keeps its records
+func (leases *Leases) noteDeparted(previous *Ring, ring *Ring) {
+	current := ring.nodes()
+	if previous != nil {
+		for node := range previous.nodes() {
+			if !current[node] {
+				leases.departed[node] = true
+			}
+		}
+	}
+	for node := range current {
+		delete(leases.departed, node)
+	}
+}
+
+// deleteDeparted deletes the lease records on the segments of the nodes which left the ring, once they
+// have expired, so they don't pile up in the backend. Returns the segments of the ring whose ranges hold
+// a segment of a node which left that is still leased to it, which can't be served until it expires
+func (leases *Leases) deleteDeparted(cfg *Config, ring *Ring) map[int]bool {
+	waiting := make(map[int]bool)
+	for node := range leases.departed {
+		remaining := false
+		for i := 0; i < RingVirtualNodes; i++ {
+			segment := ringPosition(node, i)
+			err := cfg.Backend.DeleteRecordIf(leaseRecordName(segment), func(record *backend.Map) bool {
+				return !leaseFromRecord(segment, record).live(time.Now())
+			})
+			if err == nil || err == backend.ErrNotFound {
+				continue
+			}
+			if err != backend.ErrConditionFailed {
+				logrus.Error(err)
+			}
+			remaining = true
+			waiting[ring.Segment(segment)] = true
+		}
+		if !remaining {
+			delete(leases.departed, node)
+		}
+	}
+	return waiting
+}
+
+// stopRenewal stops renewing the leases on an interval
+func (leases *Leases) stopRenewal() {
+	if leases != nil && leases.renewKiller != nil {
+		close(leases.renewKiller)
+	}
+}
+
+// ranges returns the ranges of the keyspace covered by the leases this node holds, less any which are
+// too close to expiring to be safe to serve, as they weren't renewed in time
+func (leases *Leases) ranges(now time.Time) []KeyRange {
+	if leases == nil {
+		return []KeyRange{}
+	}
+	leases.RLock()
+	defer leases.RUnlock()
+	ranges := make([]KeyRange, 0)
+	for segment, lease := range leases.leases {
+		if lease.live(now.Add(LeaseRenewInterval)) {
+			ranges = append(ranges, leases.segments[segment]...)
+		}
+	}
+	return mergeRanges(ranges)
+}
+
+// NodePartitionLeases returns the leases this node holds
+func NodePartitionLeases(cfg *Config) []PartitionLease {
+	held := make([]PartitionLease, 0)
+	if cfg.Leases == nil {
+		return held
+	}
+	cfg.Leases.RLock()
+	defer cfg.Leases.RUnlock()
+	for _, lease := range cfg.Leases.leases {
+		held = append(held, lease)
+	}
+	return held
+}
+
+// leasedRanges returns the ranges of the keyspace covered by the leases this node holds. The leases are
+// only renewed by ScheduleLeaseRenewal and rebalances, never by a receive, so a slow backend doesn't hold
+// up receivers. Leases not renewed in time stop being served before they expire
+func leasedRanges(cfg *Config) []KeyRange {
+	return cfg.Leases.ranges(time.Now())
+}
+
+// fenceRanges returns the parts of the ranges covered by leases this node still holds. A lease renewed on
+// time is trusted as it stood at its renewal, as no other node takes it before it expires. One whose
+// renewal is late, within LeaseFenceTime of expiring, is checked against the backend under the same
+// token, so a lease lost since the last renewal, such as one which another node with a fast clock saw
+// expire and took over, stops being served straight away
+func fenceRanges(cfg *Config, ranges []KeyRange) []KeyRange {
+	if cfg.Leases == nil {
+		return []KeyRange{}
+	}
+	cfg.Leases.RLock()
+	node := cfg.Leases.node
+	held := cfg.Leases.leases
+	segments := cfg.Leases.segments
+	cfg.Leases.RUnlock()
+
+	now := time.Now()
+	var wg sync.WaitGroup
+	var lock sync.Mutex
+	fenced := make([]KeyRange, 0)
+	for segment, lease := range held {
+		if len(intersectRanges(ranges, segments[segment])) == 0 || !lease.live(now) {
+			continue
+		}
+		if lease.live(now.Add(LeaseFenceTime)) {
+			fenced = append(fenced, segments[segment]...)
+			continue
+		}
+		// Checked in parallel, so a receive waits on one round trip to the backend, not one per lease
+		wg.Add(1)
+		go func(segment int, lease PartitionLease) {
+			defer wg.Done()
+			current, _, err := FetchPartitionLease(cfg, segment)
+			if err != nil {
+				logrus.Error(err)
+				return
+			}
+			if current.Owner != node || current.Token != lease.Token || !current.live(now) {
+				logrus.Warnf("Lost the lease on segment %d to %s, no longer serving it", segment, current.Owner)
+				return
+			}
+			lock.Lock()
+			defer lock.Unlock()
+			fenced = append(fenced, segments[segment]...)
+		}(segment, lease)
+	}
+	wg.Wait()
+	return intersectRanges(ranges, mergeRanges(fenced))
+}
+
+// ScheduleLeaseRenewal renews the leases of this node straight away, and then on an interval until the
+// node drains
+func ScheduleLeaseRenewal(cfg *Config, list *memberlist.Memberlist) {
+	leases := cfg.Leases
+	RenewPartitionLeases(cfg, list)
+	leases.renewScheduler = time.NewTicker(LeaseRenewInterval)
+	go func() {
+		for {
+			select {
+			case <-leases.renewScheduler.C:
+				RenewPartitionLeases(cfg, list)
+			case <-leases.renewKiller:
+				leases.renewScheduler.Stop()
+				return
+			}
+		}
+	}()
+}
+
+func leaseRecordName(segment int) string {
+	return fmt.Sprintf("partition_lease_%d", segment)
+}
@@ -0,0 +1,231 @@
+package app_test
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Tapjoy/dynamiq/app"
+	"github.com/Tapjoy/dynamiq/app/backend"
+	"github.com/hashicorp/memberlist"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("PartitionLease", func() {
+
+	var (
+		segment int
+		bottom  int
+		key     = math.MaxInt64 / 3
+	)
+
+	// Returns true if the ranges this node serves hold the key
+	serves := func(key int) bool {
+		for _, keyRange := range app.GetNodeRanges(cfg, memberList) {
+			if key >= keyRange.Bottom && key < keyRange.Top {
+				return true
+			}
+		}
+		return false
+	}
+
+	BeforeEach(func() {
+		segment = app.NewRing([]string{memberList.LocalNode().Name}).Segment(key)
+		app.RenewPartitionLeases(cfg, memberList)
+		lease, _, _ := app.FetchPartitionLease(cfg, segment)
+		bottom = lease.Bottom
+	})
+
+	AfterEach(func() {
+		lease, _, err := app.FetchPartitionLease(cfg, segment)
+		Expect(err).ToNot(HaveOccurred())
+		if lease.Owner != memberList.LocalNode().Name {
+			Expect(app.ReleasePartitionLease(cfg, lease)).To(Succeed())
+		}
+		app.RenewPartitionLeases(cfg, memberList)
+	})
+
+	It("should lease every segment this node owns to it", func() {
+		lease, found, err := app.FetchPartitionLease(cfg, segment)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(found).To(BeTrue())
+		Expect(lease.Owner).To(Equal(memberList.LocalNode().Name))
+		Expect(lease.ExpiresAt).To(BeTemporally(">", time.Now()))
+		Expect(serves(key)).To(BeTrue())
+	})
+
+	It("should keep the token while the same node renews the lease", func() {
+		before, _, _ := app.FetchPartitionLease(cfg, segment)
+		app.RenewPartitionLeases(cfg, memberList)
+		after, _, _ := app.FetchPartitionLease(cfg, segment)
+		Expect(after.Token).To(Equal(before.Token))
+		Expect(after.ExpiresAt).To(BeTemporally(">=", before.ExpiresAt))
+	})
+
+	It("should not let another node take a live lease", func() {
+		lease, acquired, err := app.AcquirePartitionLease(cfg, "other", segment, bottom, app.LeaseDuration)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(acquired).To(BeFalse())
+		Expect(lease.Owner).To(Equal(memberList.LocalNode().Name))
+	})
+
+	It("should stop serving a segment another node holds, until it gives it up", func() {
+		held, _, _ := app.FetchPartitionLease(cfg, segment)
+		Expect(app.ReleasePartitionLease(cfg, held)).To(Succeed())
+		other, acquired, err := app.AcquirePartitionLease(cfg, "other", segment, bottom, app.LeaseDuration)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(acquired).To(BeTrue())
+		Expect(other.Token).To(Equal(held.Token + 1))
+
+		app.RenewPartitionLeases(cfg, memberList)
+		Expect(serves(key)).To(BeFalse())
+
+		Expect(app.ReleasePartitionLease(cfg, other)).To(Succeed())
+		app.RenewPartitionLeases(cfg, memberList)
+		Expect(serves(key)).To(BeTrue())
+		lease, _, _ := app.FetchPartitionLease(cfg, segment)
+		Expect(lease.Token).To(Equal(other.Token + 1))
+	})
+
+	It("should only let one of several nodes take a free segment at once", func() {
+		held, _, _ := app.FetchPartitionLease(cfg, segment)
+		Expect(app.ReleasePartitionLease(cfg, held)).To(Succeed())
+		slowCfg := *cfg
+		slowCfg.Backend = slowBackend{cfg.Backend}
+		var wg sync.WaitGroup
+		var lock sync.Mutex
+		owners := make([]string, 0)
+		for i := 0; i < 8; i++ {
+			wg.Add(1)
+			go func(node string) {
+				defer wg.Done()
+				_, acquired, err := app.AcquirePartitionLease(&slowCfg, node, segment, bottom, app.LeaseDuration)
+				Expect(err).ToNot(HaveOccurred())
+				if acquired {
+					lock.Lock()
+					owners = append(owners, node)
+					lock.Unlock()
+				}
+			}(fmt.Sprintf("node-%d", i))
+		}
+		wg.Wait()
+		Expect(owners).To(HaveLen(1))
+		lease, _, _ := app.FetchPartitionLease(cfg, segment)
+		Expect(lease.Owner).To(Equal(owners[0]))
+		Expect(lease.Token).To(Equal(held.Token + 1))
+	})
+
+	It("should only check the leases it reads from against the backend once their renewal is late", func() {
+		queue := queues.QueueMap[testQueueName]
+		id, err := queue.Publish(cfg, app.PublishMessage{Body: "fenced"})
+		Expect(err).ToNot(HaveOccurred())
+
+		var calls int32
+		countingCfg := *cfg
+		countingCfg.Backend = recordCountingBackend{cfg.Backend, &calls}
+		Eventually(func() []backend.Message {
+			messages, _ := queue.Get(&countingCfg, memberList, 10)
+			for _, message := range messages {
+				queue.Delete(cfg, message.Key, app.MessageReceipt(&message))
+			}
+			return messages
+		}).Should(ConsistOf(HaveField("Key", id)))
+		Expect(atomic.LoadInt32(&calls)).To(BeZero())
+	})
+
+	It("should stop handing out messages from segments it couldn't renew", func() {
+		queue := queues.QueueMap[testQueueName]
+		id, err := queue.Publish(cfg, app.PublishMessage{Body: "fenced"})
+		Expect(err).ToNot(HaveOccurred())
+
+		// This node is cut off from the backend while renewing
+		unreachableCfg := *cfg
+		unreachableCfg.Backend = unreachableBackend{cfg.Backend}
+		app.RenewPartitionLeases(&unreachableCfg, memberList)
+		Expect(app.GetNodeRanges(cfg, memberList)).To(BeEmpty())
+		for i := 0; i < 5; i++ {
+			messages, err := queue.Get(cfg, memberList, 10)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(messages).To(BeEmpty())
+		}
+
+		app.RenewPartitionLeases(cfg, memberList)
+		Eventually(func() []backend.Message {
+			messages, _ := queue.Get(cfg, memberList, 10)
+			for _, message := range messages {
+				queue.Delete(cfg, message.Key, app.MessageReceipt(&message))
+			}
+			return messages
+		}).Should(ConsistOf(HaveField("Key", id)))
+	})
+
+	It("should delete the lease records of a node which left, once they expire", func() {
+		departed := &memberlist.Node{Name: "departed", Addr: net.ParseIP("10.0.0.8"), Port: 8000}
+		departedSegment := app.NewRing([]string{departed.Name}).Segment(0)
+		cfg.Topology.NotifyJoin(departed)
+		cfg.Topology.Rebalance(memberList)
+		lease, acquired, err := app.AcquirePartitionLease(cfg, departed.Name, departedSegment, departedSegment-1, app.LeaseDuration)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(acquired).To(BeTrue())
+
+		// Its keys are left alone while its lease lives
+		cfg.Topology.NotifyLeave(departed)
+		cfg.Topology.Rebalance(memberList)
+		_, found, _ := app.FetchPartitionLease(cfg, departedSegment)
+		Expect(found).To(BeTrue())
+		Expect(serves(departedSegment - 1)).To(BeFalse())
+
+		Expect(app.ReleasePartitionLease(cfg, lease)).To(Succeed())
+		app.RenewPartitionLeases(cfg, memberList)
+		_, found, _ = app.FetchPartitionLease(cfg, departedSegment)
+		Expect(found).To(BeFalse())
+		Expect(serves(departedSegment - 1)).To(BeTrue())
+	})
+
+	It("should only take the keys split off by a node joining once their old owner gives them up", func() {
+		// A node of its own to join the cluster, so the rest of the suite keeps its node
+		joinCfg := *cfg
+		joinCfg.Queues = &app.Queues{QueueMap: map[string]*app.Queue{}}
+		joinCfg.Topology = app.NewTopology(&joinCfg)
+		joinList, _, _ := app.InitMemberList("join_node", 8011, []string{"127.0.0.1:8000"}, core.SeedPort, joinCfg.Topology, nil)
+		defer joinList.Shutdown()
+		joinCfg.Drain = app.NewDrain(&joinCfg, joinList)
+		joinCfg.Leases = app.NewLeases()
+		joinCfg.Topology.Rebalance(joinList)
+
+		// This node serves the whole keyspace until it rebalances
+		Expect(app.GetNodeRanges(&joinCfg, joinList)).To(BeEmpty())
+		Expect(app.GetNodeRanges(cfg, memberList)).To(Equal([]app.KeyRange{{Bottom: 0, Top: math.MaxInt64}}))
+
+		Eventually(cfg.Topology.Members).Should(HaveKey("join_node"))
+		cfg.Topology.Rebalance(memberList)
+		app.RenewPartitionLeases(&joinCfg, joinList)
+		joined := app.GetNodeRanges(&joinCfg, joinList)
+		Expect(joined).ToNot(BeEmpty())
+		for _, keyRange := range joined {
+			Expect(serves(keyRange.Bottom)).To(BeFalse())
+			Expect(serves(keyRange.Top - 1)).To(BeFalse())
+		}
+
+		joinCfg.Drain.Drain()
+		Eventually(cfg.Topology.Members).ShouldNot(HaveKey("join_node"))
+		cfg.Topology.Rebalance(memberList)
+		Expect(app.GetNodeRanges(cfg, memberList)).To(Equal([]app.KeyRange{{Bottom: 0, Top: math.MaxInt64}}))
+	})
+
+	It("should take over a segment once the lease of another node expires", func() {
+		held, _, _ := app.FetchPartitionLease(cfg, segment)
+		Expect(app.ReleasePartitionLease(cfg, held)).To(Succeed())
+		_, acquired, err := app.AcquirePartitionLease(cfg, "other", segment, bottom, 10*time.Millisecond)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(acquired).To(BeTrue())
+
+		time.Sleep(20 * time.Millisecond)
+		app.RenewPartitionLeases(cfg, memberList)
+		Expect(serves(key)).To(BeTrue())
+	})
+})
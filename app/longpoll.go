@@ -0,0 +1,69 @@
+package app
+
+import (
+	"time"
+
+	"github.com/Tapjoy/dynamiq/app/backend"
+	"github.com/hashicorp/memberlist"
+)
+
+// LongPollInterval is the longest a waiting receive sleeps before looking for messages again. Puts on
+// this node wake receivers right away, but messages put on other nodes, partitions becoming available,
+// and visibility timeouts expiring are only noticed by looking again
+const LongPollInterval = 500 * time.Millisecond
+
+// GetWithWait gets messages from the queue like Get, but if there are none it waits up to wait
+// for some to arrive before returning empty. Once the node is draining it returns ErrDraining, and
+// receivers already waiting return empty
+func (queue *Queue) GetWithWait(cfg *Config, list *memberlist.Memberlist, batchsize int64, wait time.Duration) ([]backend.Message, error) {
+	if !cfg.Drain.beginReceive() {
+		return nil, ErrDraining
+	}
+	defer cfg.Drain.endReceive()
+	deadline := time.Now().Add(wait)
+	for {
+		// Grab the channel before looking, so a put which lands while we look still wakes us
+		arrived := queue.arrivals()
+		messages, err := queue.Get(cfg, list, batchsize)
+		if len(messages) > 0 || (err != nil && err.Error() != NoPartitions) {
+			return messages, err
+		}
+		remaining := deadline.Sub(time.Now())
+		if remaining <= 0 {
+			return messages, err
+		}
+		if remaining > LongPollInterval {
+			remaining = LongPollInterval
+		}
+		timer := time.NewTimer(remaining)
+		select {
+		case <-arrived:
+		case <-timer.C:
+		case <-cfg.Drain.stopping():
+			// Hand the receiver back straight away, rather than hold up the drain
+			timer.Stop()
+			return messages, err
+		}
+		timer.Stop()
+	}
+}
+
+// arrivals returns a channel which is closed the next time a message is put on this node
+func (queue *Queue) arrivals() <-chan struct{} {
+	queue.arrivedLock.Lock()
+	defer queue.arrivedLock.Unlock()
+	if queue.arrived == nil {
+		queue.arrived = make(chan struct{})
+	}
+	return queue.arrived
+}
+
+// notifyArrival wakes any receivers waiting for messages on this node
+func (queue *Queue) notifyArrival() {
+	queue.arrivedLock.Lock()
+	defer queue.arrivedLock.Unlock()
+	if queue.arrived != nil {
+		close(queue.arrived)
+		queue.arrived = nil
+	}
+}
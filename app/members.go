@@ -1,19 +1,247 @@
 package app
 
 import (
+	"fmt"
 	"sort"
 	"strconv"
+	"sync"
+	"time"
 
 	"github.com/Sirupsen/logrus"
+	"github.com/Tapjoy/dynamiq/app/stats"
 	"github.com/hashicorp/memberlist"
 )
 
-// InitMemberList created a memberlist, and joins it to the network
+// TopologyHistorySize is the number of changes to the members of the cluster kept for GET /status/topology
+const TopologyHistorySize = 100
+
+// TopologySettleTime is how long the members of the cluster have to go unchanged before the keyspace is
+// rebalanced between them, so a burst of nodes joining or leaving only moves the keyspace once
+const TopologySettleTime = 2 * time.Second
+
+// ClusterMembersStatsKey is the gauge of the members of the cluster, as seen by this node
+const ClusterMembersStatsKey = "cluster.members"
+
+// ClusterMovedStatsKey is the gauge of the percentage of the keyspace which changed owner in the last rebalance
+const ClusterMovedStatsKey = "cluster.moved_percent"
+
+// The kinds of change to the topology of the cluster
+const (
+	TopologyJoin      = "join"
+	TopologyLeave     = "leave"
+	TopologyUpdate    = "update"
+	TopologyRebalance = "rebalance"
+)
+
+// TopologyChange is an entry in the audit trail of the members of the cluster. Joins, leaves and
+// updates name the node which changed. Rebalances give the share of the keyspace which changed owner
+type TopologyChange struct {
+	Event   string    `json:"event"`
+	Node    string    `json:"node,omitempty"`
+	Address string    `json:"address,omitempty"`
+	At      time.Time `json:"at"`
+	Members []string  `json:"members"`
+	Moved   float64   `json:"moved,omitempty"`
+}
+
+// Topology keeps track of the members of the cluster, and the ring the keyspace is shared out on
+// between them. It is the memberlist EventDelegate, so it is told as nodes join, leave or change,
+// rather than asking memberlist for the members on every receive
+type Topology struct {
+	sync.RWMutex
+	cfg     *Config
+	members map[string]string
+	// The ring the keyspace was last rebalanced on, which leases are taken on
+	ring *Ring
+	// The ring of the current members, which becomes the ring once they settle
+	pending *Ring
+	history []TopologyChange
+	// Signalled when the ring changes, holding at most one pending change
+	changed chan struct{}
+}
+
+// NewTopology creates a topology with no members, to be filled in by memberlist as they join
+func NewTopology(cfg *Config) *Topology {
+	return &Topology{
+		cfg:     cfg,
+		members: make(map[string]string),
+		ring:    NewRing(nil),
+		pending: NewRing(nil),
+		history: make([]TopologyChange, 0),
+		changed: make(chan struct{}, 1),
+	}
+}
+
+// NotifyJoin is called by memberlist when a node joins the cluster, including this one
+func (topology *Topology) NotifyJoin(node *memberlist.Node) {
+	topology.change(TopologyJoin, node)
+}
+
+// NotifyLeave is called by memberlist when a node leaves the cluster, or is found to be dead
+func (topology *Topology) NotifyLeave(node *memberlist.Node) {
+	topology.change(TopologyLeave, node)
+}
+
+// NotifyUpdate is called by memberlist when the address or metadata of a node changes
+func (topology *Topology) NotifyUpdate(node *memberlist.Node) {
+	topology.change(TopologyUpdate, node)
+}
+
+// change records the change to the node, rebuilding the pending ring if the members changed. The ring
+// leases are taken on is left alone until the members settle and the keyspace is rebalanced. memberlist calls
+// its delegate while holding its own locks, so this must not call back into it, or block
+func (topology *Topology) change(event string, node *memberlist.Node) {
+	topology.Lock()
+	_, known := topology.members[node.Name]
+	if event == TopologyLeave {
+		delete(topology.members, node.Name)
+	} else {
+		topology.members[node.Name] = node.Address()
+	}
+	// Updates to a known node, or leaves of an unknown one, leave the ring as it was
+	ringChanged := known == (event == TopologyLeave)
+	if ringChanged {
+		topology.pending = NewRing(topology.memberNames())
+	}
+	change := topology.record(TopologyChange{Event: event, Node: node.Name, Address: node.Address()})
+	topology.Unlock()
+
+	logrus.WithFields(logrus.Fields{
+		"event":   event,
+		"node":    node.Name,
+		"address": change.Address,
+		"members": len(change.Members),
+	}).Info("Cluster topology changed")
+	recordTopologyChange(topology.cfg.Stats.Client, event, len(change.Members))
+
+	if ringChanged {
+		select {
+		case topology.changed <- struct{}{}:
+		default:
+			// A rebalance is already pending, and will pick this change up
+		}
+	}
+}
+
+// record adds the change to the history, stamped with the time and current members, dropping the
+// oldest change once the history is full. The caller holds the lock
+func (topology *Topology) record(change TopologyChange) TopologyChange {
+	change.At = time.Now()
+	change.Members = topology.memberNames()
+	topology.history = append(topology.history, change)
+	if len(topology.history) > TopologyHistorySize {
+		topology.history = topology.history[len(topology.history)-TopologyHistorySize:]
+	}
+	return change
+}
+
+// memberNames returns the names of the members, sorted. The caller holds the lock
+func (topology *Topology) memberNames() []string {
+	names := make([]string, 0, len(topology.members))
+	for name := range topology.members {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Members returns the address of every member of the cluster, by name
+func (topology *Topology) Members() map[string]string {
+	topology.RLock()
+	defer topology.RUnlock()
+	members := make(map[string]string, len(topology.members))
+	for name, address := range topology.members {
+		members[name] = address
+	}
+	return members
+}
+
+// NumMembers returns the number of members of the cluster
+func (topology *Topology) NumMembers() int {
+	topology.RLock()
+	defer topology.RUnlock()
+	return len(topology.members)
+}
+
+// Ring returns the ring the keyspace was last rebalanced on. It only moves onto the current members
+// once they have settled
+func (topology *Topology) Ring() *Ring {
+	topology.RLock()
+	defer topology.RUnlock()
+	return topology.ring
+}
+
+// PendingRing returns the ring of the current members, which the next rebalance moves onto
+func (topology *Topology) PendingRing() *Ring {
+	topology.RLock()
+	defer topology.RUnlock()
+	return topology.pending
+}
+
+// History returns the most recent changes to the members of the cluster, oldest first
+func (topology *Topology) History() []TopologyChange {
+	topology.RLock()
+	defer topology.RUnlock()
+	history := make([]TopologyChange, len(topology.history))
+	copy(history, topology.history)
+	return history
+}
+
+// Rebalance moves this node onto the ring of the current members, renewing the leases on the segments
+// it now owns and releasing those it no longer does. The partitions of every queue are cut from the
+// leased ranges, so they follow on the next receive
+func (topology *Topology) Rebalance(list *memberlist.Memberlist) {
+	topology.Lock()
+	moved := topology.pending.MovedShare(topology.ring)
+	topology.ring = topology.pending
+	change := topology.record(TopologyChange{Event: TopologyRebalance, Moved: moved})
+	topology.Unlock()
+
+	logrus.WithFields(logrus.Fields{
+		"members": len(change.Members),
+		"moved":   fmt.Sprintf("%.1f%%", moved*100),
+	}).Info("Rebalancing the keyspace between the members of the cluster")
+	RenewPartitionLeases(topology.cfg, list)
+	recordTopologyChange(topology.cfg.Stats.Client, TopologyRebalance, len(change.Members))
+	topology.cfg.Stats.Client.SetGauge(ClusterMovedStatsKey, int64(moved*100))
+}
+
+// ScheduleRebalance starts rebalancing the keyspace whenever the members of the cluster change, once
+// they have settled
+func (topology *Topology) ScheduleRebalance(list *memberlist.Memberlist) {
+	go func() {
+		for range topology.changed {
+			for settled := false; !settled; {
+				select {
+				case <-topology.changed:
+					// Changed again, so wait on the settle time afresh
+				case <-time.After(TopologySettleTime):
+					settled = true
+				}
+			}
+			topology.Rebalance(list)
+		}
+	}()
+}
+
+func recordTopologyChange(c stats.Client, event string, members int) error {
+	c.SetGauge(ClusterMembersStatsKey, int64(members))
+	return c.Incr(fmt.Sprintf("cluster.%s.count", event), 1)
+}
+
+// InitMemberList created a memberlist, and joins it to the network. The topology, if given,
+// is told of every change to the members, and the gossip, if given, spreads config changes
 // TODO clean this up, since we only really need the 1 port
-func InitMemberList(name string, port int, seedServers []string, seedPort int) (*memberlist.Memberlist, int, error) {
+func InitMemberList(name string, port int, seedServers []string, seedPort int, topology *Topology, gossip *Gossip) (*memberlist.Memberlist, int, error) {
 	conf := memberlist.DefaultLANConfig()
 	conf.Name = name
 	conf.BindPort = port
+	if topology != nil {
+		conf.Events = topology
+	}
+	if gossip != nil {
+		conf.Delegate = gossip
+	}
 
 	list, err := memberlist.Create(conf)
 
@@ -0,0 +1,135 @@
+package app_test
+
+import (
+	"math"
+	"net"
+
+	"github.com/Tapjoy/dynamiq/app"
+	"github.com/hashicorp/memberlist"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Topology", func() {
+
+	node := func(name string, address string) *memberlist.Node {
+		return &memberlist.Node{Name: name, Addr: net.ParseIP(address), Port: 8000}
+	}
+
+	// The share of the keyspace covered by the ranges
+	share := func(ranges []app.KeyRange) float64 {
+		total := 0.0
+		for _, keyRange := range ranges {
+			total += float64(keyRange.Top-keyRange.Bottom) / math.MaxInt64
+		}
+		return total
+	}
+
+	Context("Following the members", func() {
+		var topology *app.Topology
+
+		BeforeEach(func() {
+			topology = app.NewTopology(cfg)
+			topology.NotifyJoin(node("alice", "10.0.0.1"))
+			topology.NotifyJoin(node("bob", "10.0.0.2"))
+		})
+
+		It("should keep the members and their ring as nodes join and leave", func() {
+			Expect(topology.Members()).To(Equal(map[string]string{"alice": "10.0.0.1:8000", "bob": "10.0.0.2:8000"}))
+			Expect(topology.PendingRing().Ownership()).To(Equal(app.NewRing([]string{"alice", "bob"}).Ownership()))
+
+			topology.NotifyLeave(node("bob", "10.0.0.2"))
+			Expect(topology.Members()).To(HaveLen(1))
+			Expect(topology.PendingRing().Ownership()).To(Equal(app.NewRing([]string{"alice"}).Ownership()))
+		})
+
+		It("should keep the ring leases are taken on until the keyspace is rebalanced", func() {
+			Expect(topology.Ring().Ownership()).To(BeEmpty())
+			topology.NotifyLeave(node("bob", "10.0.0.2"))
+			Expect(topology.Ring().Ownership()).To(BeEmpty())
+		})
+
+		It("should keep the ring when a known node is updated", func() {
+			ring := topology.PendingRing()
+			topology.NotifyUpdate(node("bob", "10.0.0.3"))
+			Expect(topology.PendingRing()).To(BeIdenticalTo(ring))
+			Expect(topology.Members()["bob"]).To(Equal("10.0.0.3:8000"))
+		})
+
+		It("should keep an audit trail of every change", func() {
+			topology.NotifyLeave(node("alice", "10.0.0.1"))
+
+			history := topology.History()
+			Expect(history).To(HaveLen(3))
+			Expect(history[0].Event).To(Equal(app.TopologyJoin))
+			Expect(history[0].Members).To(Equal([]string{"alice"}))
+			Expect(history[1].Members).To(Equal([]string{"alice", "bob"}))
+			Expect(history[2].Event).To(Equal(app.TopologyLeave))
+			Expect(history[2].Node).To(Equal("alice"))
+			Expect(history[2].Address).To(Equal("10.0.0.1:8000"))
+			Expect(history[2].Members).To(Equal([]string{"bob"}))
+			Expect(history[2].At).To(BeTemporally(">=", history[0].At))
+		})
+
+		It("should only keep the most recent changes", func() {
+			for i := 0; i < app.TopologyHistorySize-1; i++ {
+				topology.NotifyUpdate(node("bob", "10.0.0.2"))
+			}
+			history := topology.History()
+			Expect(history).To(HaveLen(app.TopologyHistorySize))
+			Expect(history[0].Event).To(Equal(app.TopologyJoin))
+			Expect(history[0].Node).To(Equal("bob"))
+		})
+	})
+
+	Context("Rebalancing", func() {
+		other := node("other", "10.0.0.9")
+
+		BeforeEach(func() {
+			cfg.Topology.Rebalance(memberList)
+		})
+
+		AfterEach(func() {
+			cfg.Topology.NotifyLeave(other)
+			cfg.Topology.Rebalance(memberList)
+		})
+
+		It("should know this node has joined", func() {
+			Expect(cfg.Topology.Members()).To(HaveKey(memberList.LocalNode().Name))
+			Expect(share(app.GetNodeRanges(cfg, memberList))).To(BeNumerically("~", 1, 0.0001))
+		})
+
+		It("should keep serving the same ranges until the keyspace is rebalanced", func() {
+			before := app.GetNodeRanges(cfg, memberList)
+			settled := cfg.Topology.Ring()
+			cfg.Topology.NotifyJoin(other)
+			Expect(app.GetNodeRanges(cfg, memberList)).To(Equal(before))
+			// Renewing the leases on the interval, before the members settle, keeps the settled ring
+			app.RenewPartitionLeases(cfg, memberList)
+			Expect(cfg.Topology.Ring()).To(BeIdenticalTo(settled))
+			Expect(app.GetNodeRanges(cfg, memberList)).To(Equal(before))
+
+			cfg.Topology.Rebalance(memberList)
+			ring := cfg.Topology.Ring()
+			Expect(ring).To(BeIdenticalTo(cfg.Topology.PendingRing()))
+			ranges := app.GetNodeRanges(cfg, memberList)
+			Expect(share(ranges)).To(BeNumerically("<", 0.8))
+			for _, keyRange := range ranges {
+				Expect(ring.Owner(keyRange.Bottom)).To(Equal(memberList.LocalNode().Name))
+			}
+
+			history := cfg.Topology.History()
+			last := history[len(history)-1]
+			Expect(last.Event).To(Equal(app.TopologyRebalance))
+			Expect(last.Moved).To(BeNumerically("~", 1-share(ranges), 0.0001))
+		})
+
+		It("should take the keyspace of a node back once it leaves", func() {
+			cfg.Topology.NotifyJoin(other)
+			cfg.Topology.Rebalance(memberList)
+			cfg.Topology.NotifyLeave(other)
+			cfg.Topology.Rebalance(memberList)
+			Expect(share(app.GetNodeRanges(cfg, memberList))).To(BeNumerically("~", 1, 0.0001))
+		})
+	})
+})
@@ -0,0 +1,224 @@
+package app
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/Tapjoy/dynamiq/app/backend"
+)
+
+var (
+	// ErrInvalidReceipt represents the condition where the receipt handle provided for a message
+	// does not match the one handed out when it was last received
+	ErrInvalidReceipt = errors.New("Receipt handle is not valid for this message")
+	// ErrMissingReceipt represents the condition where a message is deleted without the receipt handle
+	// it was received with
+	ErrMissingReceipt = errors.New("A receipt handle is required to delete a message")
+	// ErrMessageNotInFlight represents the condition where the visibility of a message is changed
+	// after its visibility timeout already expired
+	ErrMessageNotInFlight = errors.New("Message is not in flight")
+	// ErrInvalidVisibilityTimeout represents the condition where a negative visibility timeout is requested
+	ErrInvalidVisibilityTimeout = errors.New("Visibility timeout must not be negative")
+	// ErrInvalidAttribute represents the condition where a message attribute has no name, an unknown
+	// type, or a value which doesn't match its type
+	ErrInvalidAttribute = errors.New("Message attributes must be named, and have a String, Number or Binary type with a matching value")
+	// ErrMissingMessageGroup represents the condition where a message is published to a fifo queue without a message group
+	ErrMissingMessageGroup = errors.New("Messages published to a fifo queue must have a message group id")
+	// ErrFifoSequenceContended represents the condition where a fifo message id couldn't be taken, as too
+	// many others were being published to the same block of the keyspace at once
+	ErrFifoSequenceContended = errors.New("Too many messages are being published to this message group at once, try again")
+	// ErrInvalidPriority represents the condition where a message is published with a priority outside of 0 to MaxPriority
+	ErrInvalidPriority = fmt.Errorf("Priority must be between 0 and %d", MaxPriority)
+)
+
+// DefaultContentType is the content type of messages published without one
+const DefaultContentType = "application/json"
+
+// StringAttribute is the type of message attributes holding text
+const StringAttribute = "String"
+
+// NumberAttribute is the type of message attributes holding a number, written as text
+const NumberAttribute = "Number"
+
+// BinaryAttribute is the type of message attributes holding base64 encoded bytes
+const BinaryAttribute = "Binary"
+
+// MessageAttribute is a typed value published alongside the message body
+type MessageAttribute struct {
+	Type  string `json:"type"`
+	Value string `json:"value"`
+}
+
+// PublishMessage is a message to be put onto a queue, along with how it should be stored
+type PublishMessage struct {
+	Body        string                      `json:"body"`
+	ContentType string                      `json:"content_type,omitempty"`
+	Attributes  map[string]MessageAttribute `json:"attributes,omitempty"`
+	// If not set, the queues delay_seconds setting is used
+	DelaySeconds *float64 `json:"delay_seconds,omitempty"`
+	// Messages published with the same id within the queues deduplication window are only stored once
+	DeduplicationID string `json:"deduplication_id,omitempty"`
+	// Required on fifo queues, messages in the same group are delivered in the order they were published
+	MessageGroupID string `json:"message_group_id,omitempty"`
+	// Higher priorities are received first. If not set, DefaultPriority is used
+	Priority *int `json:"priority,omitempty"`
+}
+
+// UnmarshalJSON accepts either a full message object, or just a string holding the body
+func (message *PublishMessage) UnmarshalJSON(data []byte) error {
+	var body string
+	if json.Unmarshal(data, &body) == nil {
+		*message = PublishMessage{Body: body}
+		return nil
+	}
+	// Use a different type, so this method isn't called again
+	type publishMessage PublishMessage
+	return json.Unmarshal(data, (*publishMessage)(message))
+}
+
+// Validate checks the delay, priority and attributes of the message
+func (message PublishMessage) Validate() error {
+	if message.DelaySeconds != nil && *message.DelaySeconds < 0 {
+		return ErrInvalidDelay
+	}
+	if message.Priority != nil && (*message.Priority < 0 || *message.Priority > MaxPriority) {
+		return ErrInvalidPriority
+	}
+	for name, attribute := range message.Attributes {
+		if name == "" {
+			return ErrInvalidAttribute
+		}
+		var err error
+		switch attribute.Type {
+		case StringAttribute:
+		case NumberAttribute:
+			_, err = strconv.ParseFloat(attribute.Value, 64)
+		case BinaryAttribute:
+			_, err = base64.StdEncoding.DecodeString(attribute.Value)
+		default:
+			err = ErrInvalidAttribute
+		}
+		if err != nil {
+			return ErrInvalidAttribute
+		}
+	}
+	return nil
+}
+
+func (message PublishMessage) contentType() string {
+	if message.ContentType == "" {
+		return DefaultContentType
+	}
+	return message.ContentType
+}
+
+// VisibleAtMeta is the message metadata key holding when an in-flight message becomes visible again
+const VisibleAtMeta = "visible_at"
+
+// ReceiptMeta is the message metadata key holding the receipt handle from the last receive
+const ReceiptMeta = "receipt"
+
+// ReceiveCountMeta is the message metadata key holding how many times the message has been received
+const ReceiveCountMeta = "receive_count"
+
+// EnqueuedAtMeta is the message metadata key holding when the message was first put, in unix nanoseconds
+const EnqueuedAtMeta = "enqueued_at"
+
+// AttributesMeta is the message metadata key holding the JSON encoded message attributes
+const AttributesMeta = "attributes"
+
+// MessageGroupMeta is the message metadata key holding the message group of a message on a fifo queue
+const MessageGroupMeta = "message_group"
+
+// PriorityMeta is the message metadata key holding the priority the message was published with
+const PriorityMeta = "priority"
+
+// SourceQueueMeta is the message metadata key holding the queue a dead lettered message came from
+const SourceQueueMeta = "source_queue"
+
+// messageVisibleAt returns the time the message becomes visible. Messages which have
+// never been received return the zero time
+func messageVisibleAt(message *backend.Message) time.Time {
+	visibleAt, err := strconv.ParseInt(message.Meta[VisibleAtMeta], 10, 64)
+	if err != nil {
+		return time.Time{}
+	}
+	return time.Unix(0, visibleAt)
+}
+
+// messageInFlight returns true if the message was received and its visibility timeout has not expired,
+// or if it was put with a delay which has not yet passed
+func messageInFlight(message *backend.Message, now time.Time) bool {
+	return messageVisibleAt(message).After(now)
+}
+
+// messageEnqueuedAt returns when the message was first put. Messages put before enqueue times were
+// recorded return false
+func messageEnqueuedAt(message *backend.Message) (time.Time, bool) {
+	enqueuedAt, err := strconv.ParseInt(message.Meta[EnqueuedAtMeta], 10, 64)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return time.Unix(0, enqueuedAt), true
+}
+
+// MessageReceipt returns the receipt handle from the last time the message was received
+func MessageReceipt(message *backend.Message) string {
+	return message.Meta[ReceiptMeta]
+}
+
+// MessageAttributes returns the attributes the message was published with
+func MessageAttributes(message *backend.Message) map[string]MessageAttribute {
+	attributes := make(map[string]MessageAttribute)
+	if encoded, ok := message.Meta[AttributesMeta]; ok {
+		json.Unmarshal([]byte(encoded), &attributes)
+	}
+	return attributes
+}
+
+// MessageGroup returns the message group the message was published to on a fifo queue
+func MessageGroup(message *backend.Message) string {
+	return message.Meta[MessageGroupMeta]
+}
+
+// MessagePriority returns the priority the message was published with. Messages published before
+// priorities existed have the DefaultPriority
+func MessagePriority(message *backend.Message) int {
+	priority, err := strconv.Atoi(message.Meta[PriorityMeta])
+	if err != nil {
+		return DefaultPriority
+	}
+	return priority
+}
+
+// MessageReceiveCount returns how many times the message has been received
+func MessageReceiveCount(message *backend.Message) int {
+	count, _ := strconv.Atoi(message.Meta[ReceiveCountMeta])
+	return count
+}
+
+// markInFlight records a new in-flight period and receipt handle on the message, and counts the receive
+func markInFlight(message *backend.Message, visibleAt time.Time) {
+	setVisibleAt(message, visibleAt)
+	message.Meta[ReceiptMeta] = newReceiptHandle()
+	message.Meta[ReceiveCountMeta] = strconv.Itoa(MessageReceiveCount(message) + 1)
+}
+
+func setVisibleAt(message *backend.Message, visibleAt time.Time) {
+	if message.Meta == nil {
+		message.Meta = make(map[string]string)
+	}
+	message.Meta[VisibleAtMeta] = strconv.FormatInt(visibleAt.UnixNano(), 10)
+}
+
+func newReceiptHandle() string {
+	handle := make([]byte, 16)
+	rand.Read(handle)
+	return hex.EncodeToString(handle)
+}
@@ -2,9 +2,7 @@ package app
 
 import (
 	"errors"
-	"math"
 	"math/rand"
-	"sort"
 	"sync"
 	"time"
 
@@ -16,10 +14,23 @@ import (
 // NoPartitions represents the message that there were no available partitions
 const NoPartitions string = "no available partitions"
 
+// AutoscaleFillRatio is how full, on average, receives must come back for receivers turned away with
+// NoPartitions to grow the partitions. Below it the queue is close to drained, and more partitions would
+// only mean more empty scans
+const AutoscaleFillRatio = 0.5
+
 // Partitions represents a collecton of Partition objects
 type Partitions struct {
 	partitions     *lane.PQueue
 	partitionCount int
+	// The partition currently holding each id, so copies dropped while out with a receiver aren't pushed back
+	current map[int]*Partition
+	// Set once the queue is deleted, so no more partitions are handed out or made
+	stopped bool
+	// Load seen since the partitions were last scaled
+	misses   int
+	receives int
+	filled   float64
 	sync.RWMutex
 }
 
@@ -27,6 +38,10 @@ type Partitions struct {
 type Partition struct {
 	ID       int
 	LastUsed time.Time
+	// The last time a receive from the partition found messages, or when it was made
+	LastFilled time.Time
+	// The range a receive from the partition starts scanning from
+	nextRange int
 }
 
 // InitPartitions creates a series of partitions based on the provided config and queue
@@ -34,6 +49,7 @@ func InitPartitions(cfg *Config, queueName string) *Partitions {
 	part := &Partitions{
 		partitions:     lane.NewPQueue(lane.MINPQ),
 		partitionCount: 0,
+		current:        make(map[int]*Partition),
 	}
 	// We'll initially allocate the minimum amount
 	minPartitions, _ := cfg.GetMinPartitions(queueName)
@@ -43,57 +59,48 @@ func InitPartitions(cfg *Config, queueName string) *Partitions {
 	return part
 }
 
+// Stop empties the partitions and keeps any more from being made or returned, so nothing
+// more is received from the queue on this node
+func (part *Partitions) Stop() {
+	part.Lock()
+	defer part.Unlock()
+	part.stopped = true
+	for !part.partitions.Empty() {
+		part.partitions.Pop()
+	}
+	part.partitionCount = 0
+	part.current = make(map[int]*Partition)
+}
+
 // PartitionCount returns the count of known partitions
 func (part *Partitions) PartitionCount() int {
+	part.RLock()
+	defer part.RUnlock()
 	return part.partitionCount
 }
 
-// GetNodePartitionRange returns the range of partitions active for this node
-func GetNodePartitionRange(cfg *Config, list *memberlist.Memberlist) (int, int) {
-	//get the node position and the node count
-	nodePosition, nodeCount := getNodePosition(list)
-
-	//calculate the range that our node is responsible for
-	step := math.MaxInt64 / nodeCount
-	nodeBottom := nodePosition * step
-	nodeTop := (nodePosition + 1) * step
-	return nodeBottom, nodeTop
+// GetNodeRanges returns the ranges of the keyspace this node serves. These are the ranges it owned on the
+// ring of the members as of the last renewal of its leases, less any it is still waiting on another node
+// to give up the lease on
+func GetNodeRanges(cfg *Config, list *memberlist.Memberlist) []KeyRange {
+	return leasedRanges(cfg)
 }
 
-// GetPartition pops a partition off of the queue for the specified queue
-func (part *Partitions) GetPartition(cfg *Config, queueName string, list *memberlist.Memberlist) (int, int, *Partition, error) {
-	//get the top and bottom for this node
-	nodeBottom, nodeTop := GetNodePartitionRange(cfg, list)
+// GetPartition pops a partition off of the queue for the specified queue, returning the ranges of
+// the keyspace it covers. The ranges this node owns are laid end to end and split evenly between the partitions
+func (part *Partitions) GetPartition(cfg *Config, queueName string, list *memberlist.Memberlist) ([]KeyRange, *Partition, error) {
+	//get the ranges for this node
+	nodeRanges := GetNodeRanges(cfg, list)
 
 	myPartition, partition, totalPartitions, err := part.getPartitionPosition(cfg, queueName)
 	if err != nil && err.Error() != NoPartitions {
 		logrus.Error(err)
 	}
-
-	// calculate my range for the given number
-	nodeRange := nodeTop - nodeBottom
-	nodeStep := nodeRange / totalPartitions
-	partitionBottom := nodeStep*myPartition + nodeBottom
-	partitionTop := nodeStep*(myPartition+1) + nodeBottom
-	return partitionBottom, partitionTop, partition, err
-}
-
-//helper method to get the node position
-func getNodePosition(list *memberlist.Memberlist) (int, int) {
-	// figure out which node we are
-	// grab and sort the node names
-	nodes := list.Members()
-	var nodeNames []string
-	for _, node := range nodes {
-		nodeNames = append(nodeNames, node.Name)
-	}
-	// sort our nodes so that we have a canonical ordering
-	// node failure will cause more dupes
-	sort.Strings(nodeNames)
-	// find our index position
-	nodePosition := sort.SearchStrings(nodeNames, list.LocalNode().Name)
-	nodeCount := len(nodeNames)
-	return nodePosition, nodeCount
+	if totalPartitions == 0 || myPartition < 0 {
+		// Stopped, or none available, there is no range to hand out
+		return nil, partition, err
+	}
+	return sliceRanges(nodeRanges, myPartition, totalPartitions), partition, err
 }
 
 func (part *Partitions) getPartitionPosition(cfg *Config, queueName string) (int, *Partition, int, error) {
@@ -102,6 +109,9 @@ func (part *Partitions) getPartitionPosition(cfg *Config, queueName string) (int
 	//TODO move loging out of the sync operation for better throughput
 	myPartition := -1
 
+	// Held throughout, so the partitions can't be scaled between picking one and counting them
+	part.Lock()
+	defer part.Unlock()
 	var err error
 	poppedPartition, _ := part.partitions.Pop()
 	var workingPartition *Partition
@@ -109,6 +119,7 @@ func (part *Partitions) getPartitionPosition(cfg *Config, queueName string) (int
 		workingPartition = poppedPartition.(*Partition)
 	} else {
 		// this seems a little scary
+		part.recordMiss()
 		return myPartition, workingPartition, part.partitionCount, errors.New(NoPartitions)
 	}
 	visTimeout, _ := cfg.GetVisibilityTimeout(queueName)
@@ -116,23 +127,47 @@ func (part *Partitions) getPartitionPosition(cfg *Config, queueName string) (int
 		myPartition = workingPartition.ID
 	} else {
 		part.partitions.Push(workingPartition, workingPartition.LastUsed.UnixNano())
-		part.Lock()
-		defer part.Unlock()
 		MinPartitions, _ := cfg.GetMinPartitions(queueName)
-		if part.partitionCount < MinPartitions {
-			workingPartition = new(Partition)
-			workingPartition.ID = part.partitionCount
+		if part.partitionCount < MinPartitions && !part.stopped {
+			workingPartition = part.newPartition()
 			myPartition = workingPartition.ID
-			part.partitionCount = part.partitionCount + 1
 		} else {
+			part.recordMiss()
 			err = errors.New(NoPartitions)
 		}
 	}
 	return myPartition, workingPartition, part.partitionCount, err
 }
 
+// recordMiss counts a receiver turned away for want of a partition, for scaling the partitions
+func (part *Partitions) recordMiss() {
+	if !part.stopped {
+		part.misses++
+	}
+}
+
+// RecordReceive notes how full a receive from the partition came back, for scaling the partitions
+func (part *Partitions) RecordReceive(partition *Partition, batchSize int64, messageCount int64) {
+	if batchSize <= 0 {
+		return
+	}
+	part.Lock()
+	defer part.Unlock()
+	part.receives++
+	part.filled += float64(messageCount) / float64(batchSize)
+	if messageCount > 0 {
+		partition.LastFilled = time.Now()
+	}
+}
+
 // PushPartition pushes a partition back onto the queue for the given queue
 func (part *Partitions) PushPartition(cfg *Config, queueName string, partition *Partition, lock bool) {
+	part.RLock()
+	defer part.RUnlock()
+	if part.stopped || part.current[partition.ID] != partition {
+		// Dropped while it was out with a receiver
+		return
+	}
 	if lock {
 		partition.LastUsed = time.Now()
 		part.partitions.Push(partition, partition.LastUsed.UnixNano())
@@ -144,60 +179,92 @@ func (part *Partitions) PushPartition(cfg *Config, queueName string, partition *
 	}
 }
 
+// newPartition makes the partition with the next id, and counts it. The caller pushes it once done with it
+func (part *Partitions) newPartition() *Partition {
+	partition := new(Partition)
+	partition.ID = part.partitionCount
+	partition.LastFilled = time.Now()
+	part.current[partition.ID] = partition
+	part.partitionCount = part.partitionCount + 1
+	return partition
+}
+
 func (part *Partitions) makePartitions(cfg *Config, queueName string, partitionsToMake int) {
-	var initialTime time.Time
-	MinPartitions, _ := cfg.GetMinPartitions(queueName)
-	offset := part.partitionCount
-	for partitionID := offset; partitionID < offset+partitionsToMake; partitionID++ {
-		if MinPartitions > partitionID {
-			partition := new(Partition)
-			partition.ID = partitionID
-			partition.LastUsed = initialTime
-			part.partitions.Push(partition, rand.Int63n(100000))
-			part.partitionCount = part.partitionCount + 1
+	for i := 0; i < partitionsToMake; i++ {
+		// Never used, so available straight away
+		partition := part.newPartition()
+		part.partitions.Push(partition, rand.Int63n(100000))
+	}
+}
+
+// dropPartitions drops the partitions with the highest ids until there are only partitionsToKeep,
+// so the rest still cover the whole of the nodes range between them
+func (part *Partitions) dropPartitions(partitionsToKeep int) {
+	kept := make([]*Partition, 0, partitionsToKeep)
+	for !part.partitions.Empty() {
+		poppedPartition, _ := part.partitions.Pop()
+		if partition := poppedPartition.(*Partition); partition.ID < partitionsToKeep {
+			kept = append(kept, partition)
 		}
 	}
+	for _, partition := range kept {
+		part.partitions.Push(partition, partition.LastUsed.UnixNano())
+	}
+	// Any of the dropped partitions out with a receiver are dropped once they are pushed back
+	for id := partitionsToKeep; id < part.partitionCount; id++ {
+		delete(part.current, id)
+	}
+	part.partitionCount = partitionsToKeep
 }
-func (part *Partitions) syncPartitions(cfg *Config, queueName string) {
 
+// Scale grows or shrinks the partitions, between the queues min and max partitions, based on the load
+// since it was last called. Receivers turned away with NoPartitions from well filled partitions grow
+// them, at most doubling them at a time. Partitions which haven't found a message in max partition age
+// are dropped. It is called on every config sync
+func (part *Partitions) Scale(cfg *Config, queueName string) {
 	part.Lock()
-	MinPartitions, _ := cfg.GetMinPartitions(queueName)
+	defer part.Unlock()
+	if part.stopped {
+		return
+	}
 	minPartitions, _ := cfg.GetMinPartitions(queueName)
+	maxPartitions, _ := cfg.GetMaxPartitions(queueName)
 	maxPartitionAge, _ := cfg.GetMaxPartitionAge(queueName)
-
-	var partsRemoved int
-	for partsRemoved = 0; MinPartitions < part.partitionCount; partsRemoved++ {
-		_, _ = part.partitions.Pop()
+	if maxPartitions < minPartitions {
+		// Can only be stored by versions which didn't validate settings
+		maxPartitions = minPartitions
 	}
-	part.partitionCount = part.partitionCount - partsRemoved
 
-	if part.partitionCount < minPartitions {
-		part.makePartitions(cfg, queueName, minPartitions-part.partitionCount)
-	}
+	misses, receives, filled := part.misses, part.receives, part.filled
+	part.misses, part.receives, part.filled = 0, 0, 0
 
-	// Partition Aging logic
-	// pop a partition
-	var workingPartition *Partition
-	poppedPartition, _ := part.partitions.Pop()
-	if poppedPartition != nil {
-		workingPartition = poppedPartition.(*Partition)
+	target := part.partitionCount
+	if misses > 0 && (receives == 0 || filled/float64(receives) >= AutoscaleFillRatio) {
+		grow := misses
+		if grow > part.partitionCount && part.partitionCount > 0 {
+			grow = part.partitionCount
+		}
+		target += grow
 	} else {
-		// this seems a little scary. we do a similiar thing in getPartitionPosition
-		return
+		// Partition Aging logic
+		for _, partition := range part.current {
+			if time.Since(partition.LastFilled).Seconds() > maxPartitionAge {
+				target--
+			}
+		}
+	}
+	if target > maxPartitions {
+		target = maxPartitions
+	}
+	if target < minPartitions {
+		target = minPartitions
 	}
-	part.partitionCount = part.partitionCount - 1
 
-	// check if the partition is older than the max age ( but not a fresh partition )
-	// if true pop the next partition, continue until this condition
-	for time.Since(workingPartition.LastUsed).Seconds() > maxPartitionAge && part.partitionCount >= minPartitions {
-		poppedPartition, _ = part.partitions.Pop()
-		if poppedPartition != nil {
-			workingPartition = poppedPartition.(*Partition)
-		}
-		part.partitionCount = part.partitionCount - 1
+	if target > part.partitionCount {
+		logrus.Debugf("Growing the partitions of %s from %d to %d", queueName, part.partitionCount, target)
+		part.makePartitions(cfg, queueName, target-part.partitionCount)
+	} else if target < part.partitionCount {
+		logrus.Debugf("Shrinking the partitions of %s from %d to %d", queueName, part.partitionCount, target)
+		part.dropPartitions(target)
 	}
-	//when false push the last popped partition
-	part.partitions.Push(workingPartition, workingPartition.LastUsed.UnixNano())
-	part.partitionCount = part.partitionCount + 1
-	part.Unlock()
 }
@@ -1,6 +1,8 @@
 package app_test
 
 import (
+	"strconv"
+
 	"github.com/Tapjoy/dynamiq/app"
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
@@ -9,11 +11,9 @@ import (
 var _ = Describe("Partition", func() {
 
 	var (
-		partitions        *app.Partitions
-		err               error
-		partitionTopID    int
-		partitionBottomID int
-		partition         *app.Partition
+		partitions      *app.Partitions
+		err             error
+		partitionRanges []app.KeyRange
 	)
 
 	BeforeEach(func() {
@@ -31,19 +31,97 @@ var _ = Describe("Partition", func() {
 	Context("GetPartition", func() {
 		BeforeEach(func() {
 			// Get the partition ids, and any errors
-			partitionBottomID, partitionTopID, partition, err = partitions.GetPartition(cfg, testQueueName, memberList)
-		})
-
-		It("should get a partitionTopId", func() {
-			Expect(partitionTopID).ToNot(BeNil())
+			partitionRanges, _, err = partitions.GetPartition(cfg, testQueueName, memberList)
 		})
 
-		It("should get a partitionBottomId", func() {
-			Expect(partitionBottomID).ToNot(BeNil())
+		It("should get the ranges of the partition", func() {
+			Expect(partitionRanges).ToNot(BeEmpty())
+			for _, partitionRange := range partitionRanges {
+				Expect(partitionRange.Bottom).To(BeNumerically("<", partitionRange.Top))
+			}
 		})
 
 		It("should not get an error", func() {
 			Expect(err).ToNot(HaveOccurred())
 		})
 	})
+
+	Context("Scale", func() {
+		var registers map[string]string
+
+		// Hands out every partition, then turns one more receiver away
+		exhaust := func() []*app.Partition {
+			held := make([]*app.Partition, 0)
+			for {
+				_, partition, err := partitions.GetPartition(cfg, testQueueName, memberList)
+				if err != nil {
+					Expect(err).To(MatchError(app.NoPartitions))
+					return held
+				}
+				held = append(held, partition)
+			}
+		}
+
+		BeforeEach(func() {
+			registers = queues.QueueMap[testQueueName].Config.Registers
+		})
+
+		AfterEach(func() {
+			registers[app.MaxPartitions] = app.DefaultSettings[app.MaxPartitions]
+			registers[app.MaxPartitionAge] = app.DefaultSettings[app.MaxPartitionAge]
+		})
+
+		It("should grow when receivers are turned away from well filled partitions", func() {
+			for _, held := range exhaust() {
+				partitions.RecordReceive(held, 10, 10)
+				partitions.PushPartition(cfg, testQueueName, held, false)
+			}
+			minParts, _ := cfg.GetMinPartitions(testQueueName)
+			partitions.Scale(cfg, testQueueName)
+			Expect(partitions.PartitionCount()).To(Equal(minParts + 1))
+		})
+
+		It("should not grow when receives come back mostly empty", func() {
+			for _, held := range exhaust() {
+				partitions.RecordReceive(held, 10, 1)
+				partitions.PushPartition(cfg, testQueueName, held, false)
+			}
+			minParts, _ := cfg.GetMinPartitions(testQueueName)
+			partitions.Scale(cfg, testQueueName)
+			Expect(partitions.PartitionCount()).To(Equal(minParts))
+		})
+
+		It("should never grow beyond max_partitions", func() {
+			minParts, _ := cfg.GetMinPartitions(testQueueName)
+			registers[app.MaxPartitions] = strconv.Itoa(minParts)
+			exhaust()
+			partitions.Scale(cfg, testQueueName)
+			Expect(partitions.PartitionCount()).To(Equal(minParts))
+		})
+
+		It("should drop partitions which haven't found a message in max_partition_age, down to min_partitions", func() {
+			exhaust()
+			partitions.Scale(cfg, testQueueName)
+			minParts, _ := cfg.GetMinPartitions(testQueueName)
+			Expect(partitions.PartitionCount()).To(Equal(minParts + 1))
+
+			registers[app.MaxPartitionAge] = "0"
+			partitions.Scale(cfg, testQueueName)
+			Expect(partitions.PartitionCount()).To(Equal(minParts))
+		})
+
+		It("should not take back a dropped partition which was out with a receiver", func() {
+			held := exhaust()
+			partitions.Scale(cfg, testQueueName)
+			grown := exhaust()
+			Expect(grown).To(HaveLen(1))
+
+			registers[app.MaxPartitionAge] = "0"
+			partitions.Scale(cfg, testQueueName)
+			for _, partition := range append(held, grown...) {
+				partitions.PushPartition(cfg, testQueueName, partition, false)
+			}
+			Expect(exhaust()).To(HaveLen(partitions.PartitionCount()))
+		})
+	})
 })
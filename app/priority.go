@@ -0,0 +1,101 @@
+package app
+
+import (
+	"crypto/rand"
+	"math"
+	"math/big"
+	"sort"
+	"strconv"
+	"sync/atomic"
+)
+
+// PriorityLevels is the number of priorities a message can be published with
+const PriorityLevels = 10
+
+// MaxPriority is the highest priority a message can be published with
+const MaxPriority = PriorityLevels - 1
+
+// DefaultPriority is the priority of messages published without one
+const DefaultPriority = 0
+
+// PriorityFairShare is how often, in receives of a queue on a node, a receive starts from a rotating
+// priority instead of the highest. It keeps a steady stream of high priority messages from starving the rest
+const PriorityFairShare = 10
+
+// priorityBandSize is the width of the band of the keyspace holding each priority. Priority 0 takes
+// the bottom band and MaxPriority the top
+const priorityBandSize = math.MaxInt64 / PriorityLevels
+
+// priorityBandBottom returns the bottom of the band of the keyspace holding the priority
+func priorityBandBottom(priority int) int64 {
+	return int64(priority) * priorityBandSize
+}
+
+// priorityMessageID returns a random id inside of the band of the keyspace holding the priority
+func priorityMessageID(priority int) string {
+	random, _ := rand.Int(rand.Reader, big.NewInt(priorityBandSize))
+	return strconv.FormatInt(priorityBandBottom(priority)+random.Int64(), 10)
+}
+
+// priorityRange scales a range of the keyspace, as handed out to nodes and partitions, down into the
+// band holding the priority. Every band is split across nodes and partitions the same way, so each
+// partition sees its share of every priority
+func priorityRange(priority int, bottom int, top int) (int, int) {
+	bandBottom := priorityBandBottom(priority)
+	return int(bandBottom + int64(bottom)/PriorityLevels), int(bandBottom + int64(top)/PriorityLevels)
+}
+
+// priorityPosition returns where in the unbanded keyspace the id falls, undoing priorityRange
+func priorityPosition(id int64) int64 {
+	band := id / priorityBandSize
+	if band >= PriorityLevels {
+		// The few ids above the top band belong to it
+		band = MaxPriority
+	}
+	offset := id - priorityBandBottom(int(band))
+	if offset >= math.MaxInt64/PriorityLevels {
+		return math.MaxInt64
+	}
+	return offset * PriorityLevels
+}
+
+// priorityPositions returns the positions of the ids in the unbanded keyspace, in order, so
+// they can be used to approximate the depth of the queue
+func priorityPositions(ids []string) []string {
+	positions := make([]int64, 0, len(ids))
+	for _, id := range ids {
+		parsed, err := strconv.ParseInt(id, 10, 64)
+		if err != nil {
+			continue
+		}
+		positions = append(positions, priorityPosition(parsed))
+	}
+	sort.Sort(int64Slice(positions))
+	formatted := make([]string, len(positions))
+	for i, position := range positions {
+		formatted[i] = strconv.FormatInt(position, 10)
+	}
+	return formatted
+}
+
+// priorityOrder returns the order the priorities should be read in for the next receive. Usually that is
+// highest first, but one in every PriorityFairShare receives starts from a rotating priority instead,
+// working down from there before wrapping around to the highest
+func (queue *Queue) priorityOrder() []int {
+	receive := atomic.AddUint64(&queue.priorityReceives, 1)
+	start := MaxPriority
+	if receive%PriorityFairShare == 0 {
+		start = int((receive / PriorityFairShare) % PriorityLevels)
+	}
+	order := make([]int, 0, PriorityLevels)
+	for i := 0; i < PriorityLevels; i++ {
+		order = append(order, (start-i+PriorityLevels)%PriorityLevels)
+	}
+	return order
+}
+
+type int64Slice []int64
+
+func (s int64Slice) Len() int           { return len(s) }
+func (s int64Slice) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s int64Slice) Less(i, j int) bool { return s[i] < s[j] }
@@ -0,0 +1,60 @@
+package app
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/Tapjoy/dynamiq/app/stats"
+)
+
+// ErrPurgeInProgress represents the condition where a purge is started while another is still running on the queue
+var ErrPurgeInProgress = errors.New("A purge is already in progress for this queue")
+
+// QueuePurgedStatsSuffix is
+const QueuePurgedStatsSuffix = "purged.count"
+
+func recordPurged(c stats.Client, queueName string, numberOfMessages int64) error {
+	key := fmt.Sprintf("%s.%s", queueName, QueuePurgedStatsSuffix)
+	return c.Incr(key, numberOfMessages)
+}
+
+// resetDepth zeroes the depth gauges of the queue, since the messages they counted are being purged
+func resetDepth(c stats.Client, queueName string) error {
+	err := c.SetGauge(fmt.Sprintf("%s.%s", queueName, QueueDepthStatsSuffix), 0)
+	if err != nil {
+		return err
+	}
+	return c.SetGauge(fmt.Sprintf("%s.%s", queueName, QueueDepthAprStatsSuffix), 0)
+}
+
+// Purge starts deleting every message put on the queue before now, in the background, and returns
+// the status of the new purge. Messages put while the purge runs are kept
+func (queue *Queue) Purge(cfg *Config) (JobStatus, error) {
+	recordName := purgeRecordName(queue.Name)
+	status, err := startJob(cfg, recordName, ErrPurgeInProgress)
+	if err != nil {
+		return status, err
+	}
+	resetDepth(cfg.Stats.Client, queue.Name)
+	go func() {
+		purged, err := queue.deleteMessagesBefore(cfg, status.StartedAt, recordName, func(count int) {
+			recordPurged(cfg.Stats.Client, queue.Name, int64(count))
+		})
+		if err != nil {
+			logrus.Error(err)
+		}
+		finishJob(cfg, recordName, status.StartedAt, purged, err)
+		logrus.Debugf("Purged %d messages from %s", purged, queue.Name)
+	}()
+	return status, nil
+}
+
+// PurgeStatus returns the progress of the latest purge of the queue, or false if it has never been purged
+func (queue *Queue) PurgeStatus(cfg *Config) (JobStatus, bool, error) {
+	return fetchJob(cfg, purgeRecordName(queue.Name))
+}
+
+func purgeRecordName(queueName string) string {
+	return fmt.Sprintf("queue_%s_purge", queueName)
+}
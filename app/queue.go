@@ -2,6 +2,7 @@ package app
 
 import (
 	"crypto/rand"
+	"encoding/json"
 	"fmt"
 	"math"
 	"math/big"
@@ -10,9 +11,9 @@ import (
 	"time"
 
 	"github.com/Sirupsen/logrus"
+	"github.com/Tapjoy/dynamiq/app/backend"
 	"github.com/Tapjoy/dynamiq/app/stats"
 	"github.com/hashicorp/memberlist"
-	"github.com/tpjg/goriakpbc"
 )
 
 // Define statistics keys suffixes
@@ -38,17 +39,44 @@ const QueueFillDeltaStatsSuffix = "fill.count"
 // MaxIDSize is
 var MaxIDSize = *big.NewInt(math.MaxInt64)
 
+// MaxReceivePages is the most pages of a partition a single receive will scan looking
+// for messages which are not in flight
+const MaxReceivePages = 10
+
+// MaxPublishBatchSize is the most messages that can be published in a single batch
+const MaxPublishBatchSize = 100
+
 // Queues represents
 type Queues struct {
 	// a container for all queues
 	QueueMap map[string]*Queue
 	// Settings for Queues in general, ie queue list
-	Config *riak.RDtMap
-	// Mutex for protecting rw access to the Config object
+	Config *backend.Map
+	// Mutex for protecting rw access to the Config object and the QueueMap
 	sync.RWMutex
 	// Channels / Timer for syncing the config
 	syncScheduler *time.Ticker
 	syncKiller    chan struct{}
+	// Channels / Timer for reaping expired messages
+	expiryScheduler *time.Ticker
+	expiryKiller    chan struct{}
+	// The last time the config was read from the backend
+	lastSynced time.Time
+}
+
+// VisibilityChange represents a request to change the visibility timeout of one in-flight message
+type VisibilityChange struct {
+	ID                string  `json:"id"`
+	Receipt           string  `json:"receipt"`
+	VisibilityTimeout float64 `json:"visibility_timeout"`
+}
+
+// PutResult represents the outcome of putting one message from a batch, either its id or the error
+type PutResult struct {
+	ID    string `json:"id,omitempty"`
+	Error string `json:"error,omitempty"`
+	// The message was a duplicate, ID holds the original message
+	Duplicate bool `json:"duplicate,omitempty"`
 }
 
 // Queue represents
@@ -59,9 +87,14 @@ type Queue struct {
 	// the partitions of the queue
 	Parts *Partitions
 	// Individual settings for the queue
-	Config *riak.RDtMap
+	Config *backend.Map
 	// Mutex for protecting rw access to the Config object
 	sync.RWMutex
+	// Closed, and replaced, whenever a message is put on this node, to wake long polling receivers
+	arrived     chan struct{}
+	arrivedLock sync.Mutex
+	// Number of receives on this node, to pick which receives start from a lower priority
+	priorityReceives uint64
 }
 
 func recordFillRatio(c stats.Client, queueName string, batchSize int64, messageCount int64) error {
@@ -121,217 +154,591 @@ func (queue *Queue) setQueueDepthApr(c stats.Client, list *memberlist.Memberlist
 
 // Exists checks is the given queue name is already created or not
 func (queues *Queues) Exists(cfg *Config, queueName string) bool {
-	// For now, lets go right to Riak for this
+	// For now, lets go right to the backend for this
 	// Because of the config delay, we don't wanna check the memory values
-	client := cfg.RiakConnection()
+	m, _ := cfg.Backend.FetchMap(QueueConfigName)
 
-	bucket, _ := client.NewBucketType("maps", ConfigurationBucket)
-	m, _ := bucket.FetchMap(QueueConfigName)
-	set := m.AddSet(QueueSetName)
-
-	for _, value := range set.GetValue() {
-		logrus.Debug("Looking for %s, found %s", queueName, string(value[:]))
-		if string(value[:]) == queueName {
+	for _, value := range m.FetchSet(QueueSetName) {
+		logrus.Debugf("Looking for %s, found %s", queueName, value)
+		if value == queueName {
 			return true
 		}
 	}
 	return false
 }
 
-// DeleteQueue deletes the given queue
-func (queues *Queues) DeleteQueue(name string, cfg *Config) bool {
-	client := cfg.RiakConnection()
-
-	bucket, _ := client.NewBucketType("maps", ConfigurationBucket)
-	config, _ := bucket.FetchMap(QueueConfigName)
-	config.FetchSet("queues").Remove([]byte(name))
-	config.Store()
+// Get gets a message from the queue
+func (queue *Queue) Get(cfg *Config, list *memberlist.Memberlist, batchsize int64) ([]backend.Message, error) {
+	// get the top and bottom partitions
+	partRanges, partition, err := queue.Parts.GetPartition(cfg, queue.Name, list)
 
-	bucketConfig, _ := bucket.FetchMap(queueConfigRecordName(name))
-	bucketConfig.Destroy()
+	if err != nil {
+		return nil, err
+	}
+	// Each message carries its own visibility timeout, so there is no need to lock the partition
+	// once we're done with it - return it to the parts heap for the next receiver
+	defer queue.Parts.PushPartition(cfg, queue.Name, partition, false)
+	// Checked against the leases once for the receive, going to the backend for those whose renewal is
+	// late, so a node which lost a lease since its last renewal doesn't hand out messages the new holder
+	// may also hand out
+	fencedRanges := fenceRanges(cfg, partRanges)
+
+	visTimeout, _ := cfg.GetVisibilityTimeout(queue.Name)
+	visibleAt := time.Now().Add(time.Duration(visTimeout * float64(time.Second)))
+
+	messages := make([]backend.Message, 0, batchsize)
+	scannedIds := make([]string, 0, batchsize)
+	// Each priority has its own band of the keyspace, and the partition has a slice of every band.
+	// Fill the batch from the slices in priority order
+	start := partition.nextRange
+	for _, priority := range queue.priorityOrder() {
+		// Bound the number of pages so a partition full of in-flight messages, or made of more ranges
+		// than can be scanned at once, doesn't hold up the receiver
+		pages := 0
+		for i := 0; i < len(partRanges) && pages < MaxReceivePages && int64(len(messages)) < batchsize; i++ {
+			partRange := partRanges[(start+i)%len(partRanges)]
+			bottom, top := priorityRange(priority, partRange.Bottom, partRange.Top)
+			continuation := ""
+			// Page through the slice, skipping anything still in flight, until we fill the batch
+			// or run out of messages
+			for pages < MaxReceivePages && int64(len(messages)) < batchsize {
+				pages++
+				var messageIds []string
+				messageIds, continuation, err = cfg.Backend.RangeScan(queue.Name, bottom, top, uint32(batchsize), continuation)
+				if err != nil {
+					logrus.Error(err)
+					break
+				}
+				scannedIds = append(scannedIds, messageIds...)
+				received := queue.receiveMessages(cfg, messageIds, fencedRanges, batchsize-int64(len(messages)), visibleAt)
+				messages = append(messages, received...)
+				if continuation == "" {
+					break
+				}
+			}
+		}
+	}
+	if len(partRanges) > 0 {
+		// The next receive from the partition starts from the ranges this one may not have reached
+		partition.nextRange = (start + MaxReceivePages) % len(partRanges)
+	}
+	defer queue.setQueueDepthApr(cfg.Stats.Client, list, queue.Name, priorityPositions(scannedIds))
 
-	//return true if queue doesn't exist anymore
-	return !queues.Exists(cfg, name)
+	// We need it as 64 for stats reporting
+	messageCount := int64(len(messages))
+	defer incrementReceiveCount(cfg.Stats.Client, queue.Name, messageCount)
+	defer recordFillRatio(cfg.Stats.Client, queue.Name, batchsize, messageCount)
+	queue.Parts.RecordReceive(partition, batchsize, messageCount)
+	logrus.Debug("Message retrieved ", messageCount)
+	return queue.decompressMessages(cfg, messages), err
 }
 
-// Get gets a message from the queue
-func (queue *Queue) Get(cfg *Config, list *memberlist.Memberlist, batchsize int64) ([]riak.RObject, error) {
-	// grab a riak client
-	client := cfg.RiakConnection()
+// receiveMessages fetches the given ids, of those in the given ranges, and marks up to limit of the ones
+// which aren't already in flight as received, until visibleAt
+func (queue *Queue) receiveMessages(cfg *Config, ids []string, ranges []KeyRange, limit int64, visibleAt time.Time) []backend.Message {
+	held := make([]string, 0, len(ids))
+	for _, id := range ids {
+		if inRanges(ranges, id) {
+			held = append(held, id)
+		}
+	}
+	ids = held
+	fifo, _ := cfg.GetFifo(queue.Name)
+	if fifo {
+		return queue.receiveFifoMessages(cfg, queue.fetchMessages(cfg, ids), ranges, limit, visibleAt)
+	}
+	return queue.recordReceipts(cfg, queue.selectMessages(cfg, queue.fetchMessages(cfg, ids), limit, visibleAt))
+}
 
-	//set the bucket
-	bucket, err := client.NewBucketType("messages", queue.Name)
-	if err != nil {
-		logrus.Error(err)
-		return nil, err
+// selectMessages marks up to limit of the messages which aren't already in flight as received
+func (queue *Queue) selectMessages(cfg *Config, messages []backend.Message, limit int64, visibleAt time.Time) []backend.Message {
+	now := time.Now()
+	candidates := make([]backend.Message, 0, limit)
+	for _, message := range messages {
+		if int64(len(candidates)) == limit {
+			break
+		}
+		if messageInFlight(&message, now) || queue.overReceiveLimit(cfg, &message) {
+			continue
+		}
+		markInFlight(&message, visibleAt)
+		candidates = append(candidates, message)
 	}
+	return candidates
+}
 
-	// get the top and bottom partitions
-	partBottom, partTop, partition, err := queue.Parts.GetPartition(cfg, queue.Name, list)
+// overReceiveLimit returns true if the message has already been received as many times as allowed,
+// without anyone deleting it, and so was moved to the dead letter queue instead of being handed out again
+func (queue *Queue) overReceiveLimit(cfg *Config, message *backend.Message) bool {
+	maxReceiveCount, _ := cfg.GetMaxReceiveCount(queue.Name)
+	return maxReceiveCount > 0 && MessageReceiveCount(message) >= maxReceiveCount && queue.deadLetter(cfg, message)
+}
+
+// recordReceipts stores the in-flight state of the received messages, dropping any which couldn't
+// be stored. The rest keep their order
+func (queue *Queue) recordReceipts(cfg *Config, candidates []backend.Message) []backend.Message {
+	stored := make([]bool, len(candidates))
+	var wg sync.WaitGroup
+	for i := range candidates {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			// The message may have been deleted, split into siblings, or received by someone else since
+			// we read it. Either way we didn't get to record our receipt, so it shouldn't be handed out
+			err := cfg.Backend.UpdateMessageIf(queue.Name, &candidates[i], func(stored *backend.Message) bool {
+				return !messageInFlight(stored, time.Now()) && MessageReceiveCount(stored) == MessageReceiveCount(&candidates[i])-1
+			})
+			if err != nil {
+				logrus.Debug(err)
+				return
+			}
+			stored[i] = true
+		}(i)
+	}
+	wg.Wait()
+	received := make([]backend.Message, 0, len(candidates))
+	for i := range candidates {
+		if stored[i] {
+			received = append(received, candidates[i])
+		}
+	}
+	return received
+}
 
+// Put puts a Message onto the queue, delayed by the queues delay_seconds setting
+func (queue *Queue) Put(cfg *Config, message string) string {
+	uuid, err := queue.Publish(cfg, PublishMessage{Body: message})
 	if err != nil {
-		return nil, err
+		//Actually want to handle this in some other way
+		logrus.Error(err)
+		return ""
 	}
-	//get a list of batchsize message ids
-	messageIds, _, err := bucket.IndexQueryRangePage("id_int", strconv.Itoa(partBottom), strconv.Itoa(partTop), uint32(batchsize), "")
-	defer queue.setQueueDepthApr(cfg.Stats.Client, list, queue.Name, messageIds)
+	return uuid
+}
 
+// PutWithDelay puts a Message onto the queue which won't be delivered until delay seconds from now
+func (queue *Queue) PutWithDelay(cfg *Config, message string, delay float64) string {
+	uuid, err := queue.Publish(cfg, PublishMessage{Body: message, DelaySeconds: &delay})
 	if err != nil {
+		//Actually want to handle this in some other way
 		logrus.Error(err)
+		return ""
 	}
-	// We need it as 64 for stats reporting
-	messageCount := int64(len(messageIds))
+	return uuid
+}
 
-	// return the partition to the parts heap, but only lock it when we have messages
-	if messageCount > 0 {
-		defer queue.Parts.PushPartition(cfg, queue.Name, partition, true)
+// Publish puts a Message onto the queue along with its content type and attributes. Unless the
+// message has its own delay, it is delayed by the queues delay_seconds setting. If the queue
+// deduplicates messages and this is a duplicate, the id of the original message is returned instead
+func (queue *Queue) Publish(cfg *Config, message PublishMessage) (string, error) {
+	uuid, duplicate, err := queue.publish(cfg, message)
+	if err != nil {
+		return "", err
+	}
+	if duplicate {
+		defer recordDeduplicated(cfg.Stats.Client, queue.Name, 1)
 	} else {
-		defer queue.Parts.PushPartition(cfg, queue.Name, partition, false)
+		defer incrementMessageCount(cfg.Stats.Client, queue.Name, 1)
 	}
-	defer incrementReceiveCount(cfg.Stats.Client, queue.Name, messageCount)
-	defer recordFillRatio(cfg.Stats.Client, queue.Name, batchsize, messageCount)
-	logrus.Debug("Message retrieved ", messageCount)
-	return queue.RetrieveMessages(messageIds, cfg), err
+	return uuid, nil
 }
 
-// Put puts a Message onto the queue
-func (queue *Queue) Put(cfg *Config, message string) string {
-	//Grab our bucket
-	client := cfg.RiakConnection()
-	bucket, err := client.NewBucketType("messages", queue.Name)
-	if err == nil {
-		// Prepare the body and compress, if need be
-		var body = []byte(message)
-		var shouldCompress, _ = cfg.GetCompressedMessages(queue.Name)
-		if shouldCompress == true {
-			var compressedBody []byte
-			compressedBody, err = cfg.Compressor.Compress(body)
-			if err != nil {
-				logrus.Error("Error compressing message body")
-				logrus.Error(err)
-			} else {
-				body = compressedBody
+// BatchPut puts multiple Messages onto the queue concurrently, and returns the outcome of each in
+// the order given. On a fifo queue the messages of each group are put one after another, in the
+// order given, so they are delivered in that order
+func (queue *Queue) BatchPut(cfg *Config, messages []PublishMessage) []PutResult {
+	results := make([]PutResult, len(messages))
+	var wg sync.WaitGroup
+	for _, batch := range queue.publishBatches(cfg, messages) {
+		wg.Add(1)
+		go func(batch []int) {
+			defer wg.Done()
+			for _, i := range batch {
+				var err error
+				results[i].ID, results[i].Duplicate, err = queue.publish(cfg, messages[i])
+				if err != nil {
+					logrus.Error(err)
+					results[i].Error = err.Error()
+				}
 			}
+		}(batch)
+	}
+	wg.Wait()
+
+	stored := 0
+	duplicates := 0
+	for _, result := range results {
+		if result.Duplicate {
+			duplicates++
+		} else if result.Error == "" {
+			stored++
 		}
+	}
+	defer incrementMessageCount(cfg.Stats.Client, queue.Name, int64(stored))
+	defer recordDeduplicated(cfg.Stats.Client, queue.Name, int64(duplicates))
+	return results
+}
 
-		//Retrieve a UUID
-		randy, _ := rand.Int(rand.Reader, &MaxIDSize)
-		uuid := randy.String()
+// publishBatches splits the indexes of the messages into batches which can be put concurrently. Each
+// message is a batch of its own, unless the queue is fifo, where each message group is one batch
+func (queue *Queue) publishBatches(cfg *Config, messages []PublishMessage) [][]int {
+	fifo, _ := cfg.GetFifo(queue.Name)
+	batches := make([][]int, 0, len(messages))
+	groups := make(map[string]int)
+	for i, message := range messages {
+		if !fifo {
+			batches = append(batches, []int{i})
+			continue
+		}
+		batch, ok := groups[message.MessageGroupID]
+		if !ok {
+			batch = len(batches)
+			groups[message.MessageGroupID] = batch
+			batches = append(batches, nil)
+		}
+		batches[batch] = append(batches[batch], i)
+	}
+	return batches
+}
 
-		messageObj := bucket.NewObject(uuid)
-		messageObj.Indexes["id_int"] = []string{uuid}
-		// THIS NEEDS TO BE CONFIGURABLE
-		messageObj.ContentType = "application/json"
-		messageObj.Data = body
-		messageObj.Store()
+// publish stores the message, unless it is a duplicate, without recording any stats. Returns the
+// id of the message, and whether it was a duplicate of an earlier one
+func (queue *Queue) publish(cfg *Config, message PublishMessage) (string, bool, error) {
+	meta, err := queue.publishMeta(cfg, message)
+	if err != nil {
+		return "", false, err
+	}
+	deduplicationID := queue.deduplicationID(cfg, message)
+	if deduplicationID == "" {
+		uuid, err := queue.storeMessage(cfg, []byte(message.Body), message.contentType(), meta)
+		return uuid, false, err
+	}
+	// Claim the deduplication id first, and only store the message if the claim is ours
+	uuid, err := queue.newMessageID(cfg, meta)
+	if err != nil {
+		return "", false, err
+	}
+	if original, duplicate := queue.reserveDeduplication(cfg, deduplicationID, uuid); duplicate {
+		return original, true, nil
+	}
+	err = queue.writeMessage(cfg, uuid, []byte(message.Body), message.contentType(), meta)
+	if err != nil {
+		queue.releaseDeduplication(cfg, deduplicationID, uuid)
+		return "", false, err
+	}
+	return uuid, false, nil
+}
 
-		defer incrementMessageCount(cfg.Stats.Client, queue.Name, 1)
-		return uuid
+// publishMeta validates the message and returns the metadata to store it with
+func (queue *Queue) publishMeta(cfg *Config, message PublishMessage) (map[string]string, error) {
+	err := message.Validate()
+	if err != nil {
+		return nil, err
+	}
+	var delay float64
+	if message.DelaySeconds != nil {
+		delay = *message.DelaySeconds
+	} else {
+		delay, _ = cfg.GetDelaySeconds(queue.Name)
+	}
+	meta := delayMeta(delay)
+	fifo, _ := cfg.GetFifo(queue.Name)
+	if fifo {
+		if message.MessageGroupID == "" {
+			return nil, ErrMissingMessageGroup
+		}
+		meta[MessageGroupMeta] = message.MessageGroupID
+	} else {
+		// Messages in a fifo group are delivered in the order they were published, whatever their priority
+		priority := DefaultPriority
+		if message.Priority != nil {
+			priority = *message.Priority
+		}
+		meta[PriorityMeta] = strconv.Itoa(priority)
 	}
-	//Actually want to handle this in some other way
-	return ""
+	if len(message.Attributes) > 0 {
+		encoded, err := json.Marshal(message.Attributes)
+		if err != nil {
+			return nil, err
+		}
+		meta[AttributesMeta] = string(encoded)
+	}
+	return meta, nil
 }
 
-// Delete deletes a Message from the queue
-func (queue *Queue) Delete(cfg *Config, id string) bool {
-	client := cfg.RiakConnection()
-	bucket, err := client.NewBucketType("messages", queue.Name)
-	if err == nil {
-		err = bucket.Delete(id)
-		if err == nil {
-			defer decrementMessageCount(cfg.Stats.Client, queue.Name, 1)
-			return true
+// putMessage stores the body, along with any metadata, under a new id
+func (queue *Queue) putMessage(cfg *Config, body []byte, contentType string, meta map[string]string) (string, error) {
+	uuid, err := queue.storeMessage(cfg, body, contentType, meta)
+	if err != nil {
+		return "", err
+	}
+	defer incrementMessageCount(cfg.Stats.Client, queue.Name, 1)
+	return uuid, nil
+}
+
+// storeMessage writes the message to the backend under a new id, without recording any stats
+func (queue *Queue) storeMessage(cfg *Config, body []byte, contentType string, meta map[string]string) (string, error) {
+	uuid, err := queue.newMessageID(cfg, meta)
+	if err != nil {
+		return "", err
+	}
+	err = queue.writeMessage(cfg, uuid, body, contentType, meta)
+	if err != nil {
+		return "", err
+	}
+	return uuid, nil
+}
+
+// writeMessage writes the message to the backend under the given id, without recording any stats
+func (queue *Queue) writeMessage(cfg *Config, uuid string, body []byte, contentType string, meta map[string]string) error {
+	// Prepare the body and compress, if need be
+	var shouldCompress, _ = cfg.GetCompressedMessages(queue.Name)
+	if shouldCompress == true {
+		compressedBody, err := cfg.Compressor.Compress(body)
+		if err != nil {
+			logrus.Error("Error compressing message body")
+			logrus.Error(err)
+		} else {
+			body = compressedBody
 		}
 	}
 
+	// Keep the original enqueue time for messages moving between queues, so they still expire on time
+	if meta == nil {
+		meta = make(map[string]string)
+	}
+	if _, ok := meta[EnqueuedAtMeta]; !ok {
+		meta[EnqueuedAtMeta] = strconv.FormatInt(time.Now().UnixNano(), 10)
+	}
+
+	messageObj := &backend.Message{
+		Key:         uuid,
+		ContentType: contentType,
+		Data:        body,
+		Meta:        meta,
+	}
+	err := cfg.Backend.PutMessage(queue.Name, messageObj)
+	if err != nil {
+		return err
+	}
+	queue.notifyArrival()
+	return nil
+}
+
+// newMessageID returns a new id for a message stored on the queue with the given metadata
+func (queue *Queue) newMessageID(cfg *Config, meta map[string]string) (string, error) {
+	if group, ok := meta[MessageGroupMeta]; ok {
+		// Keep the group together, so it can be read back in order
+		return queue.fifoMessageID(cfg, group)
+	}
+	if priority, ok := meta[PriorityMeta]; ok {
+		// Place it in the band of the keyspace for its priority, so it can be read before lower priorities
+		parsed, _ := strconv.Atoi(priority)
+		return priorityMessageID(parsed), nil
+	}
+	randy, _ := rand.Int(rand.Reader, &MaxIDSize)
+	return randy.String(), nil
+}
+
+// delayMeta returns the metadata for a message put with the given delay. A delayed message is stored as
+// if it were already in flight, so it is skipped by Get until its delivery time, regardless of which
+// partition it lands in
+func delayMeta(delay float64) map[string]string {
+	meta := make(map[string]string)
+	if delay > 0 {
+		meta[VisibleAtMeta] = strconv.FormatInt(time.Now().Add(time.Duration(delay*float64(time.Second))).UnixNano(), 10)
+	}
+	return meta
+}
+
+// Delete deletes a Message from the queue, as long as the receipt handle is the one handed out the last
+// time it was received. Returns false if the message doesn't exist
+func (queue *Queue) Delete(cfg *Config, id string, receipt string) (bool, error) {
+	deleted, err := queue.deleteMessage(cfg, id, receipt)
+	if deleted {
+		defer decrementMessageCount(cfg.Stats.Client, queue.Name, 1)
+	}
+	return deleted, err
+}
+
+// deleteMessage deletes the message if it holds the receipt handle, without recording any stats
+func (queue *Queue) deleteMessage(cfg *Config, id string, receipt string) (bool, error) {
+	if receipt == "" {
+		return false, ErrMissingReceipt
+	}
+	// Checked as part of the delete, so a consumer whose message was received again since can't delete it
+	err := cfg.Backend.DeleteMessageIf(queue.Name, id, func(stored *backend.Message) bool {
+		return MessageReceipt(stored) == receipt
+	})
+	switch err {
+	case nil:
+		return true, nil
+	case backend.ErrNotFound:
+		return false, nil
+	case backend.ErrConditionFailed:
+		return false, ErrInvalidReceipt
+	}
+
 	// if we got here we're borked
 	// TODO stats cleanup? Possibility that this gets us out of sync
 	logrus.Error(err)
-	return false
+	return false, err
 }
 
-// BatchDelete deletes multiple messages at once
-func (queue *Queue) BatchDelete(cfg *Config, ids []string) (int, error) {
-	client := cfg.RiakConnection()
-	bucket, err := client.NewBucketType("messages", queue.Name)
-	errors := 0
-	if err == nil {
-		for _, id := range ids {
-			err = bucket.Delete(id)
+// CheckReceipt verifies the receipt handle matches the one handed out the last time the
+// message was received
+func (queue *Queue) CheckReceipt(cfg *Config, id string, receipt string) error {
+	message, err := cfg.Backend.GetMessage(queue.Name, id)
+	if err != nil {
+		return err
+	}
+	if MessageReceipt(message) != receipt {
+		return ErrInvalidReceipt
+	}
+	return nil
+}
+
+// ChangeVisibility sets how many seconds from now an in-flight message stays invisible. A timeout
+// of 0 makes the message available to be received again immediately
+func (queue *Queue) ChangeVisibility(cfg *Config, id string, receipt string, timeout float64) error {
+	if timeout < 0 {
+		return ErrInvalidVisibilityTimeout
+	}
+	message, err := cfg.Backend.GetMessage(queue.Name, id)
+	if err != nil {
+		return err
+	}
+	if MessageReceipt(message) != receipt {
+		return ErrInvalidReceipt
+	}
+	now := time.Now()
+	// Delayed messages are invisible too, but they haven't been received yet
+	if MessageReceipt(message) == "" || !messageInFlight(message, now) {
+		return ErrMessageNotInFlight
+	}
+	setVisibleAt(message, now.Add(time.Duration(timeout*float64(time.Second))))
+	// The message may have timed out and been received by someone else since we read it
+	err = cfg.Backend.UpdateMessageIf(queue.Name, message, func(stored *backend.Message) bool {
+		return MessageReceipt(stored) == receipt
+	})
+	if err == backend.ErrConditionFailed {
+		return ErrInvalidReceipt
+	}
+	if err == nil && timeout == 0 {
+		// The message is available again right away
+		queue.notifyArrival()
+	}
+	return err
+}
+
+// BatchChangeVisibility changes the visibility of multiple messages at once, returning the
+// error for each message which could not be changed, keyed by id
+func (queue *Queue) BatchChangeVisibility(cfg *Config, changes []VisibilityChange) map[string]error {
+	var wg sync.WaitGroup
+	var lock sync.Mutex
+	errors := make(map[string]error)
+	for _, change := range changes {
+		wg.Add(1)
+		go func(change VisibilityChange) {
+			defer wg.Done()
+			err := queue.ChangeVisibility(cfg, change.ID, change.Receipt, change.VisibilityTimeout)
 			if err != nil {
-				logrus.Error(err)
-				errors++
+				lock.Lock()
+				errors[change.ID] = err
+				lock.Unlock()
 			}
+		}(change)
+	}
+	wg.Wait()
+	return errors
+}
+
+// BatchDelete deletes multiple messages at once, each only if it holds the receipt handle at the same
+// position in receipts. Returns how many were not deleted, whether they were missing or the receipt
+// was wrong, along with the last error
+func (queue *Queue) BatchDelete(cfg *Config, ids []string, receipts []string) (int, error) {
+	if len(receipts) != len(ids) {
+		return len(ids), ErrMissingReceipt
+	}
+	var err error
+	errors := 0
+	for i, id := range ids {
+		deleted, deleteErr := queue.deleteMessage(cfg, id, receipts[i])
+		if deleteErr != nil {
+			err = deleteErr
+		}
+		if !deleted {
+			errors++
 		}
-		// Don't count deletes that failed
-		defer decrementMessageCount(cfg.Stats.Client, queue.Name, int64(len(ids)-errors))
-	} else {
-		// if we got here we're borked
-		// TODO stats cleanup? Possibility that this gets us out of sync
-		logrus.Error(err)
 	}
+	// Don't count deletes that failed
+	defer decrementMessageCount(cfg.Stats.Client, queue.Name, int64(len(ids)-errors))
 	return errors, err
 }
 
-// RetrieveMessages takes a list of message ids and pulls the actual data from Riak
-func (queue *Queue) RetrieveMessages(ids []string, cfg *Config) []riak.RObject {
-	var rObjectArrayChan = make(chan riak.RObject, len(ids))
-	var rKeys = make(chan string, len(ids))
+// RetrieveMessages takes a list of message ids and pulls the actual data from the backend
+func (queue *Queue) RetrieveMessages(ids []string, cfg *Config) []backend.Message {
+	return queue.decompressMessages(cfg, queue.fetchMessages(cfg, ids))
+}
+
+// fetchMessages pulls the stored messages from the backend, read repairing any conflicts
+func (queue *Queue) fetchMessages(cfg *Config, ids []string) []backend.Message {
+	var messageArrayChan = make(chan backend.Message, len(ids))
+	var messageKeys = make(chan string, len(ids))
 
 	start := time.Now()
-	// We might need to decompress the data
-	var decompressMessages, _ = cfg.GetCompressedMessages(queue.Name)
 	// foreach message id we have
 	for i := 0; i < len(ids); i++ {
 		// Kick off a go routine
 		go func() {
-			var riakKey string
-			client := cfg.RiakConnection()
-			bucket, _ := client.NewBucketType("messages", queue.Name)
-			// Pop a key off the rKeys channel
-			riakKey = <-rKeys
-			rObject, err := bucket.Get(riakKey)
+			// Pop a key off the messageKeys channel
+			messageKey := <-messageKeys
+			message, err := cfg.Backend.GetMessage(queue.Name, messageKey)
 			if err != nil {
 				// This is likely an object not found error, which we get from dupes as partitions resize while
 				// messages are being deleted (happens on new queues, or under any condition triggering a resize)
 				// Thats why it's debug, not error - it's expected in certain conditions, based on how the underlying
 				// library works
 				logrus.Debug(err)
-				// If we didn't get an error, push the riak object into the objectarray channel
-			}
-			if decompressMessages == true {
-				var data, _ = cfg.Compressor.Decompress(rObject.Data)
-				rObject.Data = data
+				// Push an empty message so the reader below still gets one result per id
+				messageArrayChan <- backend.Message{Key: messageKey}
+				return
 			}
-			rObjectArrayChan <- *rObject
+			messageArrayChan <- *message
 		}()
-		// Push the id into the rKeys channel
-		rKeys <- ids[i]
+		// Push the id into the messageKeys channel
+		messageKeys <- ids[i]
 	}
-	returnVals := make([]riak.RObject, 0)
+	returnVals := make([]backend.Message, 0)
 
 	// TODO find a better mechanism than 2 loops?
 	for i := 0; i < len(ids); i++ {
 		// While the above go-rountes are running, just start popping off the channel as available
-		var rObject = <-rObjectArrayChan
+		var message = <-messageArrayChan
 		//If the key isn't blank, we've got a meaningful object to deal with
-		if len(rObject.Data) > 0 {
-			returnVals = append(returnVals, rObject)
+		if len(message.Data) > 0 {
+			returnVals = append(returnVals, message)
 		}
 		// In the event of a key conflict ( due to multiple messages receiving the same id from Random )
 		// we need to Read Repair the object into multiple independent messages
 		// the following code reads any siblings, and re-puts them onto the queue
 		// then deletes the conflicted object
-		if rObject.Conflict() {
-			for _, sibling := range rObject.Siblings {
+		if message.Conflict() {
+			for _, sibling := range message.Siblings {
 				if len(sibling.Data) > 0 {
-					queue.Put(cfg, string(sibling.Data))
+					// Each sibling is already compressed, if the queue compresses messages, so undo that before
+					// putting it back
+					body := queue.decompressMessages(cfg, []backend.Message{sibling})[0].Data
+					_, err := queue.putMessage(cfg, body, sibling.ContentType, movedMeta(&sibling))
+					if err != nil {
+						logrus.Error(err)
+					}
 				} else {
 					logrus.Debugf("sibling had no data")
 				}
 			}
 			// delete the object
-			err := rObject.Destroy()
+			err := cfg.Backend.DeleteMessage(queue.Name, message.Key)
 			if err != nil {
 				logrus.Error(err)
 			}
@@ -343,44 +750,39 @@ func (queue *Queue) RetrieveMessages(ids []string, cfg *Config) []riak.RObject {
 	return returnVals
 }
 
-func (queues *Queues) syncConfig(cfg *Config) {
-	logrus.Debug("syncing Queue config with Riak")
-	client := cfg.RiakConnection()
-	bucket, err := client.NewBucketType("maps", ConfigurationBucket)
-	if err != nil {
-		// This is likely caused by a network blip against the riak node, or the node being down
-		// In lieu of hard-failing the service, which can recover once riak comes back, we'll simply
-		// skip this iteration of the config sync, and try again at the next interval
-		logrus.Error("There was an error attempting to read the from the configuration bucket")
-		logrus.Error(err)
-		return
+// decompressMessages decompresses the message bodies, if the queue is using compression
+func (queue *Queue) decompressMessages(cfg *Config, messages []backend.Message) []backend.Message {
+	var decompressMessages, _ = cfg.GetCompressedMessages(queue.Name)
+	if decompressMessages == true {
+		for i := range messages {
+			var data, _ = cfg.Compressor.Decompress(messages[i].Data)
+			messages[i].Data = data
+		}
 	}
+	return messages
+}
 
-	queuesConfig, err := bucket.FetchMap(QueueConfigName)
+func (queues *Queues) syncConfig(cfg *Config) {
+	logrus.Debug("syncing Queue config with the backend")
+	queuesConfig, err := cfg.Backend.FetchMap(QueueConfigName)
 	if err != nil {
-		if err.Error() == "Object not found" {
+		if err == backend.ErrNotFound {
 			// This means there are no queues yet
 			// We don't need to log this, and we don't need to get held up on it.
 		} else {
-			// This is likely caused by a network blip against the riak node, or the node being down
-			// In lieu of hard-failing the service, which can recover once riak comes back, we'll simply
+			// This is likely caused by a network blip against the backend, or the node being down
+			// In lieu of hard-failing the service, which can recover once the backend comes back, we'll simply
 			// skip this iteration of the config sync, and try again at the next interval
-			logrus.Error("There was an error attempting to read from the queue configuration map in the configuration bucket")
+			logrus.Error("There was an error attempting to read from the queue configuration map")
 			logrus.Error(err)
 			return
 		}
 	}
 	queues.updateConfig(queuesConfig)
+	queues.markSynced()
 
 	//iterate the map and add or remove topics that need to be destroyed
-	queueSet := queues.getConfig().AddSet(QueueSetName)
-
-	if queueSet == nil {
-		//bail if there aren't any queues
-		//but not before sleeping
-		return
-	}
-	queueSlice := queueSet.GetValue()
+	queueSlice := queues.getConfig().FetchSet(QueueSetName)
 	if queueSlice == nil {
 		//bail if there aren't any queues
 		//but not before sleeping
@@ -388,39 +790,64 @@ func (queues *Queues) syncConfig(cfg *Config) {
 	}
 
 	//Is there a better way to do this?
-	//iterate over the queues in riak and add the missing ones
+	//iterate over the queues in the backend and add the missing ones
 	queuesToKeep := make(map[string]bool)
-	for _, queue := range queueSlice {
-		queueName := string(queue)
+	for _, queueName := range queueSlice {
 		var present bool
-		_, present = queues.QueueMap[queueName]
+		_, present = queues.getQueue(queueName)
 		if present != true {
-			initQueueFromRiak(cfg, queueName)
+			initQueueFromBackend(cfg, queueName)
 		}
 		queuesToKeep[queueName] = true
 	}
 
-	//iterate over the topics in topics.TopicMap and delete the ones no longer used
-	topics := cfg.Topics
-	for queue := range queues.QueueMap {
+	//iterate over the queues in queues.QueueMap and delete the ones no longer used
+	for _, queue := range queues.queueList() {
 		var present bool
-		_, present = queuesToKeep[queue]
+		_, present = queuesToKeep[queue.Name]
 		if present != true {
-			for topic := range topics.TopicMap {
-				topicQueueList := topics.TopicMap[topic].ListQueues()
-				for _, topicQueue := range topicQueueList {
-					if topicQueue == string(queue) {
-						topics.TopicMap[topic].DeleteQueue(cfg, string(queue))
-					}
+			queues.removeQueue(cfg, queue.Name)
+		}
+	}
+
+	//sync all queues with the backend
+	for _, queue := range queues.queueList() {
+		queue.syncConfig(cfg)
+	}
+}
+
+// removeQueue drops a queue deleted elsewhere from this node, stopping its partitions. The node which
+// deleted it already unsubscribed it from its topics in the backend, so the topics known here are only
+// refreshed from there
+func (queues *Queues) removeQueue(cfg *Config, queueName string) {
+	queue, present := queues.dropQueue(queueName)
+	if !present {
+		return
+	}
+	queue.Parts.Stop()
+	if topics := cfg.Topics; topics != nil {
+		for _, topic := range topics.topicList() {
+			for _, topicQueue := range topic.ListQueues() {
+				if topicQueue == queueName {
+					topic.syncConfig()
 				}
 			}
-			delete(queues.QueueMap, queue)
 		}
 	}
+}
 
-	//sync all topics with riak
-	for _, queue := range queues.QueueMap {
-		queue.syncConfig(cfg)
+// refreshQueue brings the named queue on this node up to date with the backend, adding or
+// removing it if it was created or deleted elsewhere
+func (queues *Queues) refreshQueue(cfg *Config, queueName string) {
+	exists := queues.Exists(cfg, queueName)
+	queue, present := queues.getQueue(queueName)
+	switch {
+	case exists && present:
+		queue.refreshConfig(cfg)
+	case exists:
+		initQueueFromBackend(cfg, queueName)
+	case present:
+		queues.removeQueue(cfg, queueName)
 	}
 }
 
@@ -445,11 +872,18 @@ func (queues *Queues) scheduleSync(cfg *Config) {
 	}(cfg)
 }
 
-func initQueueFromRiak(cfg *Config, queueName string) {
-	client := cfg.RiakConnection()
+// stopSync stops syncing the queues config with the backend, and reaping expired messages
+func (queues *Queues) stopSync() {
+	if queues.syncKiller != nil {
+		close(queues.syncKiller)
+	}
+	if queues.expiryKiller != nil {
+		close(queues.expiryKiller)
+	}
+}
 
-	bucket, _ := client.NewBucketType("maps", ConfigurationBucket)
-	config, _ := bucket.FetchMap(queueConfigRecordName(queueName))
+func initQueueFromBackend(cfg *Config, queueName string) {
+	config, _ := cfg.Backend.FetchMap(queueConfigRecordName(queueName))
 
 	queue := Queue{
 		Name:   queueName,
@@ -457,41 +891,95 @@ func initQueueFromRiak(cfg *Config, queueName string) {
 		Config: config,
 	}
 
-	// This is adding a new member to the collection, it shouldn't need a lock?
-	// TODO Keep an eye on this for emergent issues
-	cfg.Queues.QueueMap[queueName] = &queue
+	// The config sync and the refresh of an announced change may both get here for the same queue,
+	// whichever is first is kept
+	cfg.Queues.addQueue(&queue)
 }
 
 func (queue *Queue) syncConfig(cfg *Config) {
-	//refresh the queue RDtMap
-	client := cfg.RiakConnection()
-	bucket, _ := client.NewBucketType("maps", ConfigurationBucket)
+	queue.refreshConfig(cfg)
+	queue.Parts.Scale(cfg, queue.Name)
+}
 
-	rCfg, _ := bucket.FetchMap(queueConfigRecordName(queue.Name))
+// refreshConfig refreshes the queue config map from the backend
+func (queue *Queue) refreshConfig(cfg *Config) {
+	rCfg, _ := cfg.Backend.FetchMap(queueConfigRecordName(queue.Name))
 	queue.updateConfig(rCfg)
-	queue.Parts.syncPartitions(cfg, queue.Name)
 }
 
-func (queue *Queue) updateConfig(rCfg *riak.RDtMap) {
+func (queue *Queue) updateConfig(rCfg *backend.Map) {
 	queue.Lock()
 	defer queue.Unlock()
 	queue.Config = rCfg
 }
 
-func (queue *Queue) getConfig() *riak.RDtMap {
+func (queue *Queue) getConfig() *backend.Map {
 	queue.RLock()
 	defer queue.RUnlock()
 	return queue.Config
 }
 
-func (queues *Queues) updateConfig(rCfg *riak.RDtMap) {
+func (queues *Queues) updateConfig(rCfg *backend.Map) {
 	queues.Lock()
 	defer queues.Unlock()
 	queues.Config = rCfg
 }
 
-func (queues *Queues) getConfig() *riak.RDtMap {
+func (queues *Queues) getConfig() *backend.Map {
 	queues.RLock()
 	defer queues.RUnlock()
 	return queues.Config
 }
+
+// getQueue returns the named queue, if it is known to this node
+func (queues *Queues) getQueue(name string) (*Queue, bool) {
+	queues.RLock()
+	defer queues.RUnlock()
+	queue, present := queues.QueueMap[name]
+	return queue, present
+}
+
+// addQueue makes the queue known to this node, unless one with the same name already is. Returns the
+// queue known to this node by that name
+func (queues *Queues) addQueue(queue *Queue) *Queue {
+	queues.Lock()
+	defer queues.Unlock()
+	if known, present := queues.QueueMap[queue.Name]; present {
+		return known
+	}
+	queues.QueueMap[queue.Name] = queue
+	return queue
+}
+
+// dropQueue forgets the named queue on this node, returning it if it was known
+func (queues *Queues) dropQueue(name string) (*Queue, bool) {
+	queues.Lock()
+	defer queues.Unlock()
+	queue, present := queues.QueueMap[name]
+	delete(queues.QueueMap, name)
+	return queue, present
+}
+
+// queueList returns the queues known to this node, safe to range over while queues come and go
+func (queues *Queues) queueList() []*Queue {
+	queues.RLock()
+	defer queues.RUnlock()
+	list := make([]*Queue, 0, len(queues.QueueMap))
+	for _, queue := range queues.QueueMap {
+		list = append(list, queue)
+	}
+	return list
+}
+
+func (queues *Queues) markSynced() {
+	queues.Lock()
+	defer queues.Unlock()
+	queues.lastSynced = time.Now()
+}
+
+// LastSynced returns the last time the queues config was read from the backend, or the zero time if it never was
+func (queues *Queues) LastSynced() time.Time {
+	queues.RLock()
+	defer queues.RUnlock()
+	return queues.lastSynced
+}
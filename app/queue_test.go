@@ -0,0 +1,1030 @@
+package app_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"math/rand"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Tapjoy/dynamiq/app"
+	"github.com/Tapjoy/dynamiq/app/backend"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// slowBackend takes a while to hand back each message, map or record it reads, so concurrent callers all read
+// before any of them writes, and then writes messages after a random pause, so their writes interleave
+type slowBackend struct {
+	backend.Backend
+}
+
+func (b slowBackend) GetMessage(queueName string, key string) (*backend.Message, error) {
+	defer time.Sleep(10 * time.Millisecond)
+	return b.Backend.GetMessage(queueName, key)
+}
+
+func (b slowBackend) UpdateMessageIf(queueName string, message *backend.Message, condition func(stored *backend.Message) bool) error {
+	time.Sleep(time.Duration(rand.Intn(5)) * time.Millisecond)
+	return b.Backend.UpdateMessageIf(queueName, message, condition)
+}
+
+func (b slowBackend) FetchRecord(key string) (*backend.Map, error) {
+	defer time.Sleep(10 * time.Millisecond)
+	return b.Backend.FetchRecord(key)
+}
+
+func (b slowBackend) FetchMap(key string) (*backend.Map, error) {
+	defer time.Sleep(10 * time.Millisecond)
+	return b.Backend.FetchMap(key)
+}
+
+// receivingBackend has another receiver take each message just before it is conditionally deleted
+type receivingBackend struct {
+	backend.Backend
+}
+
+func (b receivingBackend) DeleteMessageIf(queueName string, key string, condition func(stored *backend.Message) bool) error {
+	message, err := b.Backend.GetMessage(queueName, key)
+	if err == nil {
+		message.Meta[app.ReceiptMeta] = "other receipt"
+		message.Meta[app.ReceiveCountMeta] = strconv.Itoa(app.MessageReceiveCount(message) + 1)
+		message.Meta[app.VisibleAtMeta] = strconv.FormatInt(time.Now().Add(time.Minute).UnixNano(), 10)
+		b.Backend.UpdateMessage(queueName, message)
+	}
+	return b.Backend.DeleteMessageIf(queueName, key, condition)
+}
+
+// gatedBackend holds every range scan until the gate is closed, so background jobs can be paused
+type gatedBackend struct {
+	backend.Backend
+	gate chan struct{}
+}
+
+func (b gatedBackend) RangeScan(queueName string, bottom int, top int, limit uint32, continuation string) ([]string, string, error) {
+	<-b.gate
+	return b.Backend.RangeScan(queueName, bottom, top, limit, continuation)
+}
+
+var _ = Describe("Queue", func() {
+
+	var (
+		queue      *app.Queue
+		queueName  string
+		queueCount int
+	)
+
+	BeforeEach(func() {
+		// Each spec gets a fresh queue, so partition locks don't leak between them
+		queueCount++
+		queueName = fmt.Sprintf("queue_spec_%d", queueCount)
+		Expect(cfg.InitializeQueue(queueName)).To(Succeed())
+		queue = queues.QueueMap[queueName]
+	})
+
+	AfterEach(func() {
+		queues.DeleteQueue(queueName, cfg)
+		delete(queues.QueueMap, queueName)
+	})
+
+	Context("Put", func() {
+		It("should return the id of the stored message", func() {
+			id := queue.Put(cfg, "hello")
+			Expect(id).ToNot(BeEmpty())
+
+			messages := queue.RetrieveMessages([]string{id}, cfg)
+			Expect(messages).To(HaveLen(1))
+			Expect(string(messages[0].Data)).To(Equal("hello"))
+		})
+	})
+
+	Context("Publish", func() {
+		It("should store the content type and attributes alongside the body", func() {
+			id, err := queue.Publish(cfg, app.PublishMessage{
+				Body:        "<hello/>",
+				ContentType: "application/xml",
+				Attributes: map[string]app.MessageAttribute{
+					"trace_id": {Type: app.StringAttribute, Value: "abc123"},
+					"attempt":  {Type: app.NumberAttribute, Value: "2"},
+					"checksum": {Type: app.BinaryAttribute, Value: "3q2+7w=="},
+				},
+			})
+			Expect(err).ToNot(HaveOccurred())
+
+			messages := queue.RetrieveMessages([]string{id}, cfg)
+			Expect(messages).To(HaveLen(1))
+			Expect(messages[0].ContentType).To(Equal("application/xml"))
+			attributes := app.MessageAttributes(&messages[0])
+			Expect(attributes).To(HaveLen(3))
+			Expect(attributes["trace_id"]).To(Equal(app.MessageAttribute{Type: app.StringAttribute, Value: "abc123"}))
+		})
+
+		It("should default the content type", func() {
+			id, err := queue.Publish(cfg, app.PublishMessage{Body: "{}"})
+			Expect(err).ToNot(HaveOccurred())
+
+			messages := queue.RetrieveMessages([]string{id}, cfg)
+			Expect(messages[0].ContentType).To(Equal(app.DefaultContentType))
+			Expect(app.MessageAttributes(&messages[0])).To(BeEmpty())
+		})
+
+		It("should read batch entries given as either a body or a full message", func() {
+			var messages []app.PublishMessage
+			err := json.Unmarshal([]byte(`["one", {"body": "two", "content_type": "text/plain"}]`), &messages)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(messages).To(Equal([]app.PublishMessage{{Body: "one"}, {Body: "two", ContentType: "text/plain"}}))
+		})
+
+		It("should reject attributes whose value doesn't match their type", func() {
+			for _, attribute := range []app.MessageAttribute{
+				{Type: app.NumberAttribute, Value: "many"},
+				{Type: app.BinaryAttribute, Value: "not base64!"},
+				{Type: "Date", Value: "today"},
+			} {
+				_, err := queue.Publish(cfg, app.PublishMessage{Body: "{}", Attributes: map[string]app.MessageAttribute{"bad": attribute}})
+				Expect(err).To(Equal(app.ErrInvalidAttribute))
+			}
+		})
+	})
+
+	Context("Deduplication", func() {
+		BeforeEach(func() {
+			queue.Config.Registers[app.DeduplicationWindow] = "60"
+		})
+
+		It("should return the original id for a message with the same deduplication id", func() {
+			first, err := queue.Publish(cfg, app.PublishMessage{Body: "one", DeduplicationID: "order-1"})
+			Expect(err).ToNot(HaveOccurred())
+			second, err := queue.Publish(cfg, app.PublishMessage{Body: "two", DeduplicationID: "order-1"})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(second).To(Equal(first))
+
+			messages, _ := queue.Get(cfg, memberList, 10)
+			Expect(messages).To(HaveLen(1))
+			Expect(string(messages[0].Data)).To(Equal("one"))
+		})
+
+		It("should only deduplicate on the body when content based deduplication is on", func() {
+			first, _ := queue.Publish(cfg, app.PublishMessage{Body: "same"})
+			second, _ := queue.Publish(cfg, app.PublishMessage{Body: "same"})
+			Expect(second).ToNot(Equal(first))
+
+			queue.Config.Registers[app.ContentBasedDeduplication] = "true"
+			third, _ := queue.Publish(cfg, app.PublishMessage{Body: "other"})
+			fourth, _ := queue.Publish(cfg, app.PublishMessage{Body: "other"})
+			Expect(fourth).To(Equal(third))
+		})
+
+		It("should flag duplicates within a batch put", func() {
+			first, _ := queue.Publish(cfg, app.PublishMessage{Body: "one", DeduplicationID: "order-1"})
+			results := queue.BatchPut(cfg, []app.PublishMessage{{Body: "one", DeduplicationID: "order-1"}, {Body: "two"}})
+			Expect(results[0]).To(Equal(app.PutResult{ID: first, Duplicate: true}))
+			Expect(results[1].Duplicate).To(BeFalse())
+		})
+
+		It("should store only one of the duplicates within a batch put", func() {
+			batch := make([]app.PublishMessage, 10)
+			for i := range batch {
+				batch[i] = app.PublishMessage{Body: fmt.Sprintf("%d", i), DeduplicationID: "order-1"}
+			}
+			slowCfg := *cfg
+			slowCfg.Backend = slowBackend{cfg.Backend}
+			results := queue.BatchPut(&slowCfg, batch)
+
+			stored := make([]app.PutResult, 0)
+			for _, result := range results {
+				Expect(result.Error).To(BeEmpty())
+				if !result.Duplicate {
+					stored = append(stored, result)
+				}
+			}
+			Expect(stored).To(HaveLen(1))
+			for _, result := range results {
+				Expect(result.ID).To(Equal(stored[0].ID))
+			}
+			messages, _ := queue.Get(cfg, memberList, 20)
+			Expect(messages).To(HaveLen(1))
+		})
+
+		It("should accept the message again once the window has passed", func() {
+			queue.Config.Registers[app.DeduplicationWindow] = "0.01"
+			first, _ := queue.Publish(cfg, app.PublishMessage{Body: "one", DeduplicationID: "order-1"})
+			time.Sleep(20 * time.Millisecond)
+			second, _ := queue.Publish(cfg, app.PublishMessage{Body: "one", DeduplicationID: "order-1"})
+			Expect(second).ToNot(Equal(first))
+		})
+
+		It("should keep dedupe records apart from the config of other queues", func() {
+			other := queueName + "_dedupe"
+			Expect(cfg.InitializeQueue(other)).To(Succeed())
+			defer queues.DeleteQueue(other, cfg)
+
+			_, err := queue.Publish(cfg, app.PublishMessage{Body: "one", DeduplicationID: "config"})
+			Expect(err).ToNot(HaveOccurred())
+			otherConfig, err := cfg.Backend.FetchMap(fmt.Sprintf("queue_%s_config", other))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(otherConfig.Registers).To(HaveKey(app.VisibilityTimeout))
+			Expect(otherConfig.Registers).ToNot(HaveKey("message_id"))
+		})
+
+		It("should not deduplicate when the window is 0", func() {
+			queue.Config.Registers[app.DeduplicationWindow] = "0"
+			first, _ := queue.Publish(cfg, app.PublishMessage{Body: "one", DeduplicationID: "order-1"})
+			second, _ := queue.Publish(cfg, app.PublishMessage{Body: "one", DeduplicationID: "order-1"})
+			Expect(second).ToNot(Equal(first))
+		})
+	})
+
+	Context("Fifo", func() {
+		BeforeEach(func() {
+			queue.Config.Registers[app.Fifo] = "true"
+		})
+
+		publish := func(group string, body string) string {
+			id, err := queue.Publish(cfg, app.PublishMessage{Body: body, MessageGroupID: group})
+			Expect(err).ToNot(HaveOccurred())
+			return id
+		}
+
+		bodies := func(messages []backend.Message) []string {
+			result := make([]string, 0, len(messages))
+			for _, message := range messages {
+				result = append(result, string(message.Data))
+			}
+			return result
+		}
+
+		It("should require a message group", func() {
+			_, err := queue.Publish(cfg, app.PublishMessage{Body: "one"})
+			Expect(err).To(Equal(app.ErrMissingMessageGroup))
+		})
+
+		It("should deliver the messages of a group in publish order", func() {
+			for i := 0; i < 20; i++ {
+				publish("order-1", fmt.Sprintf("%d", i))
+			}
+
+			messages, err := queue.Get(cfg, memberList, 20)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(messages).To(HaveLen(20))
+			for i, message := range messages {
+				Expect(string(message.Data)).To(Equal(fmt.Sprintf("%d", i)))
+				Expect(app.MessageGroup(&message)).To(Equal("order-1"))
+			}
+		})
+
+		It("should deliver the messages of a batch in the order given, within each group", func() {
+			batch := make([]app.PublishMessage, 0, 40)
+			for i := 0; i < 20; i++ {
+				batch = append(batch, app.PublishMessage{Body: fmt.Sprintf("a%d", i), MessageGroupID: "order-1"})
+				batch = append(batch, app.PublishMessage{Body: fmt.Sprintf("b%d", i), MessageGroupID: "order-2"})
+			}
+			for _, result := range queue.BatchPut(cfg, batch) {
+				Expect(result.Error).To(BeEmpty())
+			}
+
+			messages, err := queue.Get(cfg, memberList, 40)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(messages).To(HaveLen(40))
+			next := map[string]int{"order-1": 0, "order-2": 0}
+			for _, message := range messages {
+				group := app.MessageGroup(&message)
+				prefix := map[string]string{"order-1": "a", "order-2": "b"}[group]
+				Expect(string(message.Data)).To(Equal(fmt.Sprintf("%s%d", prefix, next[group])))
+				next[group]++
+			}
+		})
+
+		It("should take the ids of a group from a sequence kept in the backend, shared by every node", func() {
+			var calls int32
+			countingCfg := *cfg
+			countingCfg.Backend = recordCountingBackend{cfg.Backend, &calls}
+			_, err := queue.Publish(&countingCfg, app.PublishMessage{Body: "one", MessageGroupID: "order-1"})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(atomic.LoadInt32(&calls)).To(BeNumerically(">=", 2))
+		})
+
+		It("should give the messages of a group published through several nodes at once distinct ids, in publish order", func() {
+			slowCfg := *cfg
+			slowCfg.Backend = slowBackend{cfg.Backend}
+			var wg sync.WaitGroup
+			var lock sync.Mutex
+			ids := make(map[string]bool)
+			for i := 0; i < 8; i++ {
+				// Each its own queue, as if on different nodes
+				publisher := &app.Queue{Name: queueName, Parts: app.InitPartitions(cfg, queueName), Config: queue.Config}
+				wg.Add(1)
+				go func(i int) {
+					defer wg.Done()
+					id, err := publisher.Publish(&slowCfg, app.PublishMessage{Body: fmt.Sprintf("%d", i), MessageGroupID: "order-1"})
+					Expect(err).ToNot(HaveOccurred())
+					lock.Lock()
+					ids[id] = true
+					lock.Unlock()
+				}(i)
+			}
+			wg.Wait()
+			Expect(ids).To(HaveLen(8))
+			last := publish("order-1", "last")
+
+			messages, _ := queue.Get(cfg, memberList, 10)
+			Expect(messages).To(HaveLen(9))
+			for _, message := range messages[:8] {
+				Expect(ids).To(HaveKey(message.Key))
+				Expect(message.Siblings).To(BeEmpty())
+			}
+			Expect(messages[8].Key).To(Equal(last))
+		})
+
+		It("should hold back a group while an earlier message is in flight", func() {
+			first := publish("order-1", "first")
+			held, _ := queue.Get(cfg, memberList, 10)
+			Expect(bodies(held)).To(ConsistOf("first"))
+
+			publish("order-1", "second")
+			publish("order-2", "other")
+			messages, _ := queue.Get(cfg, memberList, 10)
+			Expect(bodies(messages)).To(ConsistOf("other"))
+
+			Expect(queue.Delete(cfg, first, app.MessageReceipt(&held[0]))).To(BeTrue())
+			messages, _ = queue.Get(cfg, memberList, 10)
+			Expect(bodies(messages)).To(ConsistOf("second"))
+		})
+
+		It("should hand a group to only one of several concurrent receivers", func() {
+			for i := 0; i < 10; i++ {
+				publish("order-1", fmt.Sprintf("%d", i))
+			}
+			slowCfg := *cfg
+			slowCfg.Backend = slowBackend{cfg.Backend}
+			var wg sync.WaitGroup
+			var lock sync.Mutex
+			received := make([][]string, 0)
+			for i := 0; i < 8; i++ {
+				// Each with its own partitions, as if on different nodes
+				receiver := &app.Queue{Name: queueName, Parts: app.InitPartitions(cfg, queueName), Config: queue.Config}
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					messages, _ := receiver.Get(&slowCfg, memberList, 10)
+					if len(messages) > 0 {
+						lock.Lock()
+						received = append(received, bodies(messages))
+						lock.Unlock()
+					}
+				}()
+			}
+			wg.Wait()
+			Expect(received).To(HaveLen(1))
+			for i, body := range received[0] {
+				Expect(body).To(Equal(fmt.Sprintf("%d", i)))
+			}
+		})
+
+		It("should redeliver the head of a group before the rest once it times out", func() {
+			queue.Config.Registers[app.VisibilityTimeout] = "0.01"
+			publish("order-1", "first")
+			publish("order-1", "second")
+
+			messages, _ := queue.Get(cfg, memberList, 1)
+			Expect(bodies(messages)).To(Equal([]string{"first"}))
+			time.Sleep(20 * time.Millisecond)
+
+			messages, _ = queue.Get(cfg, memberList, 10)
+			Expect(bodies(messages)).To(Equal([]string{"first", "second"}))
+		})
+	})
+
+	Context("Priority", func() {
+		publish := func(priority int, body string) {
+			_, err := queue.Publish(cfg, app.PublishMessage{Body: body, Priority: &priority})
+			Expect(err).ToNot(HaveOccurred())
+		}
+
+		It("should reject priorities out of range", func() {
+			for _, priority := range []int{-1, app.MaxPriority + 1} {
+				_, err := queue.Publish(cfg, app.PublishMessage{Body: "hello", Priority: &priority})
+				Expect(err).To(Equal(app.ErrInvalidPriority))
+			}
+		})
+
+		It("should store the default priority when none is given", func() {
+			id := queue.Put(cfg, "hello")
+			messages := queue.RetrieveMessages([]string{id}, cfg)
+			Expect(messages).To(HaveLen(1))
+			Expect(app.MessagePriority(&messages[0])).To(Equal(app.DefaultPriority))
+		})
+
+		It("should fill a batch from higher priorities first", func() {
+			for i := 0; i < 5; i++ {
+				publish(0, "low")
+				publish(9, "high")
+				publish(5, "medium")
+			}
+
+			for _, expected := range []int{9, 5, 0} {
+				messages, err := queue.Get(cfg, memberList, 5)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(messages).To(HaveLen(5))
+				for _, message := range messages {
+					Expect(app.MessagePriority(&message)).To(Equal(expected))
+				}
+			}
+		})
+
+		It("should not starve lower priorities", func() {
+			publish(0, "low")
+			for i := 0; i < app.PriorityFairShare; i++ {
+				publish(9, "high")
+			}
+
+			received := make([]string, 0, app.PriorityFairShare)
+			for i := 0; i < app.PriorityFairShare; i++ {
+				messages, _ := queue.Get(cfg, memberList, 1)
+				Expect(messages).To(HaveLen(1))
+				received = append(received, string(messages[0].Data))
+			}
+			Expect(received).To(ContainElement("low"))
+		})
+	})
+
+	Context("BatchPut", func() {
+		It("should return the id of each stored message in order", func() {
+			results := queue.BatchPut(cfg, []app.PublishMessage{{Body: "one"}, {Body: "two"}, {Body: "three"}})
+			Expect(results).To(HaveLen(3))
+
+			for i, body := range []string{"one", "two", "three"} {
+				Expect(results[i].Error).To(BeEmpty())
+				messages := queue.RetrieveMessages([]string{results[i].ID}, cfg)
+				Expect(messages).To(HaveLen(1))
+				Expect(string(messages[0].Data)).To(Equal(body))
+			}
+		})
+
+		It("should delay each message by its own delay", func() {
+			delay := 60.0
+			queue.BatchPut(cfg, []app.PublishMessage{{Body: "later", DelaySeconds: &delay}, {Body: "now"}})
+
+			messages, err := queue.Get(cfg, memberList, 10)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(messages).To(HaveLen(1))
+			Expect(string(messages[0].Data)).To(Equal("now"))
+		})
+
+		It("should report invalid messages without failing the rest of the batch", func() {
+			results := queue.BatchPut(cfg, []app.PublishMessage{
+				{Body: "bad", Attributes: map[string]app.MessageAttribute{"count": {Type: app.NumberAttribute, Value: "many"}}},
+				{Body: "good"},
+			})
+			Expect(results[0].Error).To(Equal(app.ErrInvalidAttribute.Error()))
+			Expect(results[1].ID).ToNot(BeEmpty())
+		})
+	})
+
+	Context("Get", func() {
+		It("should return the messages in the partition", func() {
+			queue.Put(cfg, "one")
+			queue.Put(cfg, "two")
+
+			messages, err := queue.Get(cfg, memberList, 10)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(messages).To(HaveLen(2))
+		})
+
+		It("should not redeliver messages which are in flight", func() {
+			queue.Put(cfg, "one")
+
+			messages, err := queue.Get(cfg, memberList, 10)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(messages).To(HaveLen(1))
+			Expect(app.MessageReceipt(&messages[0])).ToNot(BeEmpty())
+
+			messages, err = queue.Get(cfg, memberList, 10)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(messages).To(BeEmpty())
+		})
+
+		It("should still deliver other messages from the same partition", func() {
+			queue.Put(cfg, "one")
+			queue.Get(cfg, memberList, 10)
+			id := queue.Put(cfg, "two")
+
+			messages, err := queue.Get(cfg, memberList, 10)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(messages).To(HaveLen(1))
+			Expect(messages[0].Key).To(Equal(id))
+		})
+
+		It("should redeliver a message once its visibility timeout expires", func() {
+			// Settings are read from the local cache, which otherwise only refreshes on sync
+			queue.Config.Registers[app.VisibilityTimeout] = "0.01"
+			queue.Put(cfg, "one")
+
+			first, _ := queue.Get(cfg, memberList, 10)
+			Expect(first).To(HaveLen(1))
+			time.Sleep(20 * time.Millisecond)
+
+			second, _ := queue.Get(cfg, memberList, 10)
+			Expect(second).To(HaveLen(1))
+			Expect(app.MessageReceipt(&second[0])).ToNot(Equal(app.MessageReceipt(&first[0])))
+		})
+	})
+
+	Context("GetWithWait", func() {
+		It("should return right away when there are messages", func() {
+			queue.Put(cfg, "one")
+
+			start := time.Now()
+			messages, err := queue.GetWithWait(cfg, memberList, 10, time.Second)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(messages).To(HaveLen(1))
+			Expect(time.Since(start)).To(BeNumerically("<", 100*time.Millisecond))
+		})
+
+		It("should wake up when a message is put", func() {
+			go func() {
+				time.Sleep(50 * time.Millisecond)
+				queue.Put(cfg, "one")
+			}()
+
+			start := time.Now()
+			messages, err := queue.GetWithWait(cfg, memberList, 10, 5*time.Second)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(messages).To(HaveLen(1))
+			Expect(time.Since(start)).To(BeNumerically("<", app.LongPollInterval))
+		})
+
+		It("should return empty once the wait time is up", func() {
+			start := time.Now()
+			messages, err := queue.GetWithWait(cfg, memberList, 10, 50*time.Millisecond)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(messages).To(BeEmpty())
+			Expect(time.Since(start)).To(BeNumerically(">=", 50*time.Millisecond))
+		})
+	})
+
+	Context("PutWithDelay", func() {
+		It("should not deliver the message until the delay has passed", func() {
+			queue.PutWithDelay(cfg, "later", 0.02)
+
+			messages, err := queue.Get(cfg, memberList, 10)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(messages).To(BeEmpty())
+			time.Sleep(30 * time.Millisecond)
+
+			messages, err = queue.Get(cfg, memberList, 10)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(messages).To(HaveLen(1))
+			Expect(string(messages[0].Data)).To(Equal("later"))
+		})
+
+		It("should delay messages by the queue setting when put without a delay", func() {
+			queue.Config.Registers[app.DelaySeconds] = "60"
+			queue.Put(cfg, "later")
+
+			messages, err := queue.Get(cfg, memberList, 10)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(messages).To(BeEmpty())
+		})
+
+		It("should not allow the visibility of a delayed message to be changed", func() {
+			id := queue.PutWithDelay(cfg, "later", 60)
+			Expect(queue.ChangeVisibility(cfg, id, "", 0)).To(Equal(app.ErrMessageNotInFlight))
+		})
+	})
+
+	Context("ExpireMessages", func() {
+		It("should delete messages older than the retention period", func() {
+			queue.Config.Registers[app.MessageRetentionPeriod] = "0.01"
+			old := queue.Put(cfg, "old")
+			time.Sleep(20 * time.Millisecond)
+			fresh := queue.Put(cfg, "fresh")
+
+			expired, err := queue.ExpireMessages(cfg, memberList)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(expired).To(Equal(1))
+			Expect(queue.RetrieveMessages([]string{old}, cfg)).To(BeEmpty())
+			Expect(queue.RetrieveMessages([]string{fresh}, cfg)).To(HaveLen(1))
+		})
+
+		It("should keep messages forever when the retention period is 0", func() {
+			queue.Config.Registers[app.MessageRetentionPeriod] = "0"
+			queue.Put(cfg, "old")
+			time.Sleep(10 * time.Millisecond)
+
+			expired, err := queue.ExpireMessages(cfg, memberList)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(expired).To(Equal(0))
+		})
+
+		It("should keep messages without an enqueue time", func() {
+			queue.Config.Registers[app.MessageRetentionPeriod] = "0.01"
+			cfg.Backend.PutMessage(queueName, &backend.Message{Key: "42", Data: []byte("legacy")})
+			time.Sleep(20 * time.Millisecond)
+
+			expired, err := queue.ExpireMessages(cfg, memberList)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(expired).To(Equal(0))
+		})
+	})
+
+	Context("CheckReceipt", func() {
+		It("should only accept the receipt from the latest receive", func() {
+			id := queue.Put(cfg, "one")
+			messages, _ := queue.Get(cfg, memberList, 10)
+
+			Expect(queue.CheckReceipt(cfg, id, app.MessageReceipt(&messages[0]))).To(Succeed())
+			Expect(queue.CheckReceipt(cfg, id, "stale")).To(Equal(app.ErrInvalidReceipt))
+		})
+	})
+
+	Context("ChangeVisibility", func() {
+		visibleAt := func(id string) time.Time {
+			message, err := cfg.Backend.GetMessage(queueName, id)
+			Expect(err).ToNot(HaveOccurred())
+			nanos, _ := strconv.ParseInt(message.Meta[app.VisibleAtMeta], 10, 64)
+			return time.Unix(0, nanos)
+		}
+
+		It("should extend the visibility timeout of an in-flight message", func() {
+			id := queue.Put(cfg, "slow")
+			messages, _ := queue.Get(cfg, memberList, 10)
+
+			Expect(queue.ChangeVisibility(cfg, id, app.MessageReceipt(&messages[0]), 120)).To(Succeed())
+			Expect(visibleAt(id)).To(BeTemporally("~", time.Now().Add(120*time.Second), time.Second))
+			Expect(queue.Get(cfg, memberList, 10)).To(BeEmpty())
+		})
+
+		It("should hand the message back straight away with a timeout of 0", func() {
+			id := queue.Put(cfg, "again")
+			messages, _ := queue.Get(cfg, memberList, 10)
+
+			Expect(queue.ChangeVisibility(cfg, id, app.MessageReceipt(&messages[0]), 0)).To(Succeed())
+			messages, _ = queue.Get(cfg, memberList, 10)
+			Expect(messages).To(HaveLen(1))
+			Expect(app.MessageReceiveCount(&messages[0])).To(Equal(2))
+		})
+
+		It("should refuse a stale receipt, or a negative timeout", func() {
+			queue.Config.Registers[app.VisibilityTimeout] = "0.01"
+			id := queue.Put(cfg, "moved on")
+			stale, _ := queue.Get(cfg, memberList, 10)
+			time.Sleep(20 * time.Millisecond)
+			current, _ := queue.Get(cfg, memberList, 10)
+			Expect(current).To(HaveLen(1))
+
+			Expect(queue.ChangeVisibility(cfg, id, app.MessageReceipt(&stale[0]), 60)).To(Equal(app.ErrInvalidReceipt))
+			Expect(queue.ChangeVisibility(cfg, id, app.MessageReceipt(&current[0]), -1)).To(Equal(app.ErrInvalidVisibilityTimeout))
+			Expect(visibleAt(id)).To(BeTemporally("<", time.Now().Add(time.Second)))
+		})
+
+		It("should change the rest of a batch when some of it fails", func() {
+			ids := []string{queue.Put(cfg, "one"), queue.Put(cfg, "two")}
+			messages, _ := queue.Get(cfg, memberList, 10)
+			Expect(messages).To(HaveLen(2))
+			receipts := make(map[string]string)
+			for _, message := range messages {
+				receipts[message.Key] = app.MessageReceipt(&message)
+			}
+
+			errors := queue.BatchChangeVisibility(cfg, []app.VisibilityChange{
+				{ID: ids[0], Receipt: receipts[ids[0]], VisibilityTimeout: 120},
+				{ID: ids[1], Receipt: "stale", VisibilityTimeout: 120},
+			})
+			Expect(errors).To(Equal(map[string]error{ids[1]: app.ErrInvalidReceipt}))
+			Expect(visibleAt(ids[0])).To(BeTemporally("~", time.Now().Add(120*time.Second), time.Second))
+			Expect(visibleAt(ids[1])).To(BeTemporally("<", time.Now().Add(time.Minute)))
+		})
+	})
+
+	Context("Delete", func() {
+		It("should remove the message", func() {
+			id := queue.Put(cfg, "hello")
+			messages, _ := queue.Get(cfg, memberList, 10)
+
+			Expect(queue.Delete(cfg, id, app.MessageReceipt(&messages[0]))).To(BeTrue())
+			Expect(queue.RetrieveMessages([]string{id}, cfg)).To(BeEmpty())
+		})
+
+		It("should require the receipt from the latest receive", func() {
+			queue.Config.Registers[app.VisibilityTimeout] = "0.01"
+			id := queue.Put(cfg, "hello")
+			_, err := queue.Delete(cfg, id, "")
+			Expect(err).To(Equal(app.ErrMissingReceipt))
+
+			stale, _ := queue.Get(cfg, memberList, 10)
+			time.Sleep(20 * time.Millisecond)
+			current, _ := queue.Get(cfg, memberList, 10)
+			Expect(current).To(HaveLen(1))
+
+			deleted, err := queue.Delete(cfg, id, app.MessageReceipt(&stale[0]))
+			Expect(err).To(Equal(app.ErrInvalidReceipt))
+			Expect(deleted).To(BeFalse())
+			Expect(queue.Delete(cfg, id, app.MessageReceipt(&current[0]))).To(BeTrue())
+		})
+
+		It("should only delete the messages of a batch with a current receipt", func() {
+			ids := []string{queue.Put(cfg, "one"), queue.Put(cfg, "two")}
+			messages, _ := queue.Get(cfg, memberList, 10)
+			Expect(messages).To(HaveLen(2))
+			receipts := make(map[string]string)
+			for _, message := range messages {
+				receipts[message.Key] = app.MessageReceipt(&message)
+			}
+
+			_, err := queue.BatchDelete(cfg, ids, []string{receipts[ids[0]]})
+			Expect(err).To(Equal(app.ErrMissingReceipt))
+
+			failed, err := queue.BatchDelete(cfg, ids, []string{receipts[ids[0]], "stale"})
+			Expect(err).To(Equal(app.ErrInvalidReceipt))
+			Expect(failed).To(Equal(1))
+			Expect(queue.RetrieveMessages(ids, cfg)).To(HaveLen(1))
+		})
+	})
+
+	Context("Receive", func() {
+		It("should hand each message to only one of several concurrent receivers", func() {
+			for i := 0; i < 100; i++ {
+				queue.Put(cfg, fmt.Sprintf("%d", i))
+			}
+			slowCfg := *cfg
+			slowCfg.Backend = slowBackend{cfg.Backend}
+			var wg sync.WaitGroup
+			var lock sync.Mutex
+			received := make(map[string]int)
+			for i := 0; i < 8; i++ {
+				// Each with its own partitions, as if on different nodes
+				receiver := &app.Queue{Name: queueName, Parts: app.InitPartitions(cfg, queueName), Config: queue.Config}
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					messages, _ := receiver.Get(&slowCfg, memberList, 100)
+					lock.Lock()
+					for _, message := range messages {
+						received[message.Key]++
+					}
+					lock.Unlock()
+				}()
+			}
+			wg.Wait()
+			Expect(received).ToNot(BeEmpty())
+			for _, count := range received {
+				Expect(count).To(Equal(1))
+			}
+		})
+	})
+
+	Context("Purge", func() {
+		purgeStatus := func() app.JobStatus {
+			status, found, err := queue.PurgeStatus(cfg)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(found).To(BeTrue())
+			return status
+		}
+
+		It("should report nothing for a queue which was never purged", func() {
+			_, found, err := queue.PurgeStatus(cfg)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(found).To(BeFalse())
+		})
+
+		It("should delete every message in the background and report progress", func() {
+			ids := make([]string, 0, app.JobBatchSize+50)
+			for i := 0; i < app.JobBatchSize+50; i++ {
+				ids = append(ids, queue.Put(cfg, fmt.Sprintf("%d", i)))
+			}
+
+			status, err := queue.Purge(cfg)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(status.Status).To(Equal(app.JobRunning))
+
+			Eventually(func() string { return purgeStatus().Status }).Should(Equal(app.JobComplete))
+			status = purgeStatus()
+			Expect(status.Deleted).To(Equal(len(ids)))
+			Expect(status.FinishedAt).ToNot(BeNil())
+			Expect(queue.RetrieveMessages(ids, cfg)).To(BeEmpty())
+		})
+
+		It("should keep messages put after the purge started", func() {
+			old := queue.Put(cfg, "old")
+			_, err := queue.Purge(cfg)
+			Expect(err).ToNot(HaveOccurred())
+			fresh := queue.Put(cfg, "new")
+
+			Eventually(func() string { return purgeStatus().Status }).Should(Equal(app.JobComplete))
+			Expect(queue.RetrieveMessages([]string{old}, cfg)).To(BeEmpty())
+			Expect(queue.RetrieveMessages([]string{fresh}, cfg)).To(HaveLen(1))
+		})
+
+		It("should allow another purge once the last one finished", func() {
+			_, err := queue.Purge(cfg)
+			Expect(err).ToNot(HaveOccurred())
+			Eventually(func() string { return purgeStatus().Status }).Should(Equal(app.JobComplete))
+
+			_, err = queue.Purge(cfg)
+			Expect(err).ToNot(HaveOccurred())
+			Eventually(func() string { return purgeStatus().Status }).Should(Equal(app.JobComplete))
+		})
+	})
+
+	Context("DeleteQueue", func() {
+		deletionStatus := func() app.JobStatus {
+			status, found, err := queues.DeletionStatus(cfg, queueName)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(found).To(BeTrue())
+			return status
+		}
+
+		It("should forget the queue and delete its messages in the background", func() {
+			ids := make([]string, 0, app.JobBatchSize+50)
+			for i := 0; i < app.JobBatchSize+50; i++ {
+				ids = append(ids, queue.Put(cfg, fmt.Sprintf("%d", i)))
+			}
+
+			status, err := queues.DeleteQueue(queueName, cfg)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(status.Status).To(Equal(app.JobRunning))
+			Expect(queues.Exists(cfg, queueName)).To(BeFalse())
+			Expect(queues.QueueMap).ToNot(HaveKey(queueName))
+
+			Eventually(func() string { return deletionStatus().Status }).Should(Equal(app.JobComplete))
+			Expect(deletionStatus().Deleted).To(Equal(len(ids)))
+			Expect(queue.RetrieveMessages(ids, cfg)).To(BeEmpty())
+		})
+
+		It("should stop handing out partitions", func() {
+			queue.Put(cfg, "hello")
+			queues.DeleteQueue(queueName, cfg)
+
+			messages, err := queue.Get(cfg, memberList, 10)
+			Expect(messages).To(BeEmpty())
+			Expect(err).To(MatchError(app.NoPartitions))
+		})
+
+		It("should keep the deduplication records of a queue recreated while the deletion runs", func() {
+			gatedCfg := *cfg
+			gate := make(chan struct{})
+			gatedCfg.Backend = gatedBackend{cfg.Backend, gate}
+			_, err := queues.DeleteQueue(queueName, &gatedCfg)
+			Expect(err).ToNot(HaveOccurred())
+
+			_, err = cfg.InitializeQueueWithSettings(queueName, map[string]string{app.DeduplicationWindow: "60"})
+			Expect(err).ToNot(HaveOccurred())
+			recreated := queues.QueueMap[queueName]
+			first, err := recreated.Publish(cfg, app.PublishMessage{Body: "one", DeduplicationID: "order-1"})
+			Expect(err).ToNot(HaveOccurred())
+
+			close(gate)
+			Eventually(func() string { return deletionStatus().Status }).Should(Equal(app.JobComplete))
+			second, err := recreated.Publish(cfg, app.PublishMessage{Body: "one", DeduplicationID: "order-1"})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(second).To(Equal(first))
+		})
+
+		It("should unsubscribe the queue from every topic", func() {
+			topicName := queueName + "_topic"
+			Expect(cfg.Backend.AddToSet("topicsConfig", "topics", topicName)).To(Succeed())
+			topicConfig := fmt.Sprintf("topic_%s_config", topicName)
+			Expect(cfg.Backend.AddToSet(topicConfig, "queues", queueName)).To(Succeed())
+
+			_, err := queues.DeleteQueue(queueName, cfg)
+			Expect(err).ToNot(HaveOccurred())
+
+			subscribers, _ := cfg.Backend.FetchMap(topicConfig)
+			Expect(subscribers.FetchSet("queues")).ToNot(ContainElement(queueName))
+			cfg.Backend.RemoveFromSet("topicsConfig", "topics", topicName)
+			cfg.Backend.DeleteMap(topicConfig)
+		})
+	})
+
+	Context("Dead lettering", func() {
+		var deadLetterQueueName string
+
+		BeforeEach(func() {
+			deadLetterQueueName = queueName + "_dlq"
+			Expect(cfg.InitializeQueue(deadLetterQueueName)).To(Succeed())
+			queue.Config.Registers[app.MaxReceiveCount] = "1"
+			queue.Config.Registers[app.DeadLetterQueue] = deadLetterQueueName
+		})
+
+		AfterEach(func() {
+			queues.DeleteQueue(deadLetterQueueName, cfg)
+			delete(queues.QueueMap, deadLetterQueueName)
+		})
+
+		It("should count each receive", func() {
+			queue.Config.Registers[app.MaxReceiveCount] = "0"
+			id := queue.Put(cfg, "one")
+			messages, _ := queue.Get(cfg, memberList, 10)
+			Expect(app.MessageReceiveCount(&messages[0])).To(Equal(1))
+
+			Expect(queue.ChangeVisibility(cfg, id, app.MessageReceipt(&messages[0]), 0)).To(Succeed())
+			messages, _ = queue.Get(cfg, memberList, 10)
+			Expect(app.MessageReceiveCount(&messages[0])).To(Equal(2))
+		})
+
+		It("should move messages over the max receive count to the dead letter queue", func() {
+			id := queue.Put(cfg, "one")
+			messages, _ := queue.Get(cfg, memberList, 10)
+			Expect(queue.ChangeVisibility(cfg, id, app.MessageReceipt(&messages[0]), 0)).To(Succeed())
+
+			messages, err := queue.Get(cfg, memberList, 10)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(messages).To(BeEmpty())
+
+			deadLettered, err := queues.QueueMap[deadLetterQueueName].Get(cfg, memberList, 10)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(deadLettered).To(HaveLen(1))
+			Expect(string(deadLettered[0].Data)).To(Equal("one"))
+			Expect(deadLettered[0].Meta[app.SourceQueueMeta]).To(Equal(queueName))
+		})
+
+		It("should leave a message with whoever received it while it was being dead lettered", func() {
+			id := queue.Put(cfg, "one")
+			messages, _ := queue.Get(cfg, memberList, 10)
+			Expect(queue.ChangeVisibility(cfg, id, app.MessageReceipt(&messages[0]), 0)).To(Succeed())
+
+			receivingCfg := *cfg
+			receivingCfg.Backend = receivingBackend{cfg.Backend}
+			messages, _ = queue.Get(&receivingCfg, memberList, 10)
+			Expect(messages).To(BeEmpty())
+
+			deadLettered, _ := queues.QueueMap[deadLetterQueueName].Get(cfg, memberList, 10)
+			Expect(deadLettered).To(BeEmpty())
+			Expect(queue.Delete(cfg, id, "other receipt")).To(BeTrue())
+		})
+
+		It("should leave a message with whoever received it while it was being redriven", func() {
+			id := queue.Put(cfg, "one")
+			messages, _ := queue.Get(cfg, memberList, 10)
+			queue.ChangeVisibility(cfg, id, app.MessageReceipt(&messages[0]), 0)
+			queue.Get(cfg, memberList, 10)
+			deadLetterQueue := queues.QueueMap[deadLetterQueueName]
+			ids, _, _ := cfg.Backend.RangeScan(deadLetterQueueName, 0, math.MaxInt64, 10, "")
+			Expect(ids).To(HaveLen(1))
+
+			receivingCfg := *cfg
+			receivingCfg.Backend = receivingBackend{cfg.Backend}
+			redriven, err := deadLetterQueue.Redrive(&receivingCfg)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(redriven).To(BeZero())
+
+			messages, _ = queue.Get(cfg, memberList, 10)
+			Expect(messages).To(BeEmpty())
+			Expect(deadLetterQueue.Delete(cfg, ids[0], "other receipt")).To(BeTrue())
+		})
+
+		It("should not dead letter the head of a fifo group while it is in flight", func() {
+			queue.Config.Registers[app.Fifo] = "true"
+			first, _ := queue.Publish(cfg, app.PublishMessage{Body: "first", MessageGroupID: "order-1"})
+			held, _ := queue.Get(cfg, memberList, 10)
+			Expect(held).To(HaveLen(1))
+
+			messages, _ := queue.Get(cfg, memberList, 10)
+			Expect(messages).To(BeEmpty())
+			Expect(queue.Delete(cfg, first, app.MessageReceipt(&held[0]))).To(BeTrue())
+			deadLettered, _ := queues.QueueMap[deadLetterQueueName].Get(cfg, memberList, 10)
+			Expect(deadLettered).To(BeEmpty())
+		})
+
+		It("should redrive dead lettered messages back to their source queue", func() {
+			id := queue.Put(cfg, "one")
+			messages, _ := queue.Get(cfg, memberList, 10)
+			queue.ChangeVisibility(cfg, id, app.MessageReceipt(&messages[0]), 0)
+			queue.Get(cfg, memberList, 10)
+
+			redriven, err := queues.QueueMap[deadLetterQueueName].Redrive(cfg)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(redriven).To(Equal(1))
+
+			messages, _ = queue.Get(cfg, memberList, 10)
+			Expect(messages).To(HaveLen(1))
+			Expect(string(messages[0].Data)).To(Equal("one"))
+			Expect(app.MessageReceiveCount(&messages[0])).To(Equal(1))
+		})
+
+		It("should not allow a queue to be its own dead letter queue", func() {
+			Expect(cfg.SetDeadLetterQueue(queueName, queueName)).To(Equal(app.ErrInvalidDeadLetterQueue))
+			Expect(cfg.SetDeadLetterQueue(queueName, "missing_queue")).To(Equal(app.ErrInvalidDeadLetterQueue))
+			Expect(cfg.SetDeadLetterQueue(queueName, deadLetterQueueName)).To(Succeed())
+		})
+	})
+
+	Context("RetrieveMessages", func() {
+		It("should split siblings into independent messages", func() {
+			cfg.Backend.PutMessage(queueName, &backend.Message{Key: "42", Data: []byte("first")})
+			cfg.Backend.PutMessage(queueName, &backend.Message{Key: "42", Data: []byte("second")})
+
+			Expect(queue.RetrieveMessages([]string{"42"}, cfg)).To(BeEmpty())
+			_, err := cfg.Backend.GetMessage(queueName, "42")
+			Expect(err).To(Equal(backend.ErrNotFound))
+
+			messages, err := queue.Get(cfg, memberList, 10)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(messages).To(HaveLen(2))
+		})
+	})
+})
@@ -0,0 +1,284 @@
+package app
+
+import (
+	"crypto/md5"
+	"encoding/binary"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/hashicorp/memberlist"
+)
+
+// RingVirtualNodes is the number of points each node has on the ring. More points spread the keyspace
+// more evenly between nodes, and spread the share a node takes or gives up when it joins or leaves
+// across more of the other nodes
+const RingVirtualNodes = 128
+
+// KeyRange is a range of the keyspace, from Bottom to Top
+type KeyRange struct {
+	Bottom int
+	Top    int
+}
+
+// MarshalJSON writes the bounds as strings, as they are too large to survive being read as JavaScript numbers
+func (keyRange KeyRange) MarshalJSON() ([]byte, error) {
+	return []byte(`{"bottom":"` + strconv.Itoa(keyRange.Bottom) + `","top":"` + strconv.Itoa(keyRange.Top) + `"}`), nil
+}
+
+// Ring is a consistent hashing ring over the keyspace. Each node has RingVirtualNodes points on it, and
+// owns the range of keys from the point before each of its points, up to that point. A node joining or
+// leaving only takes or gives up the ranges next to its own points, leaving the rest where they were
+type Ring struct {
+	points []ringPoint
+}
+
+type ringPoint struct {
+	position int
+	node     string
+}
+
+// NewRing places the points of each of the named nodes on a ring
+func NewRing(nodes []string) *Ring {
+	ring := &Ring{points: make([]ringPoint, 0, len(nodes)*RingVirtualNodes)}
+	for _, node := range nodes {
+		for i := 0; i < RingVirtualNodes; i++ {
+			ring.points = append(ring.points, ringPoint{position: ringPosition(node, i), node: node})
+		}
+	}
+	sort.Sort(ringPoints(ring.points))
+	return ring
+}
+
+// ringPosition hashes the virtual node onto the keyspace
+func ringPosition(node string, virtualNode int) int {
+	sum := md5.Sum([]byte(node + "#" + strconv.Itoa(virtualNode)))
+	return int(binary.BigEndian.Uint64(sum[:8]) & math.MaxInt64)
+}
+
+// Owner returns the name of the node owning the key, or "" if the ring is empty
+func (ring *Ring) Owner(key int) string {
+	if len(ring.points) == 0 {
+		return ""
+	}
+	return ring.points[ring.pointIndex(key)].node
+}
+
+// Segment returns the position of the point whose range holds the key. The range between each point
+// and the one before it is a segment of the keyspace, known by that position on every node
+func (ring *Ring) Segment(key int) int {
+	if len(ring.points) == 0 {
+		return 0
+	}
+	return ring.points[ring.pointIndex(key)].position
+}
+
+// pointIndex returns the index of the point whose range holds the key
+func (ring *Ring) pointIndex(key int) int {
+	i := sort.Search(len(ring.points), func(i int) bool { return ring.points[i].position > key })
+	if i == len(ring.points) {
+		// Past the last point, wrapping around to the first
+		i = 0
+	}
+	return i
+}
+
+// segments returns the ranges making up the segment of each of the nodes points, by the position of the point
+func (ring *Ring) segments(node string) map[int][]KeyRange {
+	segments := make(map[int][]KeyRange)
+	for i, point := range ring.points {
+		if point.node != node {
+			continue
+		}
+		if i == 0 {
+			// The first point also holds the keys past the last point, which wrap around to it
+			segments[point.position] = []KeyRange{
+				{Bottom: ring.points[len(ring.points)-1].position, Top: math.MaxInt64},
+				{Bottom: 0, Top: point.position},
+			}
+			continue
+		}
+		segments[point.position] = []KeyRange{{Bottom: ring.points[i-1].position, Top: point.position}}
+	}
+	return segments
+}
+
+// mergeRanges sorts the ranges, joining any which meet into one
+func mergeRanges(ranges []KeyRange) []KeyRange {
+	sort.Sort(keyRanges(ranges))
+	merged := make([]KeyRange, 0, len(ranges))
+	for _, keyRange := range ranges {
+		if len(merged) > 0 && merged[len(merged)-1].Top == keyRange.Bottom {
+			merged[len(merged)-1].Top = keyRange.Top
+			continue
+		}
+		merged = append(merged, keyRange)
+	}
+	return merged
+}
+
+// intersectRanges returns the parts of the keyspace in both sets of ranges, each sorted by their bottoms
+func intersectRanges(left []KeyRange, right []KeyRange) []KeyRange {
+	intersection := make([]KeyRange, 0)
+	for i, j := 0, 0; i < len(left) && j < len(right); {
+		bottom, top := left[i].Bottom, left[i].Top
+		if right[j].Bottom > bottom {
+			bottom = right[j].Bottom
+		}
+		if right[j].Top < top {
+			top = right[j].Top
+		}
+		if bottom < top {
+			intersection = append(intersection, KeyRange{Bottom: bottom, Top: top})
+		}
+		// Move past whichever range ends first
+		if left[i].Top < right[j].Top {
+			i++
+		} else {
+			j++
+		}
+	}
+	return intersection
+}
+
+// nodes returns the names of the nodes with points on the ring
+func (ring *Ring) nodes() map[string]bool {
+	nodes := make(map[string]bool)
+	for _, point := range ring.points {
+		nodes[point.node] = true
+	}
+	return nodes
+}
+
+// Ranges returns the ranges of the keyspace owned by the node, in order
+func (ring *Ring) Ranges(node string) []KeyRange {
+	return ring.Ownership()[node]
+}
+
+// Ownership returns the ranges of the keyspace owned by each node, in order
+func (ring *Ring) Ownership() map[string][]KeyRange {
+	ownership := make(map[string][]KeyRange)
+	if len(ring.points) == 0 {
+		return ownership
+	}
+	add := func(node string, bottom int, top int) {
+		ranges := ownership[node]
+		if len(ranges) > 0 && ranges[len(ranges)-1].Top == bottom {
+			// Neighbouring points of the same node make one range
+			ranges[len(ranges)-1].Top = top
+			return
+		}
+		ownership[node] = append(ranges, KeyRange{Bottom: bottom, Top: top})
+	}
+	// The first point also owns the keys past the last point, which wrap around to it
+	first := ring.points[0]
+	add(first.node, 0, first.position)
+	for i := 1; i < len(ring.points); i++ {
+		add(ring.points[i].node, ring.points[i-1].position, ring.points[i].position)
+	}
+	add(first.node, ring.points[len(ring.points)-1].position, math.MaxInt64)
+	return ownership
+}
+
+// MovedShare returns the share of the keyspace, from 0 to 1, owned by a different node on the other ring.
+// A nil ring has no points, so the whole keyspace has moved from it
+func (ring *Ring) MovedShare(other *Ring) float64 {
+	if other == nil {
+		other = NewRing(nil)
+	}
+	// The owner of each key only changes at a point of either ring
+	bounds := []int{0, math.MaxInt64}
+	for _, point := range ring.points {
+		bounds = append(bounds, point.position)
+	}
+	for _, point := range other.points {
+		bounds = append(bounds, point.position)
+	}
+	sort.Ints(bounds)
+
+	moved := 0.0
+	for i := 1; i < len(bounds); i++ {
+		if bounds[i] != bounds[i-1] && ring.Owner(bounds[i-1]) != other.Owner(bounds[i-1]) {
+			moved += float64(bounds[i] - bounds[i-1])
+		}
+	}
+	return moved / math.MaxInt64
+}
+
+// sliceRanges splits the ranges, as if they were laid end to end, into count even slices, and
+// returns the ranges making up the slice at index
+func sliceRanges(ranges []KeyRange, index int, count int) []KeyRange {
+	total := 0
+	for _, keyRange := range ranges {
+		total += keyRange.Top - keyRange.Bottom
+	}
+	step := total / count
+	sliceBottom := step * index
+	sliceTop := sliceBottom + step
+	if index == count-1 {
+		// The last slice takes whatever is left over from rounding
+		sliceTop = total
+	}
+
+	slice := make([]KeyRange, 0)
+	offset := 0
+	for _, keyRange := range ranges {
+		// Where the range falls with the ranges laid end to end
+		start := offset
+		bottom, top := start, start+keyRange.Top-keyRange.Bottom
+		offset = top
+		if top <= sliceBottom || bottom >= sliceTop {
+			continue
+		}
+		if bottom < sliceBottom {
+			bottom = sliceBottom
+		}
+		if top > sliceTop {
+			top = sliceTop
+		}
+		slice = append(slice, KeyRange{Bottom: keyRange.Bottom + bottom - start, Top: keyRange.Bottom + top - start})
+	}
+	return slice
+}
+
+// nodeRing returns the ring of the members of the cluster, as of the last rebalance. Without a topology
+// following the members, they are read from memberlist every time
+func nodeRing(cfg *Config, list *memberlist.Memberlist) *Ring {
+	if cfg.Topology != nil {
+		return cfg.Topology.Ring()
+	}
+	nodes := make([]string, 0)
+	for _, member := range list.Members() {
+		nodes = append(nodes, member.Name)
+	}
+	sort.Strings(nodes)
+	key := strings.Join(nodes, ",")
+
+	cachedRing.Lock()
+	defer cachedRing.Unlock()
+	if cachedRing.ring == nil || cachedRing.nodes != key {
+		cachedRing.ring = NewRing(nodes)
+		cachedRing.nodes = key
+	}
+	return cachedRing.ring
+}
+
+var cachedRing struct {
+	sync.Mutex
+	nodes string
+	ring  *Ring
+}
+
+type keyRanges []KeyRange
+
+func (r keyRanges) Len() int           { return len(r) }
+func (r keyRanges) Less(i, j int) bool { return r[i].Bottom < r[j].Bottom }
+func (r keyRanges) Swap(i, j int)      { r[i], r[j] = r[j], r[i] }
+
+type ringPoints []ringPoint
+
+func (p ringPoints) Len() int           { return len(p) }
+func (p ringPoints) Less(i, j int) bool { return p[i].position < p[j].position }
+func (p ringPoints) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
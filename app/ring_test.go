@@ -0,0 +1,110 @@
+package app_test
+
+import (
+	"fmt"
+	"math"
+	"sort"
+
+	"github.com/Tapjoy/dynamiq/app"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Ring", func() {
+
+	nodes := func(count int) []string {
+		names := make([]string, count)
+		for i := range names {
+			names[i] = fmt.Sprintf("node_%d", i)
+		}
+		return names
+	}
+
+	// Evenly spaced keys across the keyspace
+	keys := make([]int, 10000)
+	for i := range keys {
+		keys[i] = i * (math.MaxInt64 / len(keys))
+	}
+
+	Context("Ownership", func() {
+		It("should cover the whole keyspace between the nodes without gaps", func() {
+			ranges := make([]app.KeyRange, 0)
+			for _, owned := range app.NewRing(nodes(4)).Ownership() {
+				ranges = append(ranges, owned...)
+			}
+			sort.Slice(ranges, func(i, j int) bool { return ranges[i].Bottom < ranges[j].Bottom })
+
+			Expect(ranges[0].Bottom).To(Equal(0))
+			for i := 1; i < len(ranges); i++ {
+				Expect(ranges[i].Bottom).To(Equal(ranges[i-1].Top))
+			}
+			Expect(ranges[len(ranges)-1].Top).To(Equal(math.MaxInt64))
+		})
+
+		It("should give each node a roughly even share", func() {
+			ring := app.NewRing(nodes(4))
+			for _, node := range nodes(4) {
+				share := 0.0
+				for _, owned := range ring.Ranges(node) {
+					share += float64(owned.Top-owned.Bottom) / math.MaxInt64
+				}
+				Expect(share).To(BeNumerically("~", 0.25, 0.1))
+			}
+		})
+
+		It("should agree with the owner of each key", func() {
+			ring := app.NewRing(nodes(3))
+			for _, key := range keys {
+				owned := false
+				for _, keyRange := range ring.Ranges(ring.Owner(key)) {
+					if key >= keyRange.Bottom && key < keyRange.Top {
+						owned = true
+					}
+				}
+				Expect(owned).To(BeTrue())
+			}
+		})
+	})
+
+	Context("Membership changes", func() {
+		It("should only move keys to a node joining", func() {
+			before := app.NewRing(nodes(4))
+			after := app.NewRing(nodes(5))
+
+			moved := 0
+			for _, key := range keys {
+				if before.Owner(key) != after.Owner(key) {
+					Expect(after.Owner(key)).To(Equal("node_4"))
+					moved++
+				}
+			}
+			Expect(float64(moved) / float64(len(keys))).To(BeNumerically("<", 0.3))
+		})
+
+		It("should only move the keys of a node leaving", func() {
+			before := app.NewRing(nodes(5))
+			after := app.NewRing(nodes(4))
+
+			for _, key := range keys {
+				if before.Owner(key) != "node_4" {
+					Expect(after.Owner(key)).To(Equal(before.Owner(key)))
+				}
+			}
+		})
+
+		It("should measure the share of the keyspace which changed owner", func() {
+			before := app.NewRing(nodes(4))
+			after := app.NewRing(nodes(5))
+
+			moved := 0
+			for _, key := range keys {
+				if before.Owner(key) != after.Owner(key) {
+					moved++
+				}
+			}
+			Expect(after.MovedShare(before)).To(BeNumerically("~", float64(moved)/float64(len(keys)), 0.01))
+			Expect(after.MovedShare(after)).To(BeZero())
+			Expect(after.MovedShare(nil)).To(BeNumerically("~", 1, 0.0001))
+		})
+	})
+})
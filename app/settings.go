@@ -0,0 +1,364 @@
+package app
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/Tapjoy/dynamiq/app/backend"
+)
+
+// ErrInvalidPartitionRange represents the condition where a queue is configured with more min_partitions than max_partitions
+var ErrInvalidPartitionRange = errors.New("Min partitions must not be greater than max partitions")
+
+// SettingType is the type of value a queue setting holds
+type SettingType string
+
+// IntSetting is the type of settings holding a whole number
+const IntSetting SettingType = "int"
+
+// FloatSetting is the type of settings holding any number
+const FloatSetting SettingType = "float"
+
+// BoolSetting is the type of settings holding true or false
+const BoolSetting SettingType = "bool"
+
+// StringSetting is the type of settings holding text
+const StringSetting SettingType = "string"
+
+// SettingError represents a queue setting which is unknown, or given a value of the wrong type or out of range
+type SettingError struct {
+	Setting string
+	Reason  string
+}
+
+func (e *SettingError) Error() string {
+	return fmt.Sprintf("%s %s", e.Setting, e.Reason)
+}
+
+// QueueSetting describes a setting of a queue, the type and range of values it takes, and its default
+type QueueSetting struct {
+	Name        string      `json:"name"`
+	Type        SettingType `json:"type"`
+	Default     string      `json:"default"`
+	Min         *float64    `json:"min,omitempty"`
+	Max         *float64    `json:"max,omitempty"`
+	Description string      `json:"description"`
+	// Returned in place of a SettingError when a value is out of range, where an error already existed for it
+	outOfRange error
+	// Validates the setting against the queue, or its other settings, once its own value checks out
+	check func(cfg *Config, queueName string, settings map[string]string) error
+}
+
+func bound(value float64) *float64 {
+	return &value
+}
+
+// QueueSettings is the registry of every setting a queue has
+var QueueSettings = []QueueSetting{
+	{
+		Name: VisibilityTimeout, Type: FloatSetting, Default: "30", Min: bound(0),
+		Description: "Seconds a received message stays in flight before it can be received again",
+		outOfRange:  ErrInvalidVisibilityTimeout,
+	},
+	{
+		Name: PartitionCount, Type: IntSetting, Default: "5", Min: bound(1),
+		Description: "Unused, kept for queues created by older versions",
+	},
+	{
+		Name: MinPartitions, Type: IntSetting, Default: "1", Min: bound(1),
+		Description: "Fewest partitions each node keeps for the queue",
+		check:       checkPartitionRange,
+	},
+	{
+		Name: MaxPartitions, Type: IntSetting, Default: "10", Min: bound(1),
+		Description: "Most partitions each node keeps for the queue",
+		check:       checkPartitionRange,
+	},
+	{
+		Name: MaxPartitionAge, Type: FloatSetting, Default: "432000", Min: bound(0),
+		Description: "Seconds a partition can go unused before it is removed",
+	},
+	{
+		Name: CompressedMessages, Type: BoolSetting, Default: "false",
+		Description: "Whether message bodies are compressed when they are stored",
+	},
+	{
+		Name: MaxReceiveCount, Type: IntSetting, Default: "0", Min: bound(0),
+		Description: "Times a message can be received before it is moved to the dead letter queue. 0 means no limit",
+	},
+	{
+		Name: DeadLetterQueue, Type: StringSetting, Default: "",
+		Description: "Queue that messages received more than max_receive_count times are moved to. Empty turns dead lettering off",
+		check: func(cfg *Config, queueName string, settings map[string]string) error {
+			deadLetterQueue := settings[DeadLetterQueue]
+			if deadLetterQueue != "" && (deadLetterQueue == queueName || !cfg.Queues.Exists(cfg, deadLetterQueue)) {
+				return ErrInvalidDeadLetterQueue
+			}
+			return nil
+		},
+	},
+	{
+		Name: DelaySeconds, Type: FloatSetting, Default: "0", Min: bound(0),
+		Description: "Seconds new messages stay invisible before their first delivery",
+		outOfRange:  ErrInvalidDelay,
+	},
+	{
+		Name: MessageRetentionPeriod, Type: FloatSetting, Default: "345600", Min: bound(0),
+		Description: "Seconds a message is kept before it expires. 0 keeps messages forever",
+		outOfRange:  ErrInvalidRetentionPeriod,
+	},
+	{
+		Name: WaitTimeSeconds, Type: FloatSetting, Default: "0", Min: bound(0), Max: bound(MaxWaitTimeSeconds),
+		Description: "Seconds a receive waits for messages to arrive when none are available",
+		outOfRange:  ErrInvalidWaitTime,
+	},
+	{
+		Name: DeduplicationWindow, Type: FloatSetting, Default: "0", Min: bound(0),
+		Description: "Seconds a message published with the same deduplication id is dropped as a duplicate. 0 turns deduplication off",
+		outOfRange:  ErrInvalidDeduplicationWindow,
+	},
+	{
+		Name: ContentBasedDeduplication, Type: BoolSetting, Default: "false",
+		Description: "Whether messages published without a deduplication id are deduplicated on a hash of their body",
+	},
+	{
+		Name: Fifo, Type: BoolSetting, Default: "false",
+		Description: "Whether messages are delivered in the order they were published within their message group",
+	},
+}
+
+// InvalidSetting returns true if the error is from a queue setting failing validation, rather than from storing it
+func InvalidSetting(err error) bool {
+	if err == nil {
+		return false
+	}
+	if _, ok := err.(*SettingError); ok {
+		return true
+	}
+	if err == ErrInvalidPartitionRange || err == ErrInvalidDeadLetterQueue {
+		return true
+	}
+	for _, setting := range QueueSettings {
+		if setting.outOfRange != nil && err == setting.outOfRange {
+			return true
+		}
+	}
+	return false
+}
+
+// LookupQueueSetting returns the setting with the given name, or false if there is no such setting
+func LookupQueueSetting(name string) (QueueSetting, bool) {
+	for _, setting := range QueueSettings {
+		if setting.Name == name {
+			return setting, true
+		}
+	}
+	return QueueSetting{}, false
+}
+
+func settingNames() []string {
+	names := make([]string, 0, len(QueueSettings))
+	for _, setting := range QueueSettings {
+		names = append(names, setting.Name)
+	}
+	return names
+}
+
+func settingDefaults() map[string]string {
+	defaults := make(map[string]string)
+	for _, setting := range QueueSettings {
+		defaults[setting.Name] = setting.Default
+	}
+	return defaults
+}
+
+// Format converts a value decoded from JSON into the form the setting is stored in
+func (setting QueueSetting) Format(value interface{}) (string, error) {
+	switch setting.Type {
+	case IntSetting:
+		number, ok := value.(float64)
+		if ok && number == math.Trunc(number) {
+			return strconv.FormatInt(int64(number), 10), nil
+		}
+	case FloatSetting:
+		if number, ok := value.(float64); ok {
+			return strconv.FormatFloat(number, 'f', -1, 64), nil
+		}
+	case BoolSetting:
+		if flag, ok := value.(bool); ok {
+			return strconv.FormatBool(flag), nil
+		}
+	case StringSetting:
+		if text, ok := value.(string); ok {
+			return text, nil
+		}
+	}
+	return "", &SettingError{Setting: setting.Name, Reason: fmt.Sprintf("must be of type %s", setting.Type)}
+}
+
+// validate checks the stored form of the value is of the right type, and in range
+func (setting QueueSetting) validate(value string) error {
+	var number float64
+	var err error
+	switch setting.Type {
+	case IntSetting:
+		var whole int
+		whole, err = strconv.Atoi(value)
+		number = float64(whole)
+	case FloatSetting:
+		number, err = strconv.ParseFloat(value, 64)
+	case BoolSetting:
+		_, err = strconv.ParseBool(value)
+	}
+	if err != nil {
+		return &SettingError{Setting: setting.Name, Reason: fmt.Sprintf("must be of type %s", setting.Type)}
+	}
+	if (setting.Min != nil && number < *setting.Min) || (setting.Max != nil && number > *setting.Max) {
+		if setting.outOfRange != nil {
+			return setting.outOfRange
+		}
+		return &SettingError{Setting: setting.Name, Reason: setting.rangeDescription()}
+	}
+	return nil
+}
+
+func (setting QueueSetting) rangeDescription() string {
+	switch {
+	case setting.Min != nil && setting.Max != nil:
+		return fmt.Sprintf("must be between %v and %v", *setting.Min, *setting.Max)
+	case setting.Min != nil:
+		return fmt.Sprintf("must be at least %v", *setting.Min)
+	default:
+		return fmt.Sprintf("must be at most %v", *setting.Max)
+	}
+}
+
+func checkPartitionRange(cfg *Config, queueName string, settings map[string]string) error {
+	minPartitions, _ := strconv.Atoi(settings[MinPartitions])
+	maxPartitions, _ := strconv.Atoi(settings[MaxPartitions])
+	if minPartitions > maxPartitions {
+		return ErrInvalidPartitionRange
+	}
+	return nil
+}
+
+// ValidateQueueSettings checks each of the settings is known, of the right type and in range, and
+// agrees with the rest of the queues settings. A queue which doesn't exist yet is checked against the defaults
+func (cfg *Config) ValidateQueueSettings(queueName string, settings map[string]string) error {
+	current, err := cfg.queueSettings(queueName)
+	if err != nil && err != backend.ErrNotFound {
+		return err
+	}
+	return cfg.validateQueueSettings(queueName, current, settings)
+}
+
+// validateQueueSettings checks the settings, as they would be applied on top of the current settings
+func (cfg *Config) validateQueueSettings(queueName string, current map[string]string, settings map[string]string) error {
+	merged := make(map[string]string)
+	for name, value := range current {
+		merged[name] = value
+	}
+	for name, value := range settings {
+		setting, known := LookupQueueSetting(name)
+		if !known {
+			return &SettingError{Setting: name, Reason: "is not a known setting"}
+		}
+		err := setting.validate(value)
+		if err != nil {
+			return err
+		}
+		merged[name] = value
+	}
+	// Check in registry order, so the same bad request always gets the same error
+	for _, setting := range QueueSettings {
+		if _, changed := settings[setting.Name]; !changed || setting.check == nil {
+			continue
+		}
+		err := setting.check(cfg, queueName, merged)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SetQueueSettings validates the settings, then stores them for the queue in a single write. They take
+// effect on this node straight away, and are announced to the others
+func (cfg *Config) SetQueueSettings(queueName string, settings map[string]string) error {
+	current, err := cfg.queueSettings(queueName)
+	if err != nil {
+		return err
+	}
+	err = cfg.validateQueueSettings(queueName, current, settings)
+	if err != nil || len(settings) == 0 {
+		return err
+	}
+	err = cfg.Backend.UpdateRegisters(queueConfigRecordName(queueName), settings)
+	if err != nil {
+		return err
+	}
+	if queue, present := cfg.Queues.getQueue(queueName); present {
+		queue.refreshConfig(cfg)
+	}
+	cfg.Gossip.Announce(ConfigQueue, queueName)
+	return nil
+}
+
+// queueSettings returns every stored setting of the queue, using the defaults for any it was created
+// without. If the queue has no config, the defaults are returned along with ErrNotFound
+func (cfg *Config) queueSettings(queueName string) (map[string]string, error) {
+	configMap, err := cfg.Backend.FetchMap(queueConfigRecordName(queueName))
+	if err != nil && err != backend.ErrNotFound {
+		return nil, err
+	}
+	settings := make(map[string]string)
+	for _, setting := range QueueSettings {
+		if value, present := configMap.FetchRegister(setting.Name); present {
+			settings[setting.Name] = value
+		}
+	}
+	return queueRegisters(settings), err
+}
+
+// typedSetting returns the setting of the queue if it parses, otherwise the default along with the error
+func (cfg *Config) typedSetting(name string, queueName string, parse func(string) error) (string, error) {
+	val, err := cfg.getQueueSetting(name, queueName)
+	if err == nil {
+		err = parse(val)
+		if err == nil {
+			return val, nil
+		}
+		logrus.Errorf("Setting %s of queue %s holds %q, using the default: %s", name, queueName, val, err)
+	}
+	return DefaultSettings[name], err
+}
+
+func (cfg *Config) getIntSetting(name string, queueName string) (int, error) {
+	val, err := cfg.typedSetting(name, queueName, func(val string) error {
+		_, err := strconv.Atoi(val)
+		return err
+	})
+	parsed, _ := strconv.Atoi(val)
+	return parsed, err
+}
+
+func (cfg *Config) getFloatSetting(name string, queueName string) (float64, error) {
+	val, err := cfg.typedSetting(name, queueName, func(val string) error {
+		_, err := strconv.ParseFloat(val, 64)
+		return err
+	})
+	parsed, _ := strconv.ParseFloat(val, 64)
+	return parsed, err
+}
+
+func (cfg *Config) getBoolSetting(name string, queueName string) (bool, error) {
+	val, err := cfg.typedSetting(name, queueName, func(val string) error {
+		_, err := strconv.ParseBool(val)
+		return err
+	})
+	parsed, _ := strconv.ParseBool(val)
+	return parsed, err
+}
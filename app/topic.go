@@ -6,16 +6,16 @@ import (
 	"time"
 
 	"github.com/Sirupsen/logrus"
-	"github.com/tpjg/goriakpbc"
+	"github.com/Tapjoy/dynamiq/app/backend"
 )
 
 // Topic represents a topic
 type Topic struct {
-	// store a CRDT in riak for the topic configuration including subscribers
-	Name     string
-	Config   *riak.RDtMap
-	riakPool *riak.Client
-	queues   *Queues
+	// store a CRDT in the backend for the topic configuration including subscribers
+	Name    string
+	Config  *backend.Map
+	backend backend.Backend
+	queues  *Queues
 	// Mutex for protecting rw access to the Config object
 	sync.RWMutex
 }
@@ -23,44 +23,48 @@ type Topic struct {
 // Topics represents a collection of topics
 type Topics struct {
 	// global topic configuration, should contain list of all active topics
-	Config *riak.RDtMap
+	Config *backend.Map
 	// topic map
 	TopicMap map[string]*Topic
-	riakPool *riak.Client
+	backend  backend.Backend
 	queues   *Queues
 	// Channels / Timer for syncing the config
 	syncScheduler *time.Ticker
 	syncKiller    chan struct{}
-	// Mutex for protecting rw access to the Config object
+	// The last time the config was read from the backend
+	lastSynced time.Time
+	// Mutex for protecting rw access to the Config object and the TopicMap
 	sync.RWMutex
 }
 
 // InitTopics initializes the set of known topics in the system
 func InitTopics(cfg *Config, queues *Queues) *Topics {
-	client := cfg.RiakConnection()
-	bucket, err := client.NewBucketType("maps", "config")
-	if err != nil {
-		logrus.Error(err)
-	}
-	config, err := bucket.FetchMap("topicsConfig")
-	if err != nil {
+	config, err := cfg.Backend.FetchMap("topicsConfig")
+	if err != nil && err != backend.ErrNotFound {
 		logrus.Error(err)
 	}
 	if config.FetchSet("topics") == nil {
-		topicSet := config.AddSet("topics")
 		// TODO Investigate if this is still the case
 		//there's a bug in the protobufs client/cant have an empty set
-		topicSet.Add([]byte("default_topic"))
-		err = config.Store()
+		err = cfg.Backend.AddToSet("topicsConfig", "topics", "default_topic")
+		if err == nil {
+			config, err = cfg.Backend.FetchMap("topicsConfig")
+		}
 	}
 	if err != nil {
 		logrus.Error(err)
 	}
+	var lastSynced time.Time
+	if err == nil {
+		lastSynced = time.Now()
+	}
 	topics := Topics{
-		Config:   config,
-		riakPool: cfg.RiakPool,
-		queues:   queues,
-		TopicMap: make(map[string]*Topic),
+		Config:     config,
+		backend:    cfg.Backend,
+		queues:     queues,
+		TopicMap:   make(map[string]*Topic),
+		syncKiller: make(chan struct{}),
+		lastSynced: lastSynced,
 	}
 	go topics.scheduleSync(cfg)
 	return &topics
@@ -73,44 +77,101 @@ func (topics *Topics) InitTopic(name string) {
 	// 1. Create new topics
 	// 2. Populate the initial list of topics during the syncConfig boot up
 	// We should split the use cases so we don't do excess calls to Riak when booting up
-	// to re-save the topic config and topics config. As-is, there is no detriment to the save calls, it's just wasted time
-	client := topics.riakPool
-	bucket, _ := client.NewBucketType("maps", ConfigurationBucket)
-	config, _ := bucket.FetchMap(topicConfigRecordName(name))
+	// to re-save the topics config. As-is, there is no detriment to the save calls, it's just wasted time
+	config, _ := topics.backend.FetchMap(topicConfigRecordName(name))
 
 	topic := new(Topic)
 	topic.Config = config
 	topic.Name = name
-	topic.riakPool = topics.riakPool
+	topic.backend = topics.backend
 	topic.queues = topics.queues
-	topics.TopicMap[name] = topic
+	topics.addTopic(topic)
 
-	// Save the topic level configuration object
-	// Currently, we do not have any options here, marked for future use
-	topic.Config.Store()
+	// Add the topic to the backend
+	err := topics.backend.AddToSet("topicsConfig", "topics", name)
+	if err != nil {
+		logrus.Error(err)
+	}
+}
 
-	// Add the queue to the riak store
-	topics.Config.FetchSet("topics").Add([]byte(name))
-	topics.Config.Store()
+// CreateTopic initializes the topic, and announces it to the other nodes
+func (topics *Topics) CreateTopic(cfg *Config, name string) {
+	topics.InitTopic(name)
+	cfg.Gossip.Announce(ConfigTopic, name)
 }
 
-// Broadcast will send the message to all listening queues and return the acked writes
+// Broadcast will send the message to all listening queues and return the acked writes. Each
+// queue delays the message by its own delay_seconds setting
 func (topic *Topic) Broadcast(cfg *Config, message string) map[string]string {
+	return topic.broadcast(func(queue *Queue) string {
+		return queue.Put(cfg, message)
+	})
+}
+
+// BroadcastWithDelay will send the message to all listening queues, delayed by the given number of
+// seconds regardless of the queues settings, and return the acked writes
+func (topic *Topic) BroadcastWithDelay(cfg *Config, message string, delay float64) map[string]string {
+	return topic.broadcast(func(queue *Queue) string {
+		return queue.PutWithDelay(cfg, message, delay)
+	})
+}
+
+// Publish will send the message, along with its content type and attributes, to all listening queues
+// and return the acked writes. Unless the message has its own delay, each queue delays it by its own
+// delay_seconds setting
+func (topic *Topic) Publish(cfg *Config, message PublishMessage) map[string]string {
+	return topic.broadcast(func(queue *Queue) string {
+		uuid, err := queue.Publish(cfg, message)
+		if err != nil {
+			logrus.Error(err)
+		}
+		return uuid
+	})
+}
+
+// BatchBroadcast will send each of the messages to all listening queues and return the outcome of
+// every write, per queue, in the order given
+func (topic *Topic) BatchBroadcast(cfg *Config, messages []PublishMessage) map[string][]PutResult {
+	return topic.batchBroadcast(func(queue *Queue) []PutResult {
+		return queue.BatchPut(cfg, messages)
+	})
+}
+
+func (topic *Topic) batchBroadcast(put func(queue *Queue) []PutResult) map[string][]PutResult {
+	queueWrites := make(map[string][]PutResult)
+	var wg sync.WaitGroup
+	var lock sync.Mutex
+	for _, name := range topic.getConfig().FetchSet("queues") {
+		queue, present := topic.queues.getQueue(name)
+		if present != true {
+			// SNS -> SQS would simply blindly accept the write and NOOP
+			continue
+		}
+		wg.Add(1)
+		go func(name string, queue *Queue) {
+			defer wg.Done()
+			results := put(queue)
+			lock.Lock()
+			queueWrites[name] = results
+			lock.Unlock()
+		}(name, queue)
+	}
+	wg.Wait()
+	return queueWrites
+}
+
+func (topic *Topic) broadcast(put func(queue *Queue) string) map[string]string {
 	queueWrites := make(map[string]string)
 	// If we haven't mapped any queues to this topic yet, this will be nil
-	topicQueues := topic.getConfig().FetchSet("queues")
-	if topicQueues != nil {
-		for _, queue := range topicQueues.GetValue() {
-			//check if we've initialized this queue yet
-			var present bool
-			_, present = topic.queues.QueueMap[string(queue)]
-			if present == true {
-				uuid := topic.queues.QueueMap[string(queue)].Put(cfg, message)
-				queueWrites[string(queue)] = uuid
-			} else {
-				// Return something indicating no queue?
-				// SNS -> SQS would simply blindly accept the write and NOOP
-			}
+	for _, queue := range topic.getConfig().FetchSet("queues") {
+		//check if we've initialized this queue yet
+		known, present := topic.queues.getQueue(queue)
+		if present == true {
+			uuid := put(known)
+			queueWrites[queue] = uuid
+		} else {
+			// Return something indicating no queue?
+			// SNS -> SQS would simply blindly accept the write and NOOP
 		}
 	}
 	return queueWrites
@@ -118,31 +179,26 @@ func (topic *Topic) Broadcast(cfg *Config, message string) map[string]string {
 
 // AddQueue adds a new queue as a subscriber to the topic
 func (topic *Topic) AddQueue(cfg *Config, name string) {
-	client := cfg.RiakConnection()
-
-	bucket, err := client.NewBucketType("maps", ConfigurationBucket)
 	recordName := topicConfigRecordName(topic.Name)
-	topic.Config, err = bucket.FetchMap(recordName)
-
-	queueSet := topic.Config.AddSet("queues")
-	queueSet.Add([]byte(name))
-	topic.Config.Store()
-	topic.Config, err = bucket.FetchMap(recordName)
+	err := cfg.Backend.AddToSet(recordName, "queues", name)
+	if err != nil {
+		logrus.Error(err)
+	}
+	config, err := cfg.Backend.FetchMap(recordName)
 	if err != nil {
 		logrus.Error(err)
 	}
+	topic.updateConfig(config)
+	cfg.Gossip.Announce(ConfigTopic, topic.Name)
 }
 
 // DeleteQueue will remove a queue from the list of topic subscribers
 func (topic *Topic) DeleteQueue(cfg *Config, name string) {
-	client := cfg.RiakConnection()
 	recordName := topicConfigRecordName(topic.Name)
-	bucket, _ := client.NewBucketType("maps", ConfigurationBucket)
-	topic.Config, _ = bucket.FetchMap(recordName)
-
-	topic.Config.FetchSet("queues").Remove([]byte(name))
-	topic.Config.Store()
-	topic.Config, _ = bucket.FetchMap(recordName)
+	cfg.Backend.RemoveFromSet(recordName, "queues", name)
+	config, _ := cfg.Backend.FetchMap(recordName)
+	topic.updateConfig(config)
+	cfg.Gossip.Announce(ConfigTopic, topic.Name)
 
 	//TODO Need de-nitialize queue analog to initialize
 
@@ -151,11 +207,8 @@ func (topic *Topic) DeleteQueue(cfg *Config, name string) {
 // ListQueues will return a list of all known queues for a topic
 func (topic *Topic) ListQueues() []string {
 	list := make([]string, 0, 10)
-	queueList := topic.Config.FetchSet("queues")
-	if queueList != nil {
-		for _, queueName := range queueList.GetValue() {
-			list = append(list, string(queueName))
-		}
+	for _, queueName := range topic.getConfig().FetchSet("queues") {
+		list = append(list, queueName)
 	}
 	return list
 }
@@ -163,22 +216,14 @@ func (topic *Topic) ListQueues() []string {
 // DeleteTopic will delete the topic from the collection of all topics, which
 // removes any queues it's subscription list
 func (topics *Topics) DeleteTopic(cfg *Config, name string) bool {
-	client := cfg.RiakConnection()
-	bucket, err := client.NewBucketType("maps", "config")
-	topicsConfig, err := bucket.FetchMap("topicsConfig")
+	err := cfg.Backend.RemoveFromSet("topicsConfig", "topics", name)
 	if err != nil {
 		logrus.Error(err)
 	}
-	topicsConfig.FetchSet("topics").Remove([]byte(name))
-	err = topicsConfig.Store()
-	if err != nil {
-		logrus.Error(err)
+	if topic, present := topics.dropTopic(name); present {
+		topic.Delete(cfg)
 	}
-	// Lock while we modify the topic name hash
-	topics.Lock()
-	topics.TopicMap[name].Delete(cfg)
-	delete(topics.TopicMap, name)
-	topics.Unlock()
+	cfg.Gossip.Announce(ConfigTopic, name)
 
 	if err != nil {
 		logrus.Error(err)
@@ -190,15 +235,10 @@ func (topics *Topics) DeleteTopic(cfg *Config, name string) bool {
 // Delete will delete the given topic, which removes any queues from its subscription
 // list
 func (topic *Topic) Delete(cfg *Config) {
-	client := cfg.RiakConnection()
-
-	bucket, _ := client.NewBucketType("maps", "config")
-	recordName := topicConfigRecordName(topic.Name)
-	topicConfig, err := bucket.FetchMap(recordName)
+	err := cfg.Backend.DeleteMap(topicConfigRecordName(topic.Name))
 	if err != nil {
 		logrus.Error(err)
 	}
-	topicConfig.Destroy()
 }
 
 func (topics *Topics) scheduleSync(cfg *Config) {
@@ -222,54 +262,50 @@ func (topics *Topics) scheduleSync(cfg *Config) {
 	}(cfg)
 }
 
+// stopSync stops syncing the topics config with the backend
+func (topics *Topics) stopSync() {
+	if topics.syncKiller != nil {
+		close(topics.syncKiller)
+	}
+}
+
 //helpers
 //TODO move error handling for empty config in riak to initializer
 func (topics *Topics) syncConfig(cfg *Config) {
-	logrus.Debug("syncing Topic config with Riak")
-	//refresh the topic RDtMap
-	client := cfg.RiakConnection()
-	bucket, err := client.NewBucketType("maps", ConfigurationBucket)
-	if err != nil {
-		// This is likely caused by a network blip against the riak node, or the node being down
-		// In lieu of hard-failing the service, which can recover once riak comes back, we'll simply
-		// skip this iteration of the config sync, and try again at the next interval
-		logrus.Error("There was an error attempting to read the from the configuration bucket")
-		logrus.Error(err)
-		return
-	}
+	logrus.Debug("syncing Topic config with the backend")
 	//fetch the map ignore error for event that map doesn't exist
 	//TODO make these keys configurable?
 	//Question is this thread safe...?
-	topicsConfig, err := bucket.FetchMap("topicsConfig")
+	topicsConfig, err := cfg.Backend.FetchMap("topicsConfig")
 	if err != nil {
-		if err.Error() == "Object not found" {
+		if err == backend.ErrNotFound {
 			// This means there are no topics yet
 			// We don't need to log this, and we don't need to get held up on it.
 		} else {
-			// This is likely caused by a network blip against the riak node, or the node being down
-			// In lieu of hard-failing the service, which can recover once riak comes back, we'll simply
+			// This is likely caused by a network blip against the backend, or the node being down
+			// In lieu of hard-failing the service, which can recover once the backend comes back, we'll simply
 			// skip this iteration of the config sync, and try again at the next interval
-			logrus.Error("There was an error attempting to read from the topic configuration map in the configuration bucket")
+			logrus.Error("There was an error attempting to read from the topic configuration map")
 			logrus.Error(err)
 			return
 		}
 	}
 	topics.updateConfig(topicsConfig)
+	topics.markSynced()
 
 	//iterate the map and add or remove topics that need to be destroyed
-	topicSlice := topics.Config.FetchSet("topics").GetValue()
+	topicSlice := topics.getConfig().FetchSet("topics")
 	if topicSlice == nil {
 		//bail if there aren't any topics
 		return
 	}
 	//Is there a better way to do this?
 
-	//iterate over the topics in riak and add the missing ones
+	//iterate over the topics in the backend and add the missing ones
 	topicsToKeep := make(map[string]bool)
-	for _, topic := range topicSlice {
-		topicName := string(topic)
+	for _, topicName := range topicSlice {
 		var present bool
-		_, present = topics.TopicMap[topicName]
+		_, present = topics.getTopic(topicName)
 		if present != true {
 			topics.InitTopic(topicName)
 		}
@@ -277,61 +313,132 @@ func (topics *Topics) syncConfig(cfg *Config) {
 
 	}
 	//iterate over the topics in topics.TopicMap and delete the ones no longer used
-	for topic := range topics.TopicMap {
+	for _, topic := range topics.topicList() {
 		var present bool
-		_, present = topicsToKeep[topic]
+		_, present = topicsToKeep[topic.Name]
 		if present != true {
-			delete(topics.TopicMap, topic)
+			topics.dropTopic(topic.Name)
 		}
 	}
 
-	//sync all topics with riak
-	for _, topic := range topics.TopicMap {
+	//sync all topics with the backend
+	for _, topic := range topics.topicList() {
 		topic.syncConfig()
 	}
 }
 
-func (topic *Topic) syncConfig() {
-	//refresh the topic RDtMap
-	client := topic.riakPool
-	bucket, err := client.NewBucketType("maps", ConfigurationBucket)
-	if err != nil {
+// refreshTopic brings the named topic on this node up to date with the backend, adding or
+// removing it if it was created or deleted elsewhere
+func (topics *Topics) refreshTopic(cfg *Config, name string) {
+	topicsConfig, err := cfg.Backend.FetchMap("topicsConfig")
+	if err != nil && err != backend.ErrNotFound {
 		logrus.Error(err)
+		return
 	}
-	recordName := topicConfigRecordName(topic.Name)
-	rCfg, err := bucket.FetchMap(recordName)
+	exists := false
+	for _, topicName := range topicsConfig.FetchSet("topics") {
+		if topicName == name {
+			exists = true
+		}
+	}
+	topic, present := topics.getTopic(name)
+
+	switch {
+	case exists && present:
+		topic.syncConfig()
+	case exists:
+		topics.InitTopic(name)
+	case present:
+		topics.dropTopic(name)
+	}
+}
+
+func (topic *Topic) syncConfig() {
+	//refresh the topic config map
+	rCfg, err := topic.backend.FetchMap(topicConfigRecordName(topic.Name))
+	// A topic without any subscribers has nothing stored for it yet, so not found is expected
 	// We need to remove the notion of the default topic, as we no longer need it
 	// For older installations that still have this topic, lets prevent it from being noisy
-	if err != nil && topic.Name != "default_topic" {
+	if err != nil && err != backend.ErrNotFound && topic.Name != "default_topic" {
 		logrus.Error(err)
 	}
 	topic.updateConfig(rCfg)
 }
 
-func (topic *Topic) updateConfig(rCfg *riak.RDtMap) {
+func (topic *Topic) updateConfig(rCfg *backend.Map) {
 	topic.Lock()
 	defer topic.Unlock()
 	topic.Config = rCfg
 }
 
-func (topic *Topic) getConfig() *riak.RDtMap {
+func (topic *Topic) getConfig() *backend.Map {
 	topic.RLock()
 	defer topic.RUnlock()
 	return topic.Config
 }
 
-func (topics *Topics) updateConfig(rCfg *riak.RDtMap) {
+func (topics *Topics) updateConfig(rCfg *backend.Map) {
 	topics.Lock()
 	defer topics.Unlock()
 	topics.Config = rCfg
 }
 
-func (topics *Topics) getConfig() *riak.RDtMap {
+func (topics *Topics) getConfig() *backend.Map {
 	topics.RLock()
 	defer topics.RUnlock()
 	return topics.Config
 }
 
+// getTopic returns the named topic, if it is known to this node
+func (topics *Topics) getTopic(name string) (*Topic, bool) {
+	topics.RLock()
+	defer topics.RUnlock()
+	topic, present := topics.TopicMap[name]
+	return topic, present
+}
+
+// addTopic makes the topic known to this node, unless one with the same name already is
+func (topics *Topics) addTopic(topic *Topic) {
+	topics.Lock()
+	defer topics.Unlock()
+	if _, present := topics.TopicMap[topic.Name]; !present {
+		topics.TopicMap[topic.Name] = topic
+	}
+}
+
+// dropTopic forgets the named topic on this node, returning it if it was known
+func (topics *Topics) dropTopic(name string) (*Topic, bool) {
+	topics.Lock()
+	defer topics.Unlock()
+	topic, present := topics.TopicMap[name]
+	delete(topics.TopicMap, name)
+	return topic, present
+}
+
+// topicList returns the topics known to this node, safe to range over while topics come and go
+func (topics *Topics) topicList() []*Topic {
+	topics.RLock()
+	defer topics.RUnlock()
+	list := make([]*Topic, 0, len(topics.TopicMap))
+	for _, topic := range topics.TopicMap {
+		list = append(list, topic)
+	}
+	return list
+}
+
+func (topics *Topics) markSynced() {
+	topics.Lock()
+	defer topics.Unlock()
+	topics.lastSynced = time.Now()
+}
+
+// LastSynced returns the last time the topics config was read from the backend, or the zero time if it never was
+func (topics *Topics) LastSynced() time.Time {
+	topics.RLock()
+	defer topics.RUnlock()
+	return topics.lastSynced
+}
+
 func topicConfigRecordName(topicName string) string {
 	return fmt.Sprintf("topic_%s_config", topicName)
 }
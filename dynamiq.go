@@ -27,7 +27,16 @@ func main() {
 	}
 	logrus.SetLevel(cfg.Core.LogLevel)
 
-	list, _, err := app.InitMemberList(cfg.Core.Name, cfg.Core.Port, cfg.Core.SeedServers, cfg.Core.SeedPort)
+	cfg.Topology = app.NewTopology(cfg)
+	cfg.Gossip = app.NewGossip(cfg)
+	list, _, err := app.InitMemberList(cfg.Core.Name, cfg.Core.Port, cfg.Core.SeedServers, cfg.Core.SeedPort, cfg.Topology, cfg.Gossip)
+	// Start out on the members we joined with, rather than waiting on them to settle
+	cfg.Topology.Rebalance(list)
+	cfg.Topology.ScheduleRebalance(list)
+	cfg.Gossip.ScheduleRefresh()
+	cfg.Drain = app.NewDrain(cfg, list)
+	app.ScheduleLeaseRenewal(cfg, list)
+	cfg.Queues.ScheduleExpiry(cfg, list)
 	httpAPI := app.HTTPApiV1{}
 
 	httpAPI.InitWebserver(list, cfg)